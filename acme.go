@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	acmeHosts = flag.String("acme_hosts", "", "Comma-separated domains to get Let's Encrypt certificates for when the UI is exposed directly (empty disables ACME)")
+	acmeCache = flag.String("acme_cache", "acme-cache", "Directory where ACME account keys and certificates are kept between restarts")
+)
+
+// parseACMEHosts reads the acme_hosts setting.
+func parseACMEHosts(s string) ([]string, error) {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		if strings.ContainsAny(h, ":/") {
+			return nil, fmt.Errorf("%q is not a domain name", h)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// acmeTLSConfig returns a TLS configuration that gets and renews
+// certificates from Let's Encrypt for the allowed hosts. The challenge is
+// answered over TLS on the service port, which must be reachable as port 443.
+func acmeTLSConfig() (*tls.Config, error) {
+	hosts, err := parseACMEHosts(*acmeHosts)
+	if err != nil {
+		return nil, err
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(*acmeCache),
+	}
+	slog.Info("Using ACME certificates", "hosts", hosts, "cache", *acmeCache)
+	return m.TLSConfig(), nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var adminToken = flag.String("admin_token", "", "Password for the /admin page and admin APIs (empty disables them)")
+
+// requireAdmin guards admin handlers with the admin token, given either as a
+// bearer token or as the password for HTTP basic authentication.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		tier := tierForPath(req.URL.Path)
+		if *adminToken == "" {
+			writeError(resp, tier, withCode(codeAdminDisabled, http.StatusNotFound, errors.New("set admin_token to enable the admin page")))
+			return
+		}
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, _ = req.BasicAuth()
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			resp.Header().Set("WWW-Authenticate", `Basic realm="topdog admin"`)
+			writeError(resp, tier, withCode(codeAdminAuth, http.StatusUnauthorized, errors.New("the admin token is required")))
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// adminSettings are the runtime settings changed from the admin page. In a
+// request, missing fields are left alone.
+type adminSettings struct {
+	Weights      *string  `json:"weights,omitempty"`      // same format as the weights flag
+	ErrorRate    *float64 `json:"errorRate,omitempty"`    // injected failures, 0 to 1
+	Latency      *string  `json:"latency,omitempty"`      // injected delay, like 200ms
+	Ready        *bool    `json:"ready,omitempty"`        // false fails /readyz
+	Strategy     *int     `json:"strategy,omitempty"`     // voting behavior version, 0 to follow version
+	Maintenance  *bool    `json:"maintenance,omitempty"`  // true answers non-admin routes with 503
+	DelayProfile *string  `json:"delayProfile,omitempty"` // backend latency profile, such as bimodal
+	ErrorProfile *string  `json:"errorProfile,omitempty"` // scripted backend failures, such as every-5th-503
+}
+
+// currentSettings returns all of the runtime settings.
+func currentSettings() adminSettings {
+	w := currentWeights()
+	f := currentFaults()
+	l := f.latency.String()
+	r := !drained.Load()
+	s := int(voteStrategy.Load())
+	m := maintenance.Load()
+	d := currentDelayProfile()
+	e := currentErrorProfile().name
+	return adminSettings{Weights: &w, ErrorRate: &f.errorRate, Latency: &l, Ready: &r, Strategy: &s, Maintenance: &m, DelayProfile: &d, ErrorProfile: &e}
+}
+
+// applySettings checks the given settings and then applies them together.
+// The source says where they came from, for the version log.
+func applySettings(ctx context.Context, s adminSettings, source string) error {
+	f := currentFaults()
+	if s.ErrorRate != nil {
+		f.errorRate = *s.ErrorRate
+	}
+	if s.Latency != nil {
+		d, err := time.ParseDuration(*s.Latency)
+		if err != nil {
+			return fmt.Errorf("latency: %w", err)
+		}
+		f.latency = d
+	}
+	if s.Strategy != nil && (*s.Strategy < 0 || *s.Strategy > 3) {
+		return fmt.Errorf("strategy %d is not 0, 1, 2, or 3", *s.Strategy)
+	}
+	if s.Weights != nil {
+		if _, err := buildSamplers(*s.Weights); err != nil {
+			return fmt.Errorf("weights: %w", err)
+		}
+	}
+	if s.DelayProfile != nil {
+		if err := checkDelayProfile(*s.DelayProfile); err != nil {
+			return err
+		}
+	}
+	if s.ErrorProfile != nil {
+		if err := checkErrorProfile(*s.ErrorProfile); err != nil {
+			return err
+		}
+	}
+	if err := setFaults(f); err != nil {
+		return err
+	}
+	if s.Weights != nil {
+		setWeights(ctx, *s.Weights)
+	}
+	if s.Ready != nil {
+		if was := drained.Swap(!*s.Ready); was != !*s.Ready {
+			if *s.Ready {
+				recordEvent(eventDrain, "Drain ended")
+			} else {
+				recordEvent(eventDrain, "Drain started")
+			}
+		}
+	}
+	if s.Strategy != nil {
+		setStrategy(ctx, *s.Strategy, source)
+	}
+	if s.Maintenance != nil {
+		setMaintenance(ctx, *s.Maintenance)
+	}
+	if s.DelayProfile != nil {
+		setDelayProfile(ctx, *s.DelayProfile)
+	}
+	if s.ErrorProfile != nil {
+		setErrorProfile(ctx, *s.ErrorProfile)
+	}
+	return nil
+}
+
+// adminAPI returns the runtime settings, and changes them on PUT or POST.
+func adminAPI(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		var s adminSettings
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			writeError(resp, tierForPath(req.URL.Path), withCode(codeBadRequest, http.StatusBadRequest, err))
+			return
+		}
+		if err := applySettings(req.Context(), s, sourceAdmin); err != nil {
+			writeError(resp, tierForPath(req.URL.Path), withCode(codeBadRequest, http.StatusBadRequest, err))
+			return
+		}
+		requestLogger(req).Info("Admin settings changed", "client", clientIP(req))
+		auditRequest(req, "settings", s)
+	default:
+		resp.Header().Set("Allow", "GET, PUT, POST")
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeBadRequest, http.StatusMethodNotAllowed, errors.New(req.Method+" not allowed")))
+		return
+	}
+	b, err := json.Marshal(currentSettings())
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
+
+// adminPageData is passed to the admin template.
+type adminPageData struct {
+	Version       int
+	Dogs          []string
+	Weights       string
+	ErrorRate     float64
+	Latency       string
+	Ready         bool
+	Strategy      int
+	Maintenance   bool
+	DelayProfile  string
+	DelayProfiles []string
+	ErrorProfile  string
+	ErrorProfiles []string
+}
+
+// newAdminPageData fills in the admin template data from the current settings.
+func newAdminPageData() *adminPageData {
+	s := currentSettings()
+	return &adminPageData{
+		Version:       *version,
+		Dogs:          dogs,
+		Weights:       *s.Weights,
+		ErrorRate:     *s.ErrorRate,
+		Latency:       *s.Latency,
+		Ready:         *s.Ready,
+		Strategy:      *s.Strategy,
+		Maintenance:   *s.Maintenance,
+		DelayProfile:  *s.DelayProfile,
+		DelayProfiles: delayProfileNames(),
+		ErrorProfile:  *s.ErrorProfile,
+		ErrorProfiles: errorProfileNames(),
+	}
+}
+
+// adminPage renders the admin page, whose controls call adminAPI.
+func adminPage(resp http.ResponseWriter, req *http.Request) {
+	t, err := loadTemplates()
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeTemplateFailed, http.StatusInternalServerError, err))
+		return
+	}
+	var buf bytes.Buffer
+	if err = t.ExecuteTemplate(&buf, "admin.html", newAdminPageData()); err != nil {
+		requestLogger(req).Error("Cannot render admin.html", "err", err)
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeTemplateFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "text/html; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(buf.Bytes())
+}
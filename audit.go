@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var auditFile = flag.String("audit_log", "", "File to append admin actions to, as JSON lines (empty keeps them in memory only)")
+
+// auditMemory is how many recent entries /admin/audit shows.
+const auditMemory = 1000
+
+// auditEntry records who changed what, and when.
+type auditEntry struct {
+	Time      time.Time   `json:"time"`
+	Who       string      `json:"who"`
+	Client    string      `json:"client,omitempty"`
+	Action    string      `json:"action"`
+	Detail    interface{} `json:"detail,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+}
+
+// auditLog keeps recent entries in memory and appends every entry to the
+// audit file, if one is configured.
+var auditLog struct {
+	lock    sync.Mutex
+	entries []auditEntry
+	file    *os.File
+}
+
+// openAuditLog opens the audit file for appending.
+func openAuditLog() error {
+	if *auditFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	auditLog.file = f
+	return nil
+}
+
+// recordAudit adds an entry to the audit log.
+func recordAudit(e auditEntry) {
+	e.Time = time.Now()
+	auditLog.lock.Lock()
+	defer auditLog.lock.Unlock()
+	auditLog.entries = append(auditLog.entries, e)
+	if len(auditLog.entries) > auditMemory {
+		auditLog.entries = auditLog.entries[len(auditLog.entries)-auditMemory:]
+	}
+	if auditLog.file != nil {
+		b, err := json.Marshal(e)
+		if err == nil {
+			_, err = auditLog.file.Write(append(b, '\n'))
+		}
+		if err != nil {
+			slog.Error("Cannot write audit log", "file", *auditFile, "err", err)
+		}
+	}
+}
+
+// auditRequest records an admin action made through a request. The admin
+// token is shared, so the user name given with it, if any, says who it was.
+func auditRequest(req *http.Request, action string, detail interface{}) {
+	who, _, ok := req.BasicAuth()
+	if !ok || who == "" {
+		who = "admin"
+	}
+	recordAudit(auditEntry{
+		Who:       who,
+		Client:    fmt.Sprint(clientIP(req)),
+		Action:    action,
+		Detail:    detail,
+		RequestID: getRequestContext(req).RequestID,
+	})
+}
+
+// adminAudit returns the recent audit entries, oldest first.
+func adminAudit(resp http.ResponseWriter, req *http.Request) {
+	auditLog.lock.Lock()
+	b, err := json.Marshal(map[string]interface{}{"entries": append([]auditEntry{}, auditLog.entries...)})
+	auditLog.lock.Unlock()
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
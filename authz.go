@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var authzPolicy = flag.String("authz_policy", "", "Expected authorization policy for /authz-check, as path=principal,principal;... such as /backend=cluster.local/ns/default/sa/topdog-midtier (paths and principals may start or end with *, as in Istio)")
+
+// Results of /authz-check.
+const (
+	authzPass     = "pass"
+	authzFail     = "fail"
+	authzNoPolicy = "no policy"
+)
+
+// authzRule allows the listed source or request principals to reach a path.
+type authzRule struct {
+	Path  string   `json:"path"`
+	Allow []string `json:"allow"`
+}
+
+// parseAuthzPolicy reads the authz_policy setting into rules, in order.
+func parseAuthzPolicy(s string) ([]authzRule, error) {
+	var rules []authzRule
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, list, ok := strings.Cut(item, "=")
+		path = strings.TrimSpace(path)
+		if !ok || path == "" || (path != "*" && !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "*")) {
+			return nil, fmt.Errorf("%q is not path=principal,principal", item)
+		}
+		r := authzRule{Path: path}
+		for _, p := range strings.Split(list, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				r.Allow = append(r.Allow, p)
+			}
+		}
+		if len(r.Allow) == 0 {
+			return nil, fmt.Errorf("rule for %s allows no principals", path)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+var (
+	authzOnce  sync.Once
+	authzRules []authzRule
+)
+
+// authzPolicyRules returns the parsed authz_policy setting.
+func authzPolicyRules() []authzRule {
+	authzOnce.Do(func() {
+		authzRules, _ = parseAuthzPolicy(*authzPolicy)
+	})
+	return authzRules
+}
+
+// checkAuthzPolicy verifies the authz_policy setting.
+func checkAuthzPolicy() error {
+	_, err := parseAuthzPolicy(*authzPolicy)
+	return err
+}
+
+// istioMatch matches a value the way AuthorizationPolicy does: exactly, or
+// with a single * at the start or end of the pattern.
+func istioMatch(pattern, v string) bool {
+	switch {
+	case pattern == "*":
+		return v != ""
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(v, pattern[1:])
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(v, pattern[:len(pattern)-1])
+	}
+	return pattern == v
+}
+
+// parseXFCC splits an x-forwarded-client-cert header into its elements, one
+// per proxy that forwarded the request, each a map of lowercase keys such as
+// by, hash, subject, and uri.
+func parseXFCC(h string) []map[string]string {
+	var elems []map[string]string
+	for _, elem := range splitQuoted(h, ',') {
+		m := make(map[string]string)
+		for _, field := range splitQuoted(elem, ';') {
+			k, v, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v = strings.TrimSpace(v)
+			if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+				v = strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`)
+			}
+			m[strings.ToLower(strings.TrimSpace(k))] = v
+		}
+		if len(m) > 0 {
+			elems = append(elems, m)
+		}
+	}
+	return elems
+}
+
+// splitQuoted splits s at sep, except inside double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// authzIdentity is who a request says it comes from.
+type authzIdentity struct {
+	Principal        string `json:"principal,omitempty"`        // from the peer certificate, as in source.principal
+	RequestPrincipal string `json:"requestPrincipal,omitempty"` // iss/sub of the JWT, as in request.auth.principal
+	XFCC             string `json:"xfcc,omitempty"`
+}
+
+// requestIdentity reads the peer's SPIFFE identity from the last element of
+// x-forwarded-client-cert, which the sidecar sets from the mTLS connection,
+// and the request principal from the JWT.
+func requestIdentity(req *http.Request) authzIdentity {
+	id := authzIdentity{XFCC: req.Header.Get("X-Forwarded-Client-Cert")}
+	if elems := parseXFCC(id.XFCC); len(elems) > 0 {
+		id.Principal = strings.TrimPrefix(elems[len(elems)-1]["uri"], "spiffe://")
+	}
+	if claims := jwtClaims(req); claims != nil {
+		iss, _ := claims["iss"].(string)
+		sub, _ := claims["sub"].(string)
+		if iss != "" || sub != "" {
+			id.RequestPrincipal = iss + "/" + sub
+		}
+	}
+	return id
+}
+
+// authzResult is the outcome of /authz-check.
+type authzResult struct {
+	Path     string              `json:"path"`
+	Identity authzIdentity       `json:"identity"`
+	Headers  map[string][]string `json:"headers"`
+	Rule     *authzRule          `json:"rule,omitempty"`
+	Matched  string              `json:"matched,omitempty"`
+	Result   string              `json:"result"`
+	Reason   string              `json:"reason"`
+}
+
+// evaluateAuthz checks an identity against the first rule for path. As with
+// an Istio ALLOW policy, a path no rule covers is denied once any rule is
+// configured.
+func evaluateAuthz(rules []authzRule, path string, id authzIdentity) authzResult {
+	r := authzResult{Path: path, Identity: id}
+	if len(rules) == 0 {
+		r.Result, r.Reason = authzNoPolicy, "authz_policy is not set"
+		return r
+	}
+	for i := range rules {
+		if !istioMatch(rules[i].Path, path) {
+			continue
+		}
+		r.Rule = &rules[i]
+		for _, allow := range rules[i].Allow {
+			if istioMatch(allow, id.Principal) {
+				r.Matched, r.Result, r.Reason = allow, authzPass, "principal "+id.Principal+" is allowed"
+				return r
+			}
+			if istioMatch(allow, id.RequestPrincipal) {
+				r.Matched, r.Result, r.Reason = allow, authzPass, "request principal "+id.RequestPrincipal+" is allowed"
+				return r
+			}
+		}
+		r.Result, r.Reason = authzFail, "no allowed principal matches"
+		return r
+	}
+	r.Result, r.Reason = authzFail, "no rule covers the path"
+	return r
+}
+
+// authzCheck reports the identity and headers a request arrived with and
+// whether the authz_policy table allows it to reach ?path=, or /authz-check
+// itself, answering 200 for pass and 403 for fail. Deploying it behind a
+// real AuthorizationPolicy shows whether the mesh and the expected table
+// agree.
+func authzCheck(resp http.ResponseWriter, req *http.Request) {
+	path := req.URL.Query().Get("path")
+	if path == "" {
+		path = req.URL.Path
+	}
+	r := evaluateAuthz(authzPolicyRules(), path, requestIdentity(req))
+	r.Headers = redactedHeaders(req.Header)
+	requestLogger(req).Info("Authorization check", "path", path, "result", r.Result,
+		"principal", r.Identity.Principal, "requestPrincipal", r.Identity.RequestPrincipal, "reason", r.Reason)
+
+	b, err := json.Marshal(&r)
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	if r.Result == authzFail {
+		resp.WriteHeader(http.StatusForbidden)
+	}
+	resp.Write(b)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// B3 propagation formats. See https://github.com/openzipkin/b3-propagation.
+const (
+	b3Multi  = "multi"  // x-b3-traceid, x-b3-spanid, ...
+	b3Single = "single" // b3: {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}
+	b3Both   = "both"
+)
+
+var b3Format = flag.String("b3_format", b3Multi, "B3 propagation format sent downstream (multi, single, or both)")
+
+// traceID returns the trace ID of the incoming request, from B3 or W3C
+// headers, or of our own span when the request didn't carry one.
+func traceID(req *http.Request) string {
+	c, _ := readB3(req.Header)
+	if c.traceID != "" {
+		return c.traceID
+	}
+	if sc := w3cSpanContext(req.Header); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	if sc := trace.SpanContextFromContext(req.Context()); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// b3Context is the B3 state read from either header format.
+type b3Context struct {
+	traceID      string
+	spanID       string
+	parentSpanID string
+	sampled      string // "1", "0", "d" (debug), or empty when deferred
+}
+
+// readB3 reads B3 propagation state, preferring the single header when both are present.
+func readB3(h http.Header) (b3Context, bool) {
+	if v := h.Get("b3"); v != "" {
+		return parseB3Single(v)
+	}
+	c := b3Context{
+		traceID:      h.Get("x-b3-traceid"),
+		spanID:       h.Get("x-b3-spanid"),
+		parentSpanID: h.Get("x-b3-parentspanid"),
+	}
+	switch strings.ToLower(h.Get("x-b3-sampled")) {
+	case "1", "true":
+		c.sampled = "1"
+	case "0", "false":
+		c.sampled = "0"
+	}
+	if h.Get("x-b3-flags") == "1" {
+		c.sampled = "d"
+	}
+	if c.traceID == "" && c.sampled == "" {
+		return c, false
+	}
+	return c, true
+}
+
+// parseB3Single parses the single b3 header.
+func parseB3Single(v string) (b3Context, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	var c b3Context
+	switch len(parts) {
+	case 1:
+		// sampling decision only
+		c.sampled = parts[0]
+	case 2:
+		c.traceID, c.spanID = parts[0], parts[1]
+	case 3:
+		c.traceID, c.spanID, c.sampled = parts[0], parts[1], parts[2]
+	case 4:
+		c.traceID, c.spanID, c.sampled, c.parentSpanID = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return c, false
+	}
+	switch c.sampled {
+	case "", "0", "1", "d":
+	default:
+		return c, false
+	}
+	return c, c.traceID != "" || c.sampled != ""
+}
+
+// single formats the context as a single b3 header value.
+func (c b3Context) single() string {
+	if c.traceID == "" {
+		return c.sampled
+	}
+	v := c.traceID + "-" + c.spanID
+	if c.sampled != "" {
+		v += "-" + c.sampled
+		if c.parentSpanID != "" {
+			v += "-" + c.parentSpanID
+		}
+	}
+	return v
+}
+
+// writeMulti sets the multi-header B3 form.
+func (c b3Context) writeMulti(h http.Header) {
+	if c.traceID != "" {
+		h.Set("x-b3-traceid", c.traceID)
+		h.Set("x-b3-spanid", c.spanID)
+	}
+	if c.parentSpanID != "" {
+		h.Set("x-b3-parentspanid", c.parentSpanID)
+	}
+	switch c.sampled {
+	case "d":
+		h.Set("x-b3-flags", "1")
+	case "0", "1":
+		h.Set("x-b3-sampled", c.sampled)
+	}
+}
+
+// copyB3 propagates B3 state from the incoming request in the configured format,
+// converting between single and multi-header forms as needed. When we started
+// a span for the call, it becomes the parent, and when there is no B3 state a
+// new trace is started.
+func copyB3(toReq *http.Request, fromReq *http.Request) {
+	c, ok := readB3(fromReq.Header)
+	if sc := trace.SpanContextFromContext(fromReq.Context()); sc.IsValid() && !sc.IsRemote() {
+		c, ok = b3FromSpan(c, sc), true
+	}
+	if !ok {
+		c = newB3Context(fromReq)
+	}
+	switch *b3Format {
+	case b3Single:
+		toReq.Header.Set("b3", c.single())
+	case b3Both:
+		toReq.Header.Set("b3", c.single())
+		c.writeMulti(toReq.Header)
+	default:
+		c.writeMulti(toReq.Header)
+	}
+}
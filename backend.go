@@ -1,47 +1,71 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"log"
 	"math/rand"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type backEndResponse struct {
+	SchemaVersion  int    `json:"schemaVersion,omitempty"`
 	TopDog         string `json:"topDog"`
 	BackendVersion int    `json:"backendVersion,omitempty"`
 	MidtierVersion int    `json:"midtierVersion,omitempty"`
 	UIVersion      int    `json:"uiVersion,omitempty"`
-}
+	TraceID        string `json:"traceId,omitempty"`
+	RequestID      string `json:"requestId,omitempty"`
+	Tenant         string `json:"tenant,omitempty"` // whose dogs the backend voted among
+
+	// baggage_keys entries as the backend received them
+	Baggage map[string]string `json:"baggage,omitempty"`
 
-var v1dogs = append(dogs, "mike", "mike", "mike", "mike")
+	// time each tier took, including the tiers below it
+	BackendMillis float64 `json:"backendMillis,omitempty"`
+	MidtierMillis float64 `json:"midtierMillis,omitempty"`
+	UIMillis      float64 `json:"uiMillis,omitempty"`
 
-func voteV1() (string, error) {
-	v := rand.Int31n(int32(len(v1dogs)))
-	return v1dogs[v], nil
+	retryWaited  time.Duration // time spent honoring downstream Retry-After
+	cacheHit     bool          // served from a cache at this tier or below
+	serverTiming string        // Server-Timing entries from the tiers below
 }
 
-var v2dogs = dogs
+// voteFunc picks the top dog using a version's weights.
+type voteFunc func(r *rand.Rand, s *aliasSampler) (string, error)
+
+func voteV1(r *rand.Rand, s *aliasSampler) (string, error) {
+	return s.sample(r), nil
+}
 
-func voteV2() (string, error) {
-	v := rand.Int31n(int32(len(v2dogs)))
-	ev := rand.Int31n(int32(4))
+func voteV2(r *rand.Rand, s *aliasSampler) (string, error) {
+	dog := s.sample(r)
+	ev := r.Int31n(int32(4))
 	if ev == 1 {
 		return "", errors.New("Oops")
 	}
-	return v2dogs[v], nil
+	return dog, nil
 }
 
-var v3dogs = append(dogs, "amit", "amit", "mike", "dan", "dan", "dan", "dan", "reuben", "prashanth")
+func voteV3(r *rand.Rand, s *aliasSampler) (string, error) {
+	return s.sample(r), nil
+}
+
+// voteStrategy overrides which version's voting behavior the backend uses;
+// zero follows the version flag.
+var voteStrategy atomic.Int32
 
-func voteV3() (string, error) {
-	v := rand.Int31n(int32(len(v3dogs)))
-	return v3dogs[v], nil
+// strategyVersion returns the version whose voting behavior is in effect.
+func strategyVersion() int {
+	if v := voteStrategy.Load(); v != 0 {
+		return int(v)
+	}
+	return *version
 }
 
-func getVoteFunc() func() (string, error) {
-	switch *version {
+// getVoteFunc returns the voting behavior of a version.
+func getVoteFunc(v int) voteFunc {
+	switch v {
 	case 1:
 		return voteV1
 	case 2:
@@ -53,26 +77,60 @@ func getVoteFunc() func() (string, error) {
 }
 
 func backEnd(resp http.ResponseWriter, req *http.Request) {
-	voteFunc := getVoteFunc()
-	dog, err := voteFunc()
+	if headVote(resp, req) {
+		return
+	}
+	waitForWarmup(req)
+	waitForDelayProfile(req)
+	if err := profileFault(); err != nil {
+		requestLogger(req).Warn("Vote failure", "err", err)
+		writeError(resp, tierBackend, err)
+		return
+	}
+	strategy := strategyVersion()
+	tenant := getRequestContext(req).Tenant
+	rnd := getRand()
+	dog, err := getVoteFunc(strategy)(rnd, tenantSampler(tenant, strategy))
+	if err == nil {
+		dog = biasVote(req, rnd, dog)
+	}
+	putRand(rnd)
 	if err != nil {
-		log.Print("Vote failure: ", err)
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		requestLogger(req).Warn("Vote failure", "err", err)
+		countVoteFailure()
+		writeError(resp, tierBackend, withCode(codeVoteFailed, http.StatusInternalServerError, err))
+		return
+	}
+	countVote(dog, tenant)
+	// only the UI can read the winner when field encryption is on
+	topDog, err := encryptField(dog)
+	if err != nil {
+		requestLogger(req).Error("Cannot encrypt", "err", err)
+		writeError(resp, tierBackend, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
 		return
 	}
 	r := backEndResponse{
-		TopDog:         dog,
+		TopDog:         topDog,
 		BackendVersion: *version,
+		RequestID:      getRequestContext(req).RequestID,
+		BackendMillis:  elapsedMillis(req),
+		Baggage:        selectedBaggage(req),
+		Tenant:         tenant,
 	}
-	b, err := json.Marshal(&r)
+	schema := negotiateSchema(req)
+	b, err := marshalResponse(&r, schema)
 	if err != nil {
-		log.Print("Write failure: ", err)
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		requestLogger(req).Error("Write failure", "err", err)
+		writeError(resp, tierBackend, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
 		return
 	}
-	resp.Header().Set("Content-type", "application/json")
-	_, err = resp.Write(b)
+	setSchemaHeaders(resp, schema)
+	setServerTiming(resp, req, tierBackend, nil)
+	if *cacheControl != "" {
+		resp.Header().Set("Cache-Control", *cacheControl)
+	}
+	_, err = resp.Write(setChecksum(resp, b))
 	if err != nil {
-		log.Print("Write failure: ", err)
+		requestLogger(req).Error("Write failure", "err", err)
 	}
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backupTarget   = flag.String("backup", "", "Where to back up the store: a directory, or an http or https URL that accepts PUT and GET, such as an object storage URL (empty disables backups)")
+	backupInterval = flag.Duration("backup_interval", 5*time.Minute, "How often to back up the store")
+	backupKeep     = flag.Int("backup_keep", 10, "Number of backups kept in a backup directory")
+	backupRestore  = flag.Bool("backup_restore", false, "Restore the newest backup at startup when the store is empty, to recover after losing a node")
+)
+
+// Backups in a directory are named by time, so they sort oldest first.
+const (
+	backupPrefix     = "topdog-backup-"
+	backupSuffix     = ".json"
+	backupTimeLayout = "20060102T150405Z"
+)
+
+var (
+	errNoBackups    = errors.New("no backups")
+	errNoBackup     = errors.New("backup is not set")
+	errBackupName   = errors.New("not a backup name")
+	backupMu        sync.Mutex // one backup or restore at a time
+	backupsTotal    = newMetric.NewCounterVec(prometheus.CounterOpts{Name: "topdog_backups_total", Help: "Backups of the store, by result."}, []string{"result"})
+	backupTimestamp = newMetric.NewGauge(prometheus.GaugeOpts{Name: "topdog_backup_last_success_timestamp_seconds", Help: "When the store was last backed up, for alerting on stale backups."})
+)
+
+// backupURL returns the backup setting as a URL, or nil for a directory.
+func backupURL() *url.URL {
+	u, err := url.Parse(*backupTarget)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	return u
+}
+
+// checkBackup verifies the backup settings.
+func checkBackup() error {
+	if *backupTarget == "" {
+		return nil
+	}
+	if *backupInterval <= 0 {
+		return fmt.Errorf("backup_interval %s must be positive", *backupInterval)
+	}
+	if *backupKeep < 1 {
+		return fmt.Errorf("backup_keep %d must be at least 1", *backupKeep)
+	}
+	if backupURL() != nil {
+		return nil
+	}
+	fi, err := os.Stat(*backupTarget)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory or an http or https URL", *backupTarget)
+	}
+	return nil
+}
+
+// backupInfo describes a stored backup.
+type backupInfo struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// listBackups returns the backups in the backup directory, oldest first.
+func listBackups() ([]backupInfo, error) {
+	entries, err := os.ReadDir(*backupTarget)
+	if err != nil {
+		return nil, err
+	}
+	var list []backupInfo
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) || !e.Type().IsRegular() {
+			continue
+		}
+		t, err := time.Parse(backupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, backupInfo{Name: name, Time: t, Size: fi.Size()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// backupStore writes a snapshot of the store to the backup directory,
+// removing the oldest beyond backup_keep, or PUTs it to the backup URL.
+func backupStore(ctx context.Context) (string, error) {
+	if *backupTarget == "" {
+		return "", errNoBackup
+	}
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	name, err := writeBackup(ctx)
+	if err != nil {
+		backupsTotal.WithLabelValues("error").Inc()
+		return "", err
+	}
+	backupsTotal.WithLabelValues("ok").Inc()
+	backupTimestamp.SetToCurrentTime()
+	return name, nil
+}
+
+func writeBackup(ctx context.Context) (string, error) {
+	s, err := getStore()
+	if err != nil {
+		return "", err
+	}
+	d, err := s.Snapshot()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(&d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if u := backupURL(); u != nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(b))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return "", fmt.Errorf("PUT %s returned %s", u.Redacted(), resp.Status)
+		}
+		return u.Redacted(), nil
+	}
+
+	name := backupPrefix + time.Now().UTC().Format(backupTimeLayout) + backupSuffix
+	tmp, err := os.CreateTemp(*backupTarget, ".topdog-backup-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(*backupTarget, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	list, err := listBackups()
+	if err != nil {
+		return name, err
+	}
+	for len(list) > *backupKeep {
+		if err := os.Remove(filepath.Join(*backupTarget, list[0].Name)); err != nil {
+			return name, err
+		}
+		list = list[1:]
+	}
+	return name, nil
+}
+
+// readBackup returns a backup's data: the named one in the backup
+// directory, the newest one if name is empty, or the one at the backup URL.
+func readBackup(ctx context.Context, name string) (storeData, string, error) {
+	var d storeData
+	var r io.ReadCloser
+	if u := backupURL(); u != nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return d, "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return d, "", err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return d, "", errNoBackups
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return d, "", fmt.Errorf("GET %s returned %s", u.Redacted(), resp.Status)
+		}
+		r, name = resp.Body, u.Redacted()
+	} else {
+		if name == "" {
+			list, err := listBackups()
+			if err != nil {
+				return d, "", err
+			}
+			if len(list) == 0 {
+				return d, "", errNoBackups
+			}
+			name = list[len(list)-1].Name
+		} else if name != filepath.Base(name) || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			return d, "", errBackupName
+		}
+		f, err := os.Open(filepath.Join(*backupTarget, name))
+		if err != nil {
+			return d, "", err
+		}
+		r = f
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return d, "", fmt.Errorf("%s: %w", name, err)
+	}
+	return d, name, nil
+}
+
+// restoreSummary describes a restore.
+type restoreSummary struct {
+	Backup    string `json:"backup"`
+	Users     int    `json:"users"`
+	Favorites int    `json:"favorites"`
+	History   int    `json:"history"`
+}
+
+// restoreStore replaces the store's data with d.
+func restoreStore(d storeData, from string) (restoreSummary, error) {
+	s, err := getStore()
+	if err != nil {
+		return restoreSummary{}, err
+	}
+	if err := s.Restore(d); err != nil {
+		return restoreSummary{}, err
+	}
+	sum := restoreSummary{Backup: from, Favorites: len(d.Favorites)}
+	users := make(map[string]bool)
+	for u, h := range d.History {
+		users[u] = true
+		sum.History += len(h)
+	}
+	for u := range d.Favorites {
+		users[u] = true
+	}
+	sum.Users = len(users)
+	recordEvent(eventBackup, "Store restored from %s", from)
+	return sum, nil
+}
+
+// startBackups backs up the store every backup_interval, after first
+// restoring the newest backup if backup_restore is set and the store is
+// empty, as on a new node.
+func startBackups() {
+	if *backupTarget == "" {
+		return
+	}
+	if *backupRestore {
+		restoreAtStartup()
+	}
+	go func() {
+		for {
+			time.Sleep(*backupInterval)
+			if name, err := backupStore(context.Background()); err != nil {
+				slog.Warn("Cannot back up store", "backup", *backupTarget, "err", err)
+			} else {
+				slog.Debug("Store backed up", "backup", name)
+			}
+		}
+	}()
+}
+
+// restoreAtStartup restores the newest backup into an empty store.
+func restoreAtStartup() {
+	s, err := getStore()
+	if err != nil {
+		return
+	}
+	if users, err := s.Users(); err != nil || len(users) > 0 {
+		return
+	}
+	d, name, err := readBackup(context.Background(), "")
+	if errors.Is(err, errNoBackups) {
+		slog.Info("No backup to restore", "backup", *backupTarget)
+		return
+	} else if err != nil {
+		slog.Warn("Cannot read backup", "backup", *backupTarget, "err", err)
+		return
+	}
+	sum, err := restoreStore(d, name)
+	if err != nil {
+		slog.Warn("Cannot restore backup", "backup", name, "err", err)
+		return
+	}
+	slog.Info("Store restored", "backup", name, "users", sum.Users, "history", sum.History)
+}
+
+// adminBackup backs up the store now.
+func adminBackup(resp http.ResponseWriter, req *http.Request) {
+	tier := tierForPath(req.URL.Path)
+	name, err := backupStore(req.Context())
+	if errors.Is(err, errNoBackup) {
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusNotFound, err))
+		return
+	} else if err != nil {
+		requestLogger(req).Warn("Cannot back up store", "err", err)
+		writeError(resp, tier, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	auditRequest(req, "backup", name)
+	writeBackupJSON(resp, req, map[string]string{"backup": name})
+}
+
+// adminBackups lists the backups in the backup directory, oldest first.
+func adminBackups(resp http.ResponseWriter, req *http.Request) {
+	tier := tierForPath(req.URL.Path)
+	if *backupTarget == "" || backupURL() != nil {
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusNotFound, errors.New("backup is not a directory")))
+		return
+	}
+	list, err := listBackups()
+	if err != nil {
+		writeError(resp, tier, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	if list == nil {
+		list = []backupInfo{}
+	}
+	writeBackupJSON(resp, req, map[string]interface{}{"backups": list})
+}
+
+// adminRestore replaces the store's data with a backup: the one in the
+// request body, the one named by ?name=, or else the newest one.
+func adminRestore(resp http.ResponseWriter, req *http.Request) {
+	tier := tierForPath(req.URL.Path)
+	var d storeData
+	var from string
+	body, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, importMaxBytes))
+	if err != nil {
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &d); err != nil {
+			writeError(resp, tier, withCode(codeBadRequest, http.StatusBadRequest, err))
+			return
+		}
+		from = "request body"
+	} else {
+		if *backupTarget == "" {
+			writeError(resp, tier, withCode(codeBadRequest, http.StatusNotFound, errNoBackup))
+			return
+		}
+		backupMu.Lock()
+		d, from, err = readBackup(req.Context(), req.URL.Query().Get("name"))
+		backupMu.Unlock()
+		switch {
+		case errors.Is(err, errNoBackups), errors.Is(err, os.ErrNotExist):
+			writeError(resp, tier, withCode(codeNotFound, http.StatusNotFound, err))
+			return
+		case errors.Is(err, errBackupName):
+			writeError(resp, tier, withCode(codeBadRequest, http.StatusBadRequest, err))
+			return
+		case err != nil:
+			writeError(resp, tier, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+			return
+		}
+	}
+	sum, err := restoreStore(d, from)
+	if err != nil {
+		writeError(resp, tier, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	requestLogger(req).Warn("Store restored", "backup", from, "users", sum.Users, "history", sum.History)
+	auditRequest(req, "restore", sum)
+	writeBackupJSON(resp, req, &sum)
+}
+
+// writeBackupJSON writes v as the JSON response of a backup handler.
+func writeBackupJSON(resp http.ResponseWriter, req *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+var baggageKeys = flag.String("baggage_keys", "user,experiment", "Comma-separated OpenTelemetry baggage entries the backend reports in the response, to verify baggage reaches every tier (empty reports none)")
+
+const baggageHeader = "baggage"
+
+// selectedBaggage returns the baggage_keys entries of the request's W3C
+// baggage header, or nil if there are none.
+func selectedBaggage(req *http.Request) map[string]string {
+	if *baggageKeys == "" {
+		return nil
+	}
+	b, err := baggage.Parse(strings.Join(req.Header.Values(baggageHeader), ","))
+	if err != nil && b.Len() == 0 {
+		return nil
+	}
+	var m map[string]string
+	for _, k := range strings.Split(*baggageKeys, ",") {
+		k = strings.TrimSpace(k)
+		if v := b.Member(k).Value(); v != "" {
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// baggageKey renders the selected baggage in a fixed order, so responses
+// reporting it are only cached for requests carrying the same entries.
+func baggageKey(req *http.Request) string {
+	m := selectedBaggage(req)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + m[k]
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stamped at build time, as in
+//
+//	go build -ldflags "-X main.buildVersion=1.4.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When they are left empty the VCS details Go embeds are used instead.
+var (
+	buildVersion string
+	buildCommit  string
+	buildDate    string
+)
+
+// buildDetails identifies the running binary.
+type buildDetails struct {
+	BuildVersion string `json:"buildVersion"`
+	Commit       string `json:"commit"`
+	BuildDate    string `json:"buildDate"`
+	Modified     bool   `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	GoVersion    string `json:"goVersion"`
+}
+
+var (
+	buildOnce sync.Once
+	build     buildDetails
+)
+
+// binaryBuild returns the stamped build details, filling gaps from the
+// module and VCS information in the binary.
+func binaryBuild() buildDetails {
+	buildOnce.Do(func() {
+		build = buildDetails{BuildVersion: buildVersion, Commit: buildCommit, BuildDate: buildDate, GoVersion: runtime.Version()}
+		if info, ok := debug.ReadBuildInfo(); ok {
+			if build.BuildVersion == "" && info.Main.Version != "(devel)" {
+				build.BuildVersion = info.Main.Version
+			}
+			for _, s := range info.Settings {
+				switch s.Key {
+				case "vcs.revision":
+					if build.Commit == "" {
+						build.Commit = s.Value
+					}
+				case "vcs.time":
+					if build.BuildDate == "" {
+						build.BuildDate = s.Value
+					}
+				case "vcs.modified":
+					build.Modified = s.Value == "true" && buildCommit == ""
+				}
+			}
+		}
+		for _, s := range []*string{&build.BuildVersion, &build.Commit, &build.BuildDate} {
+			if *s == "" {
+				*s = "unknown"
+			}
+		}
+	})
+	return build
+}
+
+var buildInfo = newMetric.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "topdog_build_info",
+	Help: "Always 1, labeled with the build version, commit, build date, and Go version of the binary.",
+}, []string{"build_version", "commit", "build_date", "goversion"})
+
+// publishBuildInfo sets topdog_build_info, so the binary behind each Istio
+// subset can be told apart with a query like
+// count by (version, commit) (topdog_build_info).
+func publishBuildInfo() {
+	b := binaryBuild()
+	buildInfo.WithLabelValues(b.BuildVersion, b.Commit, b.BuildDate, b.GoVersion).Set(1)
+}
+
+// versionResponse describes the binary and the version it serves.
+type versionResponse struct {
+	buildDetails
+	Version      int    `json:"version"`
+	Effective    int    `json:"effective"`
+	VersionLabel string `json:"versionLabel"`
+}
+
+// versionInfo reports the build of the binary along with the version flag,
+// the voting strategy in effect, and the version label on its telemetry.
+func versionInfo(resp http.ResponseWriter, req *http.Request) {
+	r := versionResponse{
+		buildDetails: binaryBuild(),
+		Version:      *version,
+		Effective:    strategyVersion(),
+		VersionLabel: workloadLabels()["version"],
+	}
+	b, err := json.Marshal(&r)
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
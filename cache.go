@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cacheHeader = "x-topdog-cache"
+
+// responseCache holds downstream responses for as long as their Cache-Control
+// or Expires headers allow.
+type responseCache struct {
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	result  backEndResponse
+	expires time.Time
+}
+
+var downstreamCache = &responseCache{entries: make(map[string]cacheEntry)}
+
+// get returns a cached response that has not yet expired.
+func (c *responseCache) get(key string) (*backEndResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	result := e.result
+	result.retryWaited = 0
+	return &result, true
+}
+
+// put stores a response if the downstream headers make it cacheable.
+func (c *responseCache) put(key string, result *backEndResponse, h http.Header) {
+	now := time.Now()
+	ttl, ok := cacheLifetime(h, now)
+	if !ok {
+		return
+	}
+	c.putFor(key, result, ttl)
+}
+
+// putFor stores a response for a fixed time, regardless of headers.
+func (c *responseCache) putFor(key string, result *backEndResponse, ttl time.Duration) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{result: *result, expires: now.Add(ttl)}
+}
+
+// cacheLifetime computes how long a shared cache may keep a response.
+func cacheLifetime(h http.Header, now time.Time) (time.Duration, bool) {
+	var maxAge, sMaxAge time.Duration = -1, -1
+	for _, cc := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(cc, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age":
+				if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+					maxAge = time.Duration(n) * time.Second
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+					sMaxAge = time.Duration(n) * time.Second
+				}
+			}
+		}
+	}
+
+	var ttl time.Duration
+	switch {
+	case sMaxAge >= 0:
+		ttl = sMaxAge
+	case maxAge >= 0:
+		ttl = maxAge
+	default:
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl = expires.Sub(date)
+	}
+
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+	return ttl, ttl > 0
+}
+
+// cacheKey identifies a cached response. Personalized responses are kept apart.
+func cacheKey(url string, req *http.Request) string {
+	return url + " " + req.Header.Get(tenantHeader) + " " + req.Header.Get(favoriteHeader) + " " + baggageKey(req)
+}
+
+// bypassCache reports whether the client asked us not to serve from cache.
+func bypassCache(req *http.Request) bool {
+	for _, cc := range req.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(cc, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-cache", "no-store", "max-age=0":
+				return true
+			}
+		}
+	}
+	return req.Header.Get("Pragma") == "no-cache"
+}
+
+// setCacheHeaders reports whether the response came from a cache at this tier or below.
+func setCacheHeaders(resp http.ResponseWriter, result *backEndResponse) {
+	if result.cacheHit {
+		resp.Header().Set(cacheHeader, "HIT")
+	} else {
+		resp.Header().Set(cacheHeader, "MISS")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var corruptRate = flag.Float64("corrupt_rate", 0, "Chance (0 to 1) that a response body is corrupted after its checksum is computed, to demonstrate detection")
+
+// checksumHeader carries the SHA-256 of the response body, as sha256=<hex>.
+const checksumHeader = "x-topdog-checksum"
+
+// bodyChecksum returns the checksum header value for a body.
+func bodyChecksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256=" + hex.EncodeToString(sum[:])
+}
+
+// setChecksum adds the checksum header for a body that is about to be
+// written, and then corrupts the body when configured to.
+func setChecksum(resp http.ResponseWriter, b []byte) []byte {
+	resp.Header().Set(checksumHeader, bodyChecksum(b))
+	if *corruptRate <= 0 || len(b) == 0 {
+		return b
+	}
+	rnd := getRand()
+	corrupt := rnd.Float64() < *corruptRate
+	i := rnd.Intn(len(b))
+	putRand(rnd)
+	if !corrupt {
+		return b
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	c[i] ^= 0x01
+	return c
+}
+
+// verifyChecksum checks a downstream body against its checksum header, if
+// it sent one.
+func verifyChecksum(h http.Header, b []byte) error {
+	want := h.Get(checksumHeader)
+	if want == "" {
+		return nil
+	}
+	if !strings.HasPrefix(want, "sha256=") {
+		return withCode(codeChecksumMismatch, http.StatusBadGateway, fmt.Errorf("unsupported checksum %q", want))
+	}
+	if got := bodyChecksum(b); got != want {
+		return withCode(codeChecksumMismatch, http.StatusBadGateway, fmt.Errorf("body checksum %s does not match %s", got, want))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var trustedProxies = flag.String("trusted_proxies", "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16", "CIDR ranges of proxies whose X-Forwarded-For and X-Envoy-External-Address headers are believed")
+
+var clientRequestsTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_client_requests_total",
+	Help: "Requests by the kind of network the client came from (loopback, private, or public).",
+}, []string{"tier", "network"})
+
+var (
+	trustedOnce sync.Once
+	trustedNets []*net.IPNet
+)
+
+// parseCIDRs reads a comma-separated list of CIDR ranges.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy.
+func isTrustedProxy(ip net.IP) bool {
+	trustedOnce.Do(func() {
+		var err error
+		trustedNets, err = parseCIDRs(*trustedProxies)
+		if err != nil {
+			slog.Error("Invalid trusted_proxies", "err", err)
+		}
+	})
+	for _, n := range trustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the address of the directly connected peer.
+func peerIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP derives the original client address. Forwarding headers are only
+// believed when they were added by a trusted proxy.
+func clientIP(req *http.Request) net.IP {
+	peer := peerIP(req)
+	if peer == nil || !isTrustedProxy(peer) {
+		return peer
+	}
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Envoy-External-Address"))); ip != nil {
+		return ip
+	}
+	// walk X-Forwarded-For from the nearest hop back to the first untrusted one
+	var hops []string
+	for _, xff := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// networkClass coarsely describes where an address lives, for metric labels.
+func networkClass(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsPrivate(), ip.IsLinkLocalUnicast():
+		return "private"
+	}
+	return "public"
+}
+
+// countClients counts requests by client network.
+func countClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		clientRequestsTotal.WithLabelValues(tierForPath(req.URL.Path), networkClass(clientIP(req))).Inc()
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// whoAmIResponse describes how the server sees the caller.
+type whoAmIResponse struct {
+	ClientIP             string   `json:"clientIp"`
+	Network              string   `json:"network"`
+	RemoteAddr           string   `json:"remoteAddr"`
+	TrustedPeer          bool     `json:"trustedPeer"`
+	ForwardedFor         []string `json:"forwardedFor,omitempty"`
+	EnvoyExternalAddress string   `json:"envoyExternalAddress,omitempty"`
+	Host                 string   `json:"host"`
+	Method               string   `json:"method"`
+	UserAgent            string   `json:"userAgent,omitempty"`
+}
+
+// whoAmI reports the derived client address and the headers it came from.
+func whoAmI(resp http.ResponseWriter, req *http.Request) {
+	ip := clientIP(req)
+	peer := peerIP(req)
+	r := whoAmIResponse{
+		ClientIP:             fmt.Sprint(ip),
+		Network:              networkClass(ip),
+		RemoteAddr:           req.RemoteAddr,
+		TrustedPeer:          peer != nil && isTrustedProxy(peer),
+		ForwardedFor:         req.Header.Values("X-Forwarded-For"),
+		EnvoyExternalAddress: req.Header.Get("X-Envoy-External-Address"),
+		Host:                 req.Host,
+		Method:               req.Method,
+		UserAgent:            req.UserAgent(),
+	}
+	b, err := json.Marshal(&r)
+	if err != nil {
+		requestLogger(req).Error("Cannot marshal JSON", "err", err)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/NYTimes/gziphandler"
+)
+
+var (
+	gzipMinSize = flag.Int("gzip_min_size", gziphandler.DefaultMinSize, "Smallest response, in bytes, that the gzip middleware compresses")
+	gzipTypes   = flag.String("gzip_types", "text/html,text/css,text/plain,application/javascript,text/javascript,application/json,application/problem+json,image/svg+xml", "Comma-separated content types the gzip middleware compresses, leaving out ones like PNG that are already compressed (empty compresses all)")
+	gzipRoutes  = flag.String("gzip_routes", "", "Per-route gzip settings overriding gzip_min_size, as route=bytes or route=off, such as /query=off,/static/=512")
+)
+
+// gzipOff disables compression for a route in gzip_routes.
+const gzipOff = -1
+
+// parseGzipRoutes reads the gzip_routes setting into minimum sizes by route.
+func parseGzipRoutes(s string) (map[string]int, error) {
+	m := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		route, v, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not route=bytes or route=off", item)
+		}
+		v = strings.TrimSpace(v)
+		if v == "off" {
+			m[strings.TrimSpace(route)] = gzipOff
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not route=bytes or route=off", item)
+		}
+		m[strings.TrimSpace(route)] = n
+	}
+	return m, nil
+}
+
+// checkGzip verifies the gzip settings.
+func checkGzip() error {
+	if *gzipMinSize < 0 {
+		return fmt.Errorf("gzip_min_size %d is negative", *gzipMinSize)
+	}
+	_, err := parseGzipRoutes(*gzipRoutes)
+	return err
+}
+
+// gzipWriter lets http.ResponseController reach the writer below the gzip
+// middleware's, which has no Unwrap, so handlers such as /debug/tap can
+// extend their write deadline.
+type gzipWriter struct {
+	*gziphandler.GzipResponseWriter
+}
+
+// Unwrap returns the underlying writer.
+func (w gzipWriter) Unwrap() http.ResponseWriter {
+	return w.GzipResponseWriter.ResponseWriter
+}
+
+// compressRoute gzips a route's responses that are big enough and of a
+// listed type, unless gzip_routes turns it off for the route.
+func compressRoute(route string, next http.Handler) http.Handler {
+	minSize := *gzipMinSize
+	m, err := parseGzipRoutes(*gzipRoutes)
+	if err != nil {
+		slog.Error("Invalid gzip_routes", "err", err)
+	} else if n, ok := m[route]; ok {
+		minSize = n
+	}
+	if minSize == gzipOff {
+		return next
+	}
+	var types []string
+	for _, t := range strings.Split(*gzipTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	wrap, err := gziphandler.GzipHandlerWithOpts(gziphandler.MinSize(minSize), gziphandler.ContentTypes(types))
+	if err != nil {
+		slog.Error("Invalid gzip settings", "route", route, "err", err)
+		return gziphandler.GzipHandler(next)
+	}
+	gz := wrap(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch w := resp.(type) {
+		case *gziphandler.GzipResponseWriter:
+			resp = gzipWriter{w}
+		case gziphandler.GzipResponseWriterWithCloseNotify:
+			resp = gzipWriter{w.GzipResponseWriter}
+		}
+		next.ServeHTTP(resp, req)
+	}))
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// byte ranges refer to the uncompressed file, so don't gzip them
+		if req.Header.Get("Range") != "" {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		gz.ServeHTTP(resp, req)
+	})
+}
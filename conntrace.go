@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var downstreamPhaseDuration = newMetric.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "topdog_downstream_phase_duration_seconds",
+	Help:    "Time spent in each phase of calls to downstream tiers: dns, connect, and tls for new connections, and ttfb (time to first response byte) for every call.",
+	Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"tier", "target", "phase"})
+
+var downstreamConnections = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_downstream_connections_total",
+	Help: "Connections used for calls to downstream tiers, by whether an idle connection was reused.",
+}, []string{"tier", "target", "reused"})
+
+// connTimings collects the connection timings of one downstream call.
+// The callbacks can run on the transport's goroutines, hence the lock.
+type connTimings struct {
+	lock                             sync.Mutex
+	start                            time.Time
+	dnsStart, connectStart, tlsStart time.Time
+	dns, connect, tls, ttfb          time.Duration
+	gotConn, reused                  bool
+}
+
+// withConnTimings returns a context that records connection timings for
+// the call made with it.
+func withConnTimings(ctx context.Context) (context.Context, *connTimings) {
+	t := &connTimings{start: time.Now()}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.since(&t.dns, &t.dnsStart) },
+		ConnectStart:      func(string, string) { t.mark(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { t.since(&t.connect, &t.connectStart) },
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.since(&t.tls, &t.tlsStart) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.lock.Lock()
+			t.gotConn, t.reused = true, info.Reused
+			t.lock.Unlock()
+		},
+		GotFirstResponseByte: func() { t.since(&t.ttfb, &t.start) },
+	}), t
+}
+
+func (t *connTimings) mark(at *time.Time) {
+	t.lock.Lock()
+	*at = time.Now()
+	t.lock.Unlock()
+}
+
+func (t *connTimings) since(d *time.Duration, start *time.Time) {
+	t.lock.Lock()
+	*d = time.Since(*start)
+	t.lock.Unlock()
+}
+
+// record adds the timings to the metrics and the client span in ctx, so the
+// effect of a sidecar on connection reuse can be seen.
+func (t *connTimings) record(ctx context.Context, tier, target string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.gotConn {
+		return
+	}
+	downstreamConnections.WithLabelValues(tier, target, strconv.FormatBool(t.reused)).Inc()
+	attrs := []attribute.KeyValue{attribute.Bool("topdog.conn_reused", t.reused)}
+	for _, p := range []struct {
+		phase string
+		d     time.Duration
+	}{{"dns", t.dns}, {"connect", t.connect}, {"tls", t.tls}, {"ttfb", t.ttfb}} {
+		if p.d <= 0 {
+			continue
+		}
+		observeWithTrace(ctx, downstreamPhaseDuration.WithLabelValues(tier, target, p.phase), p.d.Seconds())
+		attrs = append(attrs, attribute.Float64("topdog."+p.phase+"_ms", float64(p.d.Microseconds())/1000))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
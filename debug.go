@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var recentRequestCount = flag.Int("recent_requests", 100, "Number of recent requests to keep for /debug/requests")
+
+// requestEntry describes one served request.
+type requestEntry struct {
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	ClientIP   string        `json:"clientIp,omitempty"`
+	Status     int           `json:"status"`
+	Duration   time.Duration `json:"durationNs"`
+	Downstream string        `json:"downstream,omitempty"`
+	TraceID    string        `json:"traceId,omitempty"`
+
+	Envoy map[string]string `json:"envoy,omitempty"` // envoy_headers the request arrived with
+}
+
+// requestLog is a fixed-size ring of recent requests.
+type requestLog struct {
+	lock    sync.Mutex
+	entries []*requestEntry
+	pos     int
+}
+
+var recentRequests requestLog
+
+func (l *requestLog) add(e *requestEntry) {
+	if *recentRequestCount <= 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.entries) < *recentRequestCount {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.pos] = e
+	l.pos = (l.pos + 1) % len(l.entries)
+}
+
+// list returns copies of the entries, newest first.
+func (l *requestLog) list() []requestEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	result := make([]requestEntry, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		result = append(result, *l.entries[(l.pos+i)%len(l.entries)])
+	}
+	return result
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+type requestEntryKey struct{}
+
+// noteDownstream records the result of a downstream call for the current
+// request. It holds the log's lock, since a handler that timed out is still
+// running after its entry has been added to the log.
+func noteDownstream(req *http.Request, result string) {
+	if e, ok := req.Context().Value(requestEntryKey{}).(*requestEntry); ok {
+		recentRequests.lock.Lock()
+		e.Downstream = result
+		recentRequests.lock.Unlock()
+	}
+}
+
+// describeResult summarizes a downstream result for the request log.
+func describeResult(result *backEndResponse, err error) string {
+	if err != nil {
+		code, _ := errorCode(err)
+		return code
+	}
+	return result.TopDog
+}
+
+// recordRequests adds each request to the recent request log.
+func recordRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/debug/") {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		e := &requestEntry{
+			Time:     time.Now(),
+			Method:   req.Method,
+			Path:     req.URL.Path,
+			ClientIP: fmt.Sprint(clientIP(req)),
+		}
+		rec := &statusRecorder{ResponseWriter: resp}
+		next.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), requestEntryKey{}, e)))
+		e.Duration = time.Since(e.Time)
+		e.TraceID = getRequestContext(req).TraceID()
+		e.Status = rec.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		recentRequests.add(e)
+	})
+}
+
+var recentRequestsTemplate = template.Must(template.New("requests").Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="utf-8"/>
+		<title>Recent Requests</title>
+		<link rel="stylesheet" type="text/css" href="/static/dog.css"/>
+	</head>
+	<body>
+		<h1>Recent Requests</h1>
+		<table class="debug">
+			<tr><th>Time</th><th>Method</th><th>Path</th><th>Client</th><th>Status</th><th>Duration</th><th>Downstream</th><th>Trace</th></tr>
+			{{ range . }}<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.Method}}</td><td>{{.Path}}</td><td>{{.ClientIP}}</td><td>{{.Status}}</td><td>{{.Duration}}</td><td>{{.Downstream}}</td><td>{{.TraceID}}</td></tr>
+			{{ end }}
+		</table>
+	</body>
+</html>
+`))
+
+// debugRequests shows the recent request log as HTML, or JSON when asked.
+func debugRequests(resp http.ResponseWriter, req *http.Request) {
+	entries := recentRequests.list()
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		b, err := json.Marshal(entries)
+		if err != nil {
+			requestLogger(req).Error("Cannot marshal JSON", "err", err)
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Header().Set("Content-type", "application/json")
+		resp.Write(b)
+		return
+	}
+	resp.Header().Set("Content-type", "text/html; charset=utf-8")
+	err := recentRequestsTemplate.Execute(resp, entries)
+	if err != nil {
+		requestLogger(req).Error("Cannot render recent requests", "err", err)
+	}
+}
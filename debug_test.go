@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestNoteDownstreamAfterTimeout has a handler note its downstream result
+// after the timeout middleware gave up on it, and so after its entry was
+// added to the log, while the log is being read. Run it with -race.
+func TestNoteDownstreamAfterTimeout(t *testing.T) {
+	oldTimeouts, oldCount := *routeTimeouts, *recentRequestCount
+	*routeTimeouts, *recentRequestCount = "/slow=10ms", 10
+	defer func() { *routeTimeouts, *recentRequestCount = oldTimeouts, oldCount }()
+
+	done := make(chan struct{})
+	h := recordRequests(withTimeout("/slow", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		defer close(done)
+		<-req.Context().Done()
+		time.Sleep(20 * time.Millisecond)
+		noteDownstream(req, "late")
+	})))
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if resp.Code != http.StatusGatewayTimeout {
+		t.Fatalf("got %d, want 504", resp.Code)
+	}
+
+	// read the log the way /debug/requests does until the handler finishes
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+			recentRequests.list()
+			time.Sleep(time.Millisecond)
+		}
+	}
+	entries := recentRequests.list()
+	if len(entries) == 0 || entries[0].Path != "/slow" {
+		t.Fatalf("got %+v, want the /slow request first", entries)
+	}
+	if got := entries[0].Downstream; got != "late" {
+		t.Errorf("got downstream %q, want %q", got, "late")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var delayProfileFlag = flag.String("delay_profile", delayNone, "Latency profile shaping backend response times: none, fast, typical, p99-heavy, or bimodal")
+
+// delayNone turns the delay profile off.
+const delayNone = "none"
+
+// maxProfileDelay bounds a single sampled delay, since the log-normal tail
+// is unbounded.
+const maxProfileDelay = 10 * time.Second
+
+// delayMode is a log-normal component of a delay profile.
+type delayMode struct {
+	weight float64       // share of requests, relative to the other modes
+	median time.Duration // typical delay of the mode
+	sigma  float64       // spread; the p99 is about median * e^(2.33 sigma)
+}
+
+// delayProfiles are mixtures of log-normal delays, which is roughly how real
+// service latency is distributed: most requests near the median and a long
+// tail above it.
+var delayProfiles = map[string][]delayMode{
+	delayNone: nil,
+	// a quick in-memory service, p99 around 6ms
+	"fast": {{1, 3 * time.Millisecond, 0.3}},
+	// a service with a database behind it, p99 around 80ms
+	"typical": {{1, 25 * time.Millisecond, 0.5}},
+	// mostly quick, but 2% of requests wait on something slow, like a lock
+	// or a garbage collection, which moves the p99 and not the median
+	"p99-heavy": {{0.98, 20 * time.Millisecond, 0.4}, {0.02, 800 * time.Millisecond, 0.5}},
+	// cache hits and misses, with two clear peaks in the histogram
+	"bimodal": {{0.7, 10 * time.Millisecond, 0.3}, {0.3, 250 * time.Millisecond, 0.3}},
+}
+
+// delayProfileNames lists the profiles, for messages.
+func delayProfileNames() []string {
+	names := make([]string, 0, len(delayProfiles))
+	for name := range delayProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkDelayProfile verifies a profile name.
+func checkDelayProfile(name string) error {
+	if _, ok := delayProfiles[name]; !ok {
+		return fmt.Errorf("delay profile %q is not one of %s", name, strings.Join(delayProfileNames(), ", "))
+	}
+	return nil
+}
+
+// activeDelayProfile overrides delay_profile once set from the admin API.
+var activeDelayProfile atomic.Pointer[string]
+
+// currentDelayProfile returns the name of the profile in effect.
+func currentDelayProfile() string {
+	if p := activeDelayProfile.Load(); p != nil {
+		return *p
+	}
+	return *delayProfileFlag
+}
+
+// setDelayProfile changes the profile in effect.
+func setDelayProfile(ctx context.Context, name string) error {
+	if err := checkDelayProfile(name); err != nil {
+		return err
+	}
+	if previous := currentDelayProfile(); previous != name {
+		contextLogger(ctx).Info("Delay profile changed", "previous", previous, "profile", name)
+	}
+	activeDelayProfile.Store(&name)
+	return nil
+}
+
+// sampleDelay draws a delay from the profile in effect.
+func sampleDelay() time.Duration {
+	modes := delayProfiles[currentDelayProfile()]
+	if len(modes) == 0 {
+		return 0
+	}
+	rnd := getRand()
+	defer putRand(rnd)
+	var total float64
+	for _, m := range modes {
+		total += m.weight
+	}
+	pick := rnd.Float64() * total
+	m := modes[len(modes)-1]
+	for _, mode := range modes {
+		if pick < mode.weight {
+			m = mode
+			break
+		}
+		pick -= mode.weight
+	}
+	d := time.Duration(float64(m.median) * math.Exp(m.sigma*rnd.NormFloat64()))
+	return min(d, maxProfileDelay)
+}
+
+// waitForDelayProfile delays a backend request by a sample of the profile.
+func waitForDelayProfile(req *http.Request) {
+	d := sampleDelay()
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-req.Context().Done():
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dependencyURL       = flag.String("dependency_url", "", "URL of a fake dependency, such as a license server, that this instance checks on a timer (empty disables it); any topdog serves one at /dependency")
+	dependencyName      = flag.String("dependency_name", "license-server", "Name of the fake dependency in logs, metrics, and /readyz")
+	dependencyInterval  = flag.Duration("dependency_interval", 10*time.Second, "How often to check dependency_url")
+	dependencyRequired  = flag.Bool("dependency_required", true, "Fail /readyz while the dependency is down, after readiness_failures checks in a row")
+	dependencyErrorRate = flag.Float64("dependency_error_rate", 0, "Chance (0 to 1) that this instance's /dependency endpoint fails, to play a flaky dependency")
+)
+
+var errDependencyFault = errors.New("dependency failure injected by dependency_error_rate")
+
+var dependencyChecksTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_dependency_checks_total",
+	Help: "Checks of the fake dependency, by result.",
+}, []string{"dependency", "result"})
+
+var dependencyUp = newMetric.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "topdog_dependency_up",
+	Help: "Whether the fake dependency is considered up (1) or down (0).",
+}, []string{"dependency"})
+
+// dependencyGate tracks whether the fake dependency is up, with the same
+// hysteresis as the readiness gate.
+var dependencyGate downstreamGate
+
+// startDependencyChecks checks dependency_url in the background, so that
+// each instance has an extra edge in the mesh graph that can be made to fail.
+func startDependencyChecks() {
+	if *dependencyURL == "" {
+		return
+	}
+	dependencyUp.WithLabelValues(*dependencyName).Set(1)
+	go func() {
+		c := &http.Client{Transport: transport, Timeout: *dependencyInterval}
+		for {
+			err := checkDependency(c)
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			dependencyChecksTotal.WithLabelValues(*dependencyName, result).Inc()
+			if dependencyGate.record(err) {
+				if err != nil {
+					dependencyUp.WithLabelValues(*dependencyName).Set(0)
+					slog.Warn("Dependency down", "dependency", *dependencyName, "failures", *readinessFailures, "err", err)
+					recordEvent(eventDependency, "%s down after %d failed checks: %v", *dependencyName, *readinessFailures, err)
+				} else {
+					dependencyUp.WithLabelValues(*dependencyName).Set(1)
+					slog.Info("Dependency up", "dependency", *dependencyName, "successes", *readinessSuccesses)
+					recordEvent(eventDependency, "%s up", *dependencyName)
+				}
+			}
+			time.Sleep(*dependencyInterval)
+		}
+	}()
+}
+
+// checkDependency calls the dependency, which must answer 200.
+func checkDependency(c *http.Client) error {
+	resp, err := c.Get(*dependencyURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(*dependencyURL + " returned " + resp.Status)
+	}
+	return nil
+}
+
+// dependencyAPI plays the fake dependency, failing at dependency_error_rate.
+// Faults set from the admin page apply too, so a scenario can take it down.
+func dependencyAPI(resp http.ResponseWriter, req *http.Request) {
+	if *dependencyErrorRate > 0 {
+		rnd := getRand()
+		fail := rnd.Float64() < *dependencyErrorRate
+		putRand(rnd)
+		if fail {
+			writeError(resp, tierForPath(req.URL.Path), withCode(codeInjectedFault, http.StatusServiceUnavailable, errDependencyFault))
+			return
+		}
+	}
+	b, _ := json.Marshal(map[string]interface{}{"name": *dependencyName, "ok": true})
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// redactedHeaders copies h with credentials replaced, keeping the
+// Authorization scheme so it's clear which kind was sent.
+func redactedHeaders(h http.Header) http.Header {
+	c := h.Clone()
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		if a := c.Get(name); a != "" {
+			scheme, _, _ := strings.Cut(a, " ")
+			c[name] = []string{scheme + " (redacted)"}
+		}
+	}
+	for _, name := range []string{"Cookie", "Set-Cookie", apiKeyHeader} {
+		if c.Get(name) != "" {
+			c[http.CanonicalHeaderKey(name)] = []string{"(redacted)"}
+		}
+	}
+	return c
+}
+
+// sidecarHeaderPrefixes match headers that Envoy or the Istio sidecar add
+// to requests it forwards.
+var sidecarHeaderPrefixes = []string{
+	"X-Envoy-",
+	"X-B3-",
+	"X-Forwarded-",
+	"X-Request-Id",
+	"Traceparent",
+	"Tracestate",
+	"B3",
+}
+
+// sidecarHeaders returns the names of the headers in h that a sidecar is
+// likely to have added, sorted.
+func sidecarHeaders(h http.Header) []string {
+	var names []string
+	for name := range h {
+		for _, p := range sidecarHeaderPrefixes {
+			if strings.HasPrefix(name, p) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// echoTLS describes the TLS connection a request arrived on.
+type echoTLS struct {
+	Version            string   `json:"version"`
+	CipherSuite        string   `json:"cipherSuite"`
+	ServerName         string   `json:"serverName,omitempty"`
+	NegotiatedProtocol string   `json:"negotiatedProtocol,omitempty"`
+	Resumed            bool     `json:"resumed"`
+	ClientSubject      string   `json:"clientSubject,omitempty"`
+	ClientURIs         []string `json:"clientUris,omitempty"` // SPIFFE IDs, for mTLS
+}
+
+// newEchoTLS describes a connection state, or returns nil for plain text.
+func newEchoTLS(cs *tls.ConnectionState) *echoTLS {
+	if cs == nil {
+		return nil
+	}
+	t := &echoTLS{
+		Version:            tls.VersionName(cs.Version),
+		CipherSuite:        tls.CipherSuiteName(cs.CipherSuite),
+		ServerName:         cs.ServerName,
+		NegotiatedProtocol: cs.NegotiatedProtocol,
+		Resumed:            cs.DidResume,
+	}
+	if len(cs.PeerCertificates) > 0 {
+		cert := cs.PeerCertificates[0]
+		t.ClientSubject = cert.Subject.String()
+		for _, u := range cert.URIs {
+			t.ClientURIs = append(t.ClientURIs, u.String())
+		}
+	}
+	return t
+}
+
+// echoResponse is what /debug/echo saw of a request.
+type echoResponse struct {
+	Method        string              `json:"method"`
+	URI           string              `json:"uri"`
+	Proto         string              `json:"proto"`
+	Host          string              `json:"host"`
+	RemoteAddr    string              `json:"remoteAddr"`
+	LocalAddr     string              `json:"localAddr,omitempty"`
+	ClientIP      string              `json:"clientIp"`
+	TrustedPeer   bool                `json:"trustedPeer"`
+	ContentLength int64               `json:"contentLength"`
+	Headers       map[string][]string `json:"headers"`
+	Sidecar       []string            `json:"sidecarHeaders"`               // headers Envoy likely added
+	GeneratedID   bool                `json:"generatedRequestId,omitempty"` // X-Request-Id came from topdog, not Envoy
+	TLS           *echoTLS            `json:"tls"`                          // null for plain text, as behind a sidecar
+}
+
+// debugEcho dumps the headers, peer, and TLS state of the request as
+// received, to show what the sidecar adds or strips. Behind a sidecar the
+// connection from Envoy is plain text even with mTLS on, and the client's
+// certificate shows up in X-Forwarded-Client-Cert instead.
+func debugEcho(resp http.ResponseWriter, req *http.Request) {
+	peer := peerIP(req)
+	r := echoResponse{
+		Method:        req.Method,
+		URI:           req.RequestURI,
+		Proto:         req.Proto,
+		Host:          req.Host,
+		RemoteAddr:    req.RemoteAddr,
+		ClientIP:      fmt.Sprint(clientIP(req)),
+		TrustedPeer:   peer != nil && isTrustedProxy(peer),
+		ContentLength: req.ContentLength,
+		Headers:       redactedHeaders(req.Header),
+		Sidecar:       sidecarHeaders(req.Header),
+		TLS:           newEchoTLS(req.TLS),
+	}
+	if getRequestContext(req).Generated {
+		r.GeneratedID = true
+		r.Sidecar = slices.DeleteFunc(r.Sidecar, func(name string) bool { return name == http.CanonicalHeaderKey(requestIDHeader) })
+	}
+	if a, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		r.LocalAddr = a.String()
+	}
+	b, err := json.MarshalIndent(&r, "", "  ")
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
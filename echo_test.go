@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactedHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret-token")
+	h.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	h.Set("Cookie", "user=secret")
+	h.Add("Set-Cookie", "session=secret")
+	h.Add("Set-Cookie", "other=secret")
+	h.Set(apiKeyHeader, "secret-key")
+	h.Set("Accept", "application/json")
+
+	r := redactedHeaders(h)
+	tests := []struct {
+		name, want string
+	}{
+		{"Authorization", "Bearer (redacted)"},
+		{"Proxy-Authorization", "Basic (redacted)"},
+		{"Cookie", "(redacted)"},
+		{"Set-Cookie", "(redacted)"},
+		{apiKeyHeader, "(redacted)"},
+		{"Accept", "application/json"},
+	}
+	for _, tt := range tests {
+		if got := r.Values(tt.name); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: got %q, want [%q]", tt.name, got, tt.want)
+		}
+	}
+	for name, vs := range r {
+		for _, v := range vs {
+			if strings.Contains(v, "secret") || strings.Contains(v, "c2VjcmV0") {
+				t.Errorf("%s still holds a credential: %q", name, v)
+			}
+		}
+	}
+	if h.Get("Authorization") != "Bearer secret-token" {
+		t.Error("redactedHeaders changed the original headers")
+	}
+}
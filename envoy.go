@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	envoyHeaders     = flag.String("envoy_headers", "x-envoy-attempt-count,x-envoy-expected-rq-timeout-ms,x-envoy-decorator-operation,x-envoy-upstream-service-time", "Comma-separated Envoy headers to capture from requests and downstream responses, for /debug/requests and the logs (empty captures none)")
+	echoEnvoyHeaders = flag.Bool("echo_envoy_headers", false, "Echo the captured Envoy request headers in the response, renamed from x-envoy-* to x-topdog-seen-*")
+)
+
+// envoyEchoPrefix replaces x-envoy- in echoed headers, since Envoy sets or
+// strips some x-envoy-* response headers itself.
+const envoyEchoPrefix = "x-topdog-seen-"
+
+// envoyHeaderNames returns the envoy_headers setting as canonical header names.
+func envoyHeaderNames() []string {
+	var names []string
+	for _, h := range strings.Split(*envoyHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			names = append(names, http.CanonicalHeaderKey(h))
+		}
+	}
+	return names
+}
+
+// captureEnvoy returns the envoy_headers found in h, by lowercase name, or
+// nil if there are none.
+func captureEnvoy(h http.Header) map[string]string {
+	var m map[string]string
+	for _, name := range envoyHeaderNames() {
+		if v := h.Get(name); v != "" {
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[strings.ToLower(name)] = v
+		}
+	}
+	return m
+}
+
+// captureEnvoyHeaders notes the Envoy headers a request arrived with, so
+// retry and timeout settings can be verified from the application side: a
+// retried request carries x-envoy-attempt-count above 1, and the route
+// timeout shows up as x-envoy-expected-rq-timeout-ms.
+func captureEnvoyHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		seen := captureEnvoy(req.Header)
+		if seen == nil {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		if e, ok := req.Context().Value(requestEntryKey{}).(*requestEntry); ok {
+			e.Envoy = seen
+		}
+		logger := requestLogger(req)
+		if n, err := strconv.Atoi(seen["x-envoy-attempt-count"]); err == nil && n > 1 {
+			logger.Info("Request retried by Envoy", "path", req.URL.Path, envoyAttr(seen))
+		} else {
+			logger.Debug("Envoy headers", "path", req.URL.Path, envoyAttr(seen))
+		}
+		if *echoEnvoyHeaders {
+			for k, v := range seen {
+				resp.Header().Set(envoyEchoPrefix+strings.TrimPrefix(k, "x-envoy-"), v)
+			}
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// envoyAttr groups the captured headers for logging, in order.
+func envoyAttr(seen map[string]string) slog.Attr {
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]any, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, k, seen[k])
+	}
+	return slog.Group("envoy", args...)
+}
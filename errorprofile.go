@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errorProfileFlag = flag.String("error_profile", errorNone, "Scripted backend failures: none, every-5th-503, alternate-500, blip-5s-every-1m, or outage-30s-every-5m")
+
+// errorNone turns the error profile off.
+const errorNone = "none"
+
+// errorSequence fails requests in a predictable rhythm.
+type errorSequence struct {
+	status  int           // returned by failed requests
+	every   int           // fail every nth request
+	failFor time.Duration // fail every request for this long...
+	period  time.Duration // ...at the end of every period
+}
+
+// errorProfiles give retry, outlier detection, and alerting demos a rhythm
+// that can be predicted, unlike a random error rate.
+var errorProfiles = map[string]errorSequence{
+	errorNone: {},
+	// a retry on another attempt always succeeds
+	"every-5th-503": {status: http.StatusServiceUnavailable, every: 5},
+	// consecutive errors never reach 2, so outlier detection set to eject
+	// after 2 or more never fires
+	"alternate-500": {status: http.StatusInternalServerError, every: 2},
+	// short outages, too brief for most alerts to fire
+	"blip-5s-every-1m": {status: http.StatusServiceUnavailable, failFor: 5 * time.Second, period: time.Minute},
+	// long enough to eject the pod and page someone
+	"outage-30s-every-5m": {status: http.StatusServiceUnavailable, failFor: 30 * time.Second, period: 5 * time.Minute},
+}
+
+var errProfileFault = errors.New("fault injected by the error profile")
+
+// errorProfileNames lists the profiles, for messages.
+func errorProfileNames() []string {
+	names := make([]string, 0, len(errorProfiles))
+	for name := range errorProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkErrorProfile verifies a profile name.
+func checkErrorProfile(name string) error {
+	if _, ok := errorProfiles[name]; !ok {
+		return fmt.Errorf("error profile %q is not one of %s", name, strings.Join(errorProfileNames(), ", "))
+	}
+	return nil
+}
+
+// errorProfileRun is a profile in effect. Its sequence starts when it is
+// chosen, healthy first, so the rhythm can be lined up with a demo.
+type errorProfileRun struct {
+	name  string
+	seq   errorSequence
+	start time.Time
+	count atomic.Int64
+}
+
+// fail reports whether the next request fails.
+func (r *errorProfileRun) fail(now time.Time) bool {
+	n := r.count.Add(1)
+	if r.seq.every > 0 && n%int64(r.seq.every) == 0 {
+		return true
+	}
+	return r.seq.period > 0 && now.Sub(r.start)%r.seq.period >= r.seq.period-r.seq.failFor
+}
+
+var activeErrorProfile atomic.Pointer[errorProfileRun]
+
+// currentErrorProfile returns the profile in effect, starting error_profile
+// with the first request that asks.
+func currentErrorProfile() *errorProfileRun {
+	if r := activeErrorProfile.Load(); r != nil {
+		return r
+	}
+	activeErrorProfile.CompareAndSwap(nil, &errorProfileRun{name: *errorProfileFlag, seq: errorProfiles[*errorProfileFlag], start: time.Now()})
+	return activeErrorProfile.Load()
+}
+
+// setErrorProfile changes the profile in effect. Choosing the profile that is
+// already in effect leaves its sequence running.
+func setErrorProfile(ctx context.Context, name string) error {
+	if err := checkErrorProfile(name); err != nil {
+		return err
+	}
+	previous := currentErrorProfile()
+	if previous.name == name {
+		return nil
+	}
+	activeErrorProfile.Store(&errorProfileRun{name: name, seq: errorProfiles[name], start: time.Now()})
+	contextLogger(ctx).Info("Error profile changed", "previous", previous.name, "profile", name)
+	return nil
+}
+
+// profileFault returns the error a backend request fails with under the
+// profile in effect, or nil.
+func profileFault() error {
+	r := currentErrorProfile()
+	if !r.fail(time.Now()) {
+		return nil
+	}
+	return withCode(codeInjectedFault, r.seq.status, fmt.Errorf("%w %s", errProfileFault, r.name))
+}
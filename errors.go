@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Tier names, used in error responses and telemetry.
+const (
+	tierUI      = "ui"
+	tierMidtier = "midtier"
+	tierBackend = "backend"
+)
+
+// Stable error codes returned in error responses so clients don't have to match messages.
+const (
+	codeVoteFailed            = "VOTE_FAILED"
+	codeEncodeFailed          = "ENCODE_FAILED"
+	codeDownstreamTimeout     = "DOWNSTREAM_TIMEOUT"
+	codeDownstreamUnreachable = "DOWNSTREAM_UNREACHABLE"
+	codeDownstreamError       = "DOWNSTREAM_ERROR"
+	codeDownstreamBadResponse = "DOWNSTREAM_BAD_RESPONSE"
+	codeDownstreamThrottled   = "DOWNSTREAM_THROTTLED"
+	codeInternal              = "INTERNAL"
+	codePanic                 = "PANIC"
+	codeHandlerTimeout        = "HANDLER_TIMEOUT"
+	codeTemplateFailed        = "TEMPLATE_FAILED"
+	codeBadRequest            = "BAD_REQUEST"
+	codeNotFound              = "NOT_FOUND"
+	codeNoUser                = "NO_USER"
+	codeStoreFailed           = "STORE_FAILED"
+	codeInjectedFault         = "INJECTED_FAULT"
+	codeAdminDisabled         = "ADMIN_DISABLED"
+	codeAdminAuth             = "ADMIN_AUTH_REQUIRED"
+	codeOverrideDenied        = "OVERRIDE_NOT_ALLOWED"
+	codeChecksumMismatch      = "CHECKSUM_MISMATCH"
+	codeDecryptFailed         = "DECRYPT_FAILED"
+	codeRateLimited           = "RATE_LIMITED"
+	codeQuotaExceeded         = "QUOTA_EXCEEDED"
+	codeMaintenance           = "MAINTENANCE"
+	codeUnknownTenant         = "UNKNOWN_TENANT"
+)
+
+const errorCodeHeader = "x-topdog-error-code"
+
+// codedError attaches an error code and HTTP status to an error.
+type codedError struct {
+	code       string
+	status     int
+	err        error
+	retryAfter time.Duration // passed upstream as Retry-After, if set
+	hops       []hop         // downstream calls the error passed through, outermost first
+}
+
+// hop describes one failed call between tiers.
+type hop struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Status    int    `json:"status,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// addHop records that err was seen on the call from one tier to another.
+func addHop(err error, h hop) error {
+	var ce *codedError
+	if !errors.As(err, &ce) {
+		ce = &codedError{code: codeInternal, status: http.StatusInternalServerError, err: err}
+		err = ce
+	}
+	h.Code = ce.code
+	ce.hops = append([]hop{h}, ce.hops...)
+	return err
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withCode wraps err with an error code and HTTP status.
+func withCode(code string, status int, err error) error {
+	return &codedError{code: code, status: status, err: err}
+}
+
+// errorCode returns the code and HTTP status for an error, defaulting to INTERNAL.
+func errorCode(err error) (string, int) {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code, ce.status
+	}
+	return codeInternal, http.StatusInternalServerError
+}
+
+// classifyTransportError assigns a code to an error returned by the HTTP client.
+func classifyTransportError(err error) error {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return withCode(codeDownstreamTimeout, http.StatusGatewayTimeout, err)
+	}
+	return withCode(codeDownstreamUnreachable, http.StatusBadGateway, err)
+}
+
+// tierForPath returns the tier that serves a path.
+func tierForPath(path string) string {
+	switch path {
+	case "/backend":
+		return tierBackend
+	case "/midtier":
+		return tierMidtier
+	}
+	return tierUI
+}
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+	Tier   string `json:"tier"`
+
+	FailedAt string `json:"failedAt,omitempty"` // innermost failed hop, like "midtier→backend"
+	Hops     []hop  `json:"hops,omitempty"`
+}
+
+// writeError writes err as an application/problem+json response.
+func writeError(resp http.ResponseWriter, tier string, err error) {
+	code, status := errorCode(err)
+	p := problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+		Code:   code,
+		Tier:   tier,
+	}
+	var ce *codedError
+	if errors.As(err, &ce) && len(ce.hops) > 0 {
+		p.Hops = ce.hops
+		last := ce.hops[len(ce.hops)-1]
+		p.FailedAt = last.From + "→" + last.To
+	}
+	b, merr := json.Marshal(&p)
+	if merr != nil {
+		http.Error(resp, err.Error(), status)
+		return
+	}
+	resp.Header().Set("Content-type", "application/problem+json")
+	resp.Header().Set(errorCodeHeader, code)
+	if ce != nil && ce.retryAfter > 0 {
+		resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ce.retryAfter.Seconds()))))
+	}
+	resp.WriteHeader(status)
+	_, werr := resp.Write(b)
+	if werr != nil {
+		slog.Error("Write failure", "err", werr)
+	}
+}
+
+// parseProblem extracts a downstream error code and detail from a problem+json body.
+func parseProblem(data []byte) (problem, bool) {
+	var p problem
+	if json.Unmarshal(data, &p) != nil || p.Code == "" {
+		return p, false
+	}
+	return p, true
+}
+
+// headerTracker notes whether a handler has started its response.
+type headerTracker struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (t *headerTracker) WriteHeader(status int) {
+	t.wroteHeader = true
+	t.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (t *headerTracker) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+func (t *headerTracker) Write(b []byte) (int, error) {
+	t.wroteHeader = true
+	return t.ResponseWriter.Write(b)
+}
+
+// handlerPanic carries a panic from a handler running on another goroutine,
+// such as under the timeout middleware, along with that goroutine's stack.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// recoverPanics turns a panicking handler into a logged 500 problem response.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		t := &headerTracker{ResponseWriter: resp}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			var stack []byte
+			if p, ok := v.(handlerPanic); ok {
+				v, stack = p.value, p.stack
+			} else {
+				stack = debug.Stack()
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			panicsTotal.WithLabelValues(tierForPath(req.URL.Path)).Inc()
+			requestLogger(req).Error("Panic", "path", req.URL.Path, "client", clientIP(req), "panic", fmt.Sprint(v), "stack", string(stack))
+			recordEvent(eventPanic, "Panic serving %s: %v", req.URL.Path, v)
+			if t.wroteHeader {
+				// too late for an error response; drop the connection
+				panic(http.ErrAbortHandler)
+			}
+			writeError(resp, tierForPath(req.URL.Path), withCode(codePanic, http.StatusInternalServerError, fmt.Errorf("panic: %v", v)))
+		}()
+		next.ServeHTTP(t, req)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventMemory is how many lifecycle events /debug/events keeps.
+const eventMemory = 200
+
+// Kinds of lifecycle events.
+const (
+	eventStartup     = "startup"
+	eventShutdown    = "shutdown"
+	eventConfig      = "config"
+	eventTLS         = "tls"
+	eventDrain       = "drain"
+	eventReadiness   = "readiness"
+	eventDependency  = "dependency"
+	eventMaintenance = "maintenance"
+	eventScenario    = "scenario"
+	eventPanic       = "panic"
+	eventVersion     = "version"
+	eventBackup      = "backup"
+)
+
+// lifecycleEvent is one significant thing that happened to this instance.
+type lifecycleEvent struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+// eventLog keeps the most recent lifecycle events.
+var eventLog struct {
+	lock   sync.Mutex
+	events []lifecycleEvent
+}
+
+// recordEvent adds an event to the lifecycle event log.
+func recordEvent(kind, format string, args ...interface{}) {
+	e := lifecycleEvent{Time: time.Now(), Kind: kind, Message: fmt.Sprintf(format, args...)}
+	eventLog.lock.Lock()
+	defer eventLog.lock.Unlock()
+	eventLog.events = append(eventLog.events, e)
+	if len(eventLog.events) > eventMemory {
+		eventLog.events = eventLog.events[len(eventLog.events)-eventMemory:]
+	}
+}
+
+var eventsTemplate = template.Must(template.New("events").Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="utf-8"/>
+		<title>Events</title>
+		<link rel="stylesheet" type="text/css" href="/static/dog.css"/>
+	</head>
+	<body>
+		<h1>Events</h1>
+		<table class="debug">
+			<tr><th>Time</th><th>Kind</th><th>Event</th></tr>
+			{{ range . }}<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.Kind}}</td><td>{{.Message}}</td></tr>
+			{{ end }}
+		</table>
+	</body>
+</html>
+`))
+
+// debugEvents shows the lifecycle event log, oldest first, as HTML, or JSON
+// when asked, for narrating what happened during an incident.
+func debugEvents(resp http.ResponseWriter, req *http.Request) {
+	eventLog.lock.Lock()
+	events := append([]lifecycleEvent{}, eventLog.events...)
+	eventLog.lock.Unlock()
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		b, err := json.Marshal(events)
+		if err != nil {
+			requestLogger(req).Error("Cannot marshal JSON", "err", err)
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Header().Set("Content-type", "application/json")
+		resp.Write(b)
+		return
+	}
+	resp.Header().Set("Content-type", "text/html; charset=utf-8")
+	err := eventsTemplate.Execute(resp, events)
+	if err != nil {
+		requestLogger(req).Error("Cannot render events", "err", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of exported records.
+const (
+	exportTally    = "tally"
+	exportFavorite = "favorite"
+	exportHistory  = "history"
+)
+
+// exportFlushEvery is how many records are written between flushes, so a
+// large export streams instead of building up in memory.
+const exportFlushEvery = 100
+
+// exportRecord is one row of an export: a tally, a user's favorite, or a
+// history entry.
+type exportRecord struct {
+	Type      string     `json:"type"`
+	Tally     string     `json:"tally,omitempty"` // votes or results
+	User      string     `json:"user,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+	Kind      string     `json:"kind,omitempty"`    // of a history entry
+	Version   string     `json:"version,omitempty"` // backend version, as v1
+	Dog       string     `json:"dog,omitempty"`
+	Count     int64      `json:"count,omitempty"`
+	ErrorCode string     `json:"errorCode,omitempty"`
+}
+
+var exportColumns = []string{"type", "tally", "user", "time", "kind", "version", "dog", "count", "error_code"}
+
+// csvRow returns the record in exportColumns order.
+func (r *exportRecord) csvRow() []string {
+	var t, count string
+	if r.Time != nil {
+		t = r.Time.Format(time.RFC3339Nano)
+	}
+	if r.Type == exportTally {
+		count = strconv.FormatInt(r.Count, 10)
+	}
+	return []string{r.Type, r.Tally, r.User, t, r.Kind, r.Version, r.Dog, count, r.ErrorCode}
+}
+
+// exportWriter streams records as CSV or as a JSON array.
+type exportWriter struct {
+	resp    http.ResponseWriter
+	format  string
+	csv     *csv.Writer
+	written int
+}
+
+func (w *exportWriter) begin() {
+	if w.format == "csv" {
+		w.csv = csv.NewWriter(w.resp)
+		w.csv.Write(exportColumns)
+		return
+	}
+	w.resp.Write([]byte("[\n"))
+}
+
+func (w *exportWriter) write(r *exportRecord) error {
+	if w.csv != nil {
+		if err := w.csv.Write(r.csvRow()); err != nil {
+			return err
+		}
+	} else {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if w.written > 0 {
+			w.resp.Write([]byte(",\n"))
+		}
+		if _, err = w.resp.Write(b); err != nil {
+			return err
+		}
+	}
+	w.written++
+	if w.written%exportFlushEvery == 0 {
+		w.flush()
+	}
+	return nil
+}
+
+func (w *exportWriter) flush() {
+	if w.csv != nil {
+		w.csv.Flush()
+	}
+	http.NewResponseController(w.resp).Flush()
+}
+
+func (w *exportWriter) end() {
+	if w.csv == nil {
+		w.resp.Write([]byte("\n]\n"))
+	}
+	w.flush()
+}
+
+// tenantTallies returns a tally's entries for one tenant, keyed without the
+// tenant.
+func tenantTallies(m *expvar.Map, tenant string) map[string]expvar.Var {
+	entries := make(map[string]expvar.Var)
+	m.Do(func(kv expvar.KeyValue) {
+		t, key, ok := strings.Cut(kv.Key, "/")
+		if !ok {
+			t, key = "", kv.Key
+		}
+		if t == tenant {
+			entries[key] = kv.Value
+		}
+	})
+	return entries
+}
+
+// tallyRecords returns the vote and result tallies of a tenant, in order.
+func tallyRecords(tenant string) []exportRecord {
+	var records []exportRecord
+	votes := tenantTallies(votesVar, tenant)
+	for _, dog := range sortedKeys(votes) {
+		if n, ok := votes[dog].(*expvar.Int); ok {
+			records = append(records, exportRecord{Type: exportTally, Tally: "votes", Dog: dog, Count: n.Value()})
+		}
+	}
+	results := tenantTallies(resultsVar, tenant)
+	for _, v := range sortedKeys(results) {
+		m, ok := results[v].(*expvar.Map)
+		if !ok {
+			continue
+		}
+		m.Do(func(kv expvar.KeyValue) {
+			if n, ok := kv.Value.(*expvar.Int); ok {
+				records = append(records, exportRecord{Type: exportTally, Tally: "results", Version: v, Dog: kv.Key, Count: n.Value()})
+			}
+		})
+	}
+	return records
+}
+
+func sortedKeys(m map[string]expvar.Var) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// exportAPI streams the tallies and every user's favorite and history, as
+// CSV with ?format=csv or else as a JSON array, for analysis after a
+// workshop. Users are read one at a time, so the store isn't locked while
+// the response is written. When multi-tenancy is on only the caller's
+// tenant is exported.
+func exportAPI(resp http.ResponseWriter, req *http.Request) {
+	format := req.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "json"
+	case "csv", "json":
+	default:
+		writeError(resp, tierUI, withCode(codeBadRequest, http.StatusBadRequest, errors.New("format must be csv or json")))
+		return
+	}
+	s, err := getStore()
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	users, err := s.Users()
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	tenant := getRequestContext(req).Tenant
+	prefix := ""
+	if *tenantSource != "" {
+		prefix = tenant + "/"
+	}
+
+	if format == "csv" {
+		resp.Header().Set("Content-type", "text/csv; charset=utf-8")
+	} else {
+		resp.Header().Set("Content-type", "application/json")
+	}
+	resp.Header().Set("Content-Disposition", `attachment; filename="topdog-export.`+format+`"`)
+	resp.Header().Set("Cache-Control", "no-store")
+	w := &exportWriter{resp: resp, format: format}
+	w.begin()
+	defer w.end()
+
+	logger := requestLogger(req)
+	for _, r := range tallyRecords(tenant) {
+		if err := w.write(&r); err != nil {
+			logger.Warn("Export stopped", "err", err)
+			return
+		}
+	}
+	for _, key := range users {
+		user, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		fav, err := s.Favorite(key)
+		if err == nil && fav != "" {
+			err = w.write(&exportRecord{Type: exportFavorite, User: user, Dog: fav})
+		}
+		var h []historyEntry
+		if err == nil {
+			h, err = s.History(key)
+		}
+		// oldest first, like the tallies accumulated
+		for i := len(h) - 1; i >= 0 && err == nil; i-- {
+			e := h[i]
+			r := exportRecord{Type: exportHistory, User: user, Time: &e.Time, Kind: e.Kind, Dog: e.Dog, ErrorCode: e.ErrorCode}
+			if e.BackendVersion != 0 {
+				r.Version = "v" + strconv.Itoa(e.BackendVersion)
+			}
+			err = w.write(&r)
+		}
+		if err != nil {
+			// the status has been sent, so all that can be done is stop
+			logger.Warn("Export stopped", "user", user, "err", err)
+			return
+		}
+	}
+}
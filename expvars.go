@@ -0,0 +1,44 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// Running tallies published at /debug/vars, for watching results skew
+// between versions without a metrics stack.
+var (
+	votesVar            = expvar.NewMap("votes")             // backend votes by dog
+	resultsVar          = expvar.NewMap("results")           // UI results by backend version, then dog
+	requestsVar         = expvar.NewMap("requests")          // requests served by route
+	downstreamErrorsVar = expvar.NewMap("downstream_errors") // failed downstream calls by tier→target and code
+
+	resultsLock sync.Mutex
+)
+
+// tallyKey keeps each tenant's tallies apart, as tenant/key.
+func tallyKey(tenant, key string) string {
+	if tenant == "" {
+		return key
+	}
+	return tenant + "/" + key
+}
+
+// tallyResult counts a result the UI received, by backend version and dog.
+func tallyResult(result *backEndResponse) {
+	addResults(result.Tenant, fmt.Sprintf("v%d", result.BackendVersion), result.TopDog, 1)
+}
+
+// addResults adds n results for a dog from a backend version, such as v1.
+func addResults(tenant, version, dog string, n int64) {
+	key := tallyKey(tenant, version)
+	resultsLock.Lock()
+	m, ok := resultsVar.Get(key).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map)
+		resultsVar.Set(key, m)
+	}
+	resultsLock.Unlock()
+	m.Add(dog, n)
+}
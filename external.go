@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var externalURL = flag.String("external_url", "", "Public URL, such as https://httpbin.org/get, that /external fetches and relays, for ServiceEntry and egress gateway demos (empty disables /external)")
+
+// externalMaxBody limits how much of the external response is relayed.
+const externalMaxBody = 1 << 20
+
+// targetExternal labels calls to external_url in metrics and spans.
+const targetExternal = "external"
+
+var errNoExternalURL = errors.New("set external_url to enable /external")
+
+// externalAPI fetches external_url with the downstream client and relays the
+// status, content type, and body, so a blocked or redirected egress shows up
+// as it would to any workload in the mesh.
+func externalAPI(resp http.ResponseWriter, req *http.Request) {
+	tier := tierForPath(req.URL.Path)
+	if *externalURL == "" {
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusNotFound, errNoExternalURL))
+		return
+	}
+	req, span := startClientSpan(tier, targetExternal, *externalURL, req)
+	start := time.Now()
+	status, header, body, err := fetchExternal(req)
+	countDownstream(req.Context(), tier, targetExternal, status, err, time.Since(start))
+	endClientSpan(span, status, err)
+	if status == 0 {
+		requestLogger(req).Warn("External request error", "url", *externalURL, "err", err)
+		writeError(resp, tier, err)
+		return
+	}
+	if ct := header.Get("Content-Type"); ct != "" {
+		resp.Header().Set("Content-Type", ct)
+	}
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(status)
+	resp.Write(body)
+}
+
+// fetchExternal calls external_url, returning the status and body if a
+// response was received. Only the request and trace IDs are sent along, not
+// the user.
+func fetchExternal(originalRequest *http.Request) (int, http.Header, []byte, error) {
+	request, err := http.NewRequestWithContext(originalRequest.Context(), "GET", *externalURL, nil)
+	if err != nil {
+		return 0, nil, nil, withCode(codeInternal, http.StatusInternalServerError, err)
+	}
+	request.Header.Set(requestIDHeader, getRequestContext(originalRequest).RequestID)
+	copyB3(request, originalRequest)
+	copyTraceContext(request, originalRequest)
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, nil, nil, classifyTransportError(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, externalMaxBody))
+	if err != nil {
+		return 0, nil, nil, classifyTransportError(err)
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err = withCode(codeDownstreamError, response.StatusCode, fmt.Errorf("%s returned %s", *externalURL, response.Status))
+	}
+	return response.StatusCode, response.Header, body, err
+}
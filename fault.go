@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// faults describes failures injected from the admin page.
+type faults struct {
+	errorRate float64       // chance (0 to 1) that a request fails
+	latency   time.Duration // added to every request
+}
+
+var (
+	faultMu      sync.RWMutex
+	activeFaults faults
+)
+
+// currentFaults returns the faults being injected.
+func currentFaults() faults {
+	faultMu.RLock()
+	defer faultMu.RUnlock()
+	return activeFaults
+}
+
+// setFaults changes the faults being injected.
+func setFaults(f faults) error {
+	if f.errorRate < 0 || f.errorRate > 1 {
+		return fmt.Errorf("error rate %g is not between 0 and 1", f.errorRate)
+	}
+	if f.latency < 0 {
+		return errors.New("latency must not be negative")
+	}
+	faultMu.Lock()
+	activeFaults = f
+	faultMu.Unlock()
+	return nil
+}
+
+// injectFaults delays or fails requests to a route as configured.
+func injectFaults(route string, next http.Handler) http.Handler {
+	tier := tierForPath(route)
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		f := currentFaults()
+		if f.latency > 0 {
+			select {
+			case <-time.After(f.latency):
+			case <-req.Context().Done():
+			}
+		}
+		if f.errorRate > 0 {
+			rnd := getRand()
+			fail := rnd.Float64() < f.errorRate
+			putRand(rnd)
+			if fail {
+				writeError(resp, tier, withCode(codeInjectedFault, http.StatusInternalServerError, errors.New("fault injected from the admin page")))
+				return
+			}
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
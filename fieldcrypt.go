@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var fieldKey = flag.String("field_key", "", "Key for encrypting the winning dog between the backend and UI: base64:<32 bytes> or kms:<key id> (empty disables encryption)")
+
+// encryptedPrefix marks an encrypted field value.
+const encryptedPrefix = "enc:v1:"
+
+// fieldAAD binds ciphertexts to their purpose.
+var fieldAAD = []byte("topdog/topDog")
+
+// keyProvider supplies the field encryption key.
+type keyProvider interface {
+	Key() ([]byte, error)
+}
+
+// staticKey is a key given directly, usually through the FIELD_KEY environment variable.
+type staticKey string
+
+func (k staticKey) Key() ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(string(k))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("key is %d bytes, not 32", len(b))
+	}
+	return b, nil
+}
+
+// kmsStub stands in for a key management service. It derives the key from
+// the key ID, so every tier configured with the same ID gets the same key.
+// A real KMS would fetch or unwrap the key instead.
+type kmsStub string
+
+func (k kmsStub) Key() ([]byte, error) {
+	if k == "" {
+		return nil, errors.New("missing key id")
+	}
+	sum := sha256.Sum256([]byte("topdog-kms-stub/" + string(k)))
+	return sum[:], nil
+}
+
+// parseKeyProvider reads the field_key setting.
+func parseKeyProvider(s string) (keyProvider, error) {
+	kind, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("%q is not base64:<key> or kms:<key id>", s)
+	}
+	switch kind {
+	case "base64":
+		return staticKey(value), nil
+	case "kms":
+		return kmsStub(value), nil
+	}
+	return nil, fmt.Errorf("unknown key source %q", kind)
+}
+
+var (
+	fieldCipherOnce sync.Once
+	fieldCipher     cipher.AEAD
+	fieldCipherErr  error
+)
+
+// getFieldCipher returns the AEAD for field encryption, or nil when it is off.
+func getFieldCipher() (cipher.AEAD, error) {
+	fieldCipherOnce.Do(func() {
+		if *fieldKey == "" {
+			return
+		}
+		var kp keyProvider
+		kp, fieldCipherErr = parseKeyProvider(*fieldKey)
+		if fieldCipherErr != nil {
+			return
+		}
+		var key []byte
+		key, fieldCipherErr = kp.Key()
+		if fieldCipherErr != nil {
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			fieldCipherErr = err
+			return
+		}
+		fieldCipher, fieldCipherErr = cipher.NewGCM(block)
+		if _, ok := kp.(kmsStub); ok && fieldCipherErr == nil {
+			slog.Warn("Using the stub KMS for field encryption; keys are derived from the key id")
+		}
+	})
+	return fieldCipher, fieldCipherErr
+}
+
+// encryptField encrypts a value with AES-GCM when field encryption is on.
+func encryptField(v string) (string, error) {
+	aead, err := getFieldCipher()
+	if err != nil || aead == nil {
+		return v, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(v), fieldAAD)
+	return encryptedPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptField reverses encryptField. Values that aren't encrypted are
+// returned as they are.
+func decryptField(v string) (string, error) {
+	enc, ok := strings.CutPrefix(v, encryptedPrefix)
+	if !ok {
+		return v, nil
+	}
+	aead, err := getFieldCipher()
+	if err != nil {
+		return "", withCode(codeDecryptFailed, http.StatusBadGateway, err)
+	}
+	if aead == nil {
+		return "", withCode(codeDecryptFailed, http.StatusBadGateway, errors.New("received an encrypted field but field_key is not set"))
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", withCode(codeDecryptFailed, http.StatusBadGateway, errors.New("malformed encrypted field"))
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], fieldAAD)
+	if err != nil {
+		return "", withCode(codeDecryptFailed, http.StatusBadGateway, err)
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+var (
+	grpcPort    = flag.Int("grpc_port", 0, "Port for the gRPC Vote services of the backend and midtier, for gRPC routing, load balancing, and retry demos (0 disables it)")
+	backendGRPC = flag.String("backend_grpc", "", "host:port of the backend's gRPC service; when set, the midtier votes over gRPC instead of calling /backend")
+	midtierGRPC = flag.String("midtier_grpc", "", "host:port of the midtier's gRPC service; when set, the UI votes over gRPC instead of calling /midtier")
+
+	grpcReflection = flag.Bool("grpc_reflection", true, "Serve gRPC reflection on grpc_port, so grpcurl and other clients can call the services without topdog.proto")
+)
+
+// The gRPC services, described in topdog.proto. Each bridges to the HTTP
+// route of its tier.
+const (
+	grpcBackendService = "topdog.v1.Backend"
+	grpcMidtierService = "topdog.v1.Midtier"
+)
+
+// Metadata in the gRPC trailer of a failed vote, alongside
+// x-topdog-error-code, so the caller sees the same failure as over HTTP.
+const (
+	statusMetadata = "x-topdog-status" // HTTP status
+	hopsMetadata   = "x-topdog-hops"   // JSON of the failed calls below
+)
+
+// voteRequest is the Vote request. The tenant, user, and trace context come
+// from metadata, as they do from headers over HTTP.
+type voteRequest struct{}
+
+// voteReply is the Vote response, the fields of backEndResponse filled in
+// by the backend and midtier.
+type voteReply struct {
+	TopDog         string
+	BackendVersion int
+	RequestID      string
+	Tenant         string
+	BackendMillis  float64
+	Baggage        map[string]string
+	MidtierVersion int
+	MidtierMillis  float64
+}
+
+// Field numbers of voteReply.
+const (
+	fieldTopDog protowire.Number = iota + 1
+	fieldBackendVersion
+	fieldRequestID
+	fieldTenant
+	fieldBackendMillis
+	fieldBaggage
+	fieldMidtierVersion
+	fieldMidtierMillis
+)
+
+func (r *voteReply) marshal() []byte {
+	var b []byte
+	str := func(n protowire.Number, s string) {
+		if s != "" {
+			b = protowire.AppendTag(b, n, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+	integer := func(n protowire.Number, v int) {
+		if v != 0 {
+			b = protowire.AppendTag(b, n, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		}
+	}
+	double := func(n protowire.Number, v float64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, n, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(v))
+		}
+	}
+	str(fieldTopDog, r.TopDog)
+	integer(fieldBackendVersion, r.BackendVersion)
+	str(fieldRequestID, r.RequestID)
+	str(fieldTenant, r.Tenant)
+	double(fieldBackendMillis, r.BackendMillis)
+	for k, v := range r.Baggage {
+		var e []byte
+		e = protowire.AppendTag(e, 1, protowire.BytesType)
+		e = protowire.AppendString(e, k)
+		e = protowire.AppendTag(e, 2, protowire.BytesType)
+		e = protowire.AppendString(e, v)
+		b = protowire.AppendTag(b, fieldBaggage, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	integer(fieldMidtierVersion, r.MidtierVersion)
+	double(fieldMidtierMillis, r.MidtierMillis)
+	return b
+}
+
+func (r *voteReply) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == fieldTopDog && typ == protowire.BytesType:
+			r.TopDog, n = protowire.ConsumeString(b)
+		case num == fieldBackendVersion && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			r.BackendVersion = int(v)
+		case num == fieldMidtierVersion && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			r.MidtierVersion = int(v)
+		case num == fieldRequestID && typ == protowire.BytesType:
+			r.RequestID, n = protowire.ConsumeString(b)
+		case num == fieldTenant && typ == protowire.BytesType:
+			r.Tenant, n = protowire.ConsumeString(b)
+		case num == fieldBackendMillis && typ == protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			r.BackendMillis = math.Float64frombits(v)
+		case num == fieldMidtierMillis && typ == protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			r.MidtierMillis = math.Float64frombits(v)
+		case num == fieldBaggage && typ == protowire.BytesType:
+			var e []byte
+			e, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				k, v, err := unmarshalMapEntry(e)
+				if err != nil {
+					return err
+				}
+				if r.Baggage == nil {
+					r.Baggage = make(map[string]string)
+				}
+				r.Baggage[k] = v
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// unmarshalMapEntry reads one entry of a map<string, string>.
+func unmarshalMapEntry(b []byte) (string, string, error) {
+	var k, v string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			k, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			v, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return k, v, nil
+}
+
+// voteCodec encodes the Vote messages as protobuf without generated code.
+// Other messages, such as those of gRPC's own services, use the proto package.
+type voteCodec struct{}
+
+func (voteCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *voteRequest:
+		return nil, nil
+	case *voteReply:
+		return m.marshal(), nil
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("cannot marshal %T", v)
+}
+
+func (voteCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *voteRequest:
+		return nil // no fields yet
+	case *voteReply:
+		return m.unmarshal(data)
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("cannot unmarshal %T", v)
+}
+
+// Name is the content subtype, so requests are sent as application/grpc+proto.
+func (voteCodec) Name() string {
+	return "proto"
+}
+
+// grpcBridge serves Vote by running the request through the same handler,
+// middleware included, as the HTTP route of its tier, so faults, delays,
+// caching, metrics, and the voting strategy behave the same over both
+// protocols.
+type grpcBridge struct {
+	handler http.Handler
+}
+
+// topdogProto describes the services and messages of topdog.proto, for
+// reflection. It must be kept in step with that file and voteReply.
+func topdogProto() *descriptorpb.FileDescriptorProto {
+	field := func(name string, n int32, t descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(jsonCamelCase(name)),
+			Number:   proto.Int32(n),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     t.Enum(),
+		}
+	}
+	baggage := field("baggage", int32(fieldBaggage), descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	baggage.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	baggage.TypeName = proto.String(".topdog.v1.VoteReply.BaggageEntry")
+	vote := func(service string) *descriptorpb.ServiceDescriptorProto {
+		return &descriptorpb.ServiceDescriptorProto{
+			Name: proto.String(strings.TrimPrefix(service, "topdog.v1.")),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Vote"),
+				InputType:  proto.String(".topdog.v1.VoteRequest"),
+				OutputType: proto.String(".topdog.v1.VoteReply"),
+			}},
+		}
+	}
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("topdog.proto"),
+		Package: proto.String("topdog.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("VoteRequest")},
+			{
+				Name: proto.String("VoteReply"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("top_dog", int32(fieldTopDog), descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("backend_version", int32(fieldBackendVersion), descriptorpb.FieldDescriptorProto_TYPE_INT32),
+					field("request_id", int32(fieldRequestID), descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("tenant", int32(fieldTenant), descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("backend_millis", int32(fieldBackendMillis), descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+					baggage,
+					field("midtier_version", int32(fieldMidtierVersion), descriptorpb.FieldDescriptorProto_TYPE_INT32),
+					field("midtier_millis", int32(fieldMidtierMillis), descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{{
+					Name: proto.String("BaggageEntry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+						field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{vote(grpcBackendService), vote(grpcMidtierService)},
+	}
+}
+
+// jsonCamelCase returns the JSON name protoc gives a field, such as topDog for top_dog.
+func jsonCamelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// registerTopdogProto adds topdog.proto to the registry reflection reads.
+func registerTopdogProto() error {
+	if _, err := protoregistry.GlobalFiles.FindFileByPath("topdog.proto"); err == nil {
+		return nil
+	}
+	fd, err := protodesc.NewFile(topdogProto(), protoregistry.GlobalFiles)
+	if err != nil {
+		return err
+	}
+	return protoregistry.GlobalFiles.RegisterFile(fd)
+}
+
+// grpcServiceDesc describes a service whose Vote method bridges to path.
+func grpcServiceDesc(service, path string) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: service,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Vote",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				var in voteRequest
+				if err := dec(&in); err != nil {
+					return nil, err
+				}
+				return srv.(*grpcBridge).vote(ctx, path)
+			},
+		}},
+		Metadata: "topdog.proto",
+	}
+}
+
+// checkGRPCAddr verifies a backend_grpc or midtier_grpc setting.
+func checkGRPCAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%q is not host:port: %w", addr, err)
+	}
+	return nil
+}
+
+// startGRPC serves the Vote services on grpc_port.
+func startGRPC(h http.Handler) (*grpc.Server, error) {
+	if *grpcPort == 0 {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *grpcPort))
+	if err != nil {
+		return nil, err
+	}
+	s := grpc.NewServer(grpc.ForceServerCodec(voteCodec{}))
+	bridge := &grpcBridge{handler: h}
+	s.RegisterService(grpcServiceDesc(grpcBackendService, "/backend"), bridge)
+	s.RegisterService(grpcServiceDesc(grpcMidtierService, "/midtier"), bridge)
+	healthpb.RegisterHealthServer(s, health.NewServer()) // for gRPC readiness probes
+	if *grpcReflection {
+		if err := registerTopdogProto(); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("topdog.proto: %w", err)
+		}
+		reflection.Register(s)
+	}
+	slog.Info("gRPC listening", "addr", ln.Addr().String())
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			slog.Error("Cannot serve gRPC", "err", err)
+		}
+	}()
+	return s, nil
+}
+
+// grpcResponse collects the response of the bridged handler.
+type grpcResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *grpcResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *grpcResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *grpcResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+// vote handles one Vote call by serving path. Metadata becomes request
+// headers, and response headers are sent back as metadata.
+func (g *grpcBridge) vote(ctx context.Context, path string) (*voteReply, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, vs := range md {
+		switch {
+		case k == ":authority":
+			req.Host = vs[0]
+		case strings.HasPrefix(k, ":"), strings.HasPrefix(k, "grpc-"), k == "content-type", k == "te":
+		default:
+			req.Header[textproto.CanonicalMIMEHeaderKey(k)] = vs
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+	}
+
+	resp := &grpcResponse{header: make(http.Header)}
+	g.handler.ServeHTTP(resp, req)
+
+	out := metadata.MD{}
+	for k, vs := range resp.header {
+		switch k {
+		case "Content-Type", "Content-Length", "Content-Encoding", "Vary", http.CanonicalHeaderKey(checksumHeader):
+		default:
+			out[strings.ToLower(k)] = vs
+		}
+	}
+	if resp.status < 200 || resp.status > 299 {
+		detail := resp.body.String()
+		code := resp.header.Get(errorCodeHeader)
+		if p, ok := parseProblem(resp.body.Bytes()); ok {
+			detail, code = p.Detail, p.Code
+			if len(p.Hops) > 0 {
+				b, _ := json.Marshal(p.Hops)
+				out.Set(hopsMetadata, string(b))
+			}
+		}
+		out.Set(errorCodeHeader, code)
+		out.Set(statusMetadata, strconv.Itoa(resp.status))
+		grpc.SetTrailer(ctx, out)
+		return nil, status.Error(grpcCode(resp.status), detail)
+	}
+	// the body doesn't travel as JSON, so check it here
+	if err := verifyChecksum(resp.header, resp.body.Bytes()); err != nil {
+		out.Set(errorCodeHeader, codeChecksumMismatch)
+		out.Set(statusMetadata, strconv.Itoa(resp.status))
+		grpc.SetTrailer(ctx, out)
+		return nil, status.Error(codes.DataLoss, err.Error())
+	}
+	grpc.SetHeader(ctx, out)
+	result, err := unmarshalResponse(resp.body.Bytes())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &voteReply{
+		TopDog:         result.TopDog,
+		BackendVersion: result.BackendVersion,
+		RequestID:      result.RequestID,
+		Tenant:         result.Tenant,
+		BackendMillis:  result.BackendMillis,
+		Baggage:        result.Baggage,
+		MidtierVersion: result.MidtierVersion,
+		MidtierMillis:  result.MidtierMillis,
+	}, nil
+}
+
+// grpcCode maps an HTTP status to the gRPC code Envoy and grpc-gateway use for it.
+func grpcCode(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Unknown
+}
+
+var grpcConns = struct {
+	sync.Mutex
+	m map[string]*grpc.ClientConn
+}{m: make(map[string]*grpc.ClientConn)}
+
+// grpcConn returns the connection to a gRPC address. The sidecar, not the
+// client, balances calls across pods, so one connection per address is shared.
+func grpcConn(addr string) (*grpc.ClientConn, error) {
+	grpcConns.Lock()
+	defer grpcConns.Unlock()
+	if conn, ok := grpcConns.m[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(voteCodec{})))
+	if err != nil {
+		return nil, err
+	}
+	grpcConns.m[addr] = conn
+	return conn, nil
+}
+
+// grpcVoteURL identifies a Vote call in spans, metrics, and caches, where
+// HTTP calls use the route's URL.
+func grpcVoteURL(addr, service string) string {
+	return "grpc://" + addr + "/" + service + "/Vote"
+}
+
+// midtierCallURL returns what the UI calls to vote: the midtier's gRPC
+// service when midtier_grpc is set, or else /midtier.
+func midtierCallURL() string {
+	if *midtierGRPC != "" {
+		return grpcVoteURL(*midtierGRPC, grpcMidtierService)
+	}
+	return *midtierURL + "/midtier"
+}
+
+// fetchGRPC makes the Vote call named by a grpc:// URL, returning the HTTP
+// status the called tier reported if the call failed there.
+func fetchGRPC(tier, target, url string, originalRequest *http.Request) (*backEndResponse, int, error) {
+	logger := requestLogger(originalRequest)
+	addr, method, _ := strings.Cut(strings.TrimPrefix(url, "grpc://"), "/")
+	conn, err := grpcConn(addr)
+	if err != nil {
+		return nil, 0, withCode(codeDownstreamUnreachable, http.StatusBadGateway, err)
+	}
+
+	// send the same headers as over HTTP, as metadata
+	headers, _ := http.NewRequest(http.MethodGet, url, nil)
+	copyHeaders(headers, originalRequest)
+	md := metadata.MD{}
+	for k, vs := range headers.Header {
+		md[strings.ToLower(k)] = vs
+	}
+	ctx, cancel := context.WithTimeout(originalRequest.Context(), client.Timeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	var reply voteReply
+	var header, trailer metadata.MD
+	err = conn.Invoke(ctx, "/"+method, &voteRequest{}, &reply, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		st := status.Convert(err)
+		logger.Warn("gRPC error", "url", url, "code", st.Code().String(), "err", st.Message())
+		if code := first(trailer.Get(errorCodeHeader)); code != "" {
+			s, _ := strconv.Atoi(first(trailer.Get(statusMetadata)))
+			if s == 0 {
+				s = http.StatusBadGateway
+			}
+			var hops []hop
+			json.Unmarshal([]byte(first(trailer.Get(hopsMetadata))), &hops)
+			return nil, s, &codedError{code: code, status: s, err: errors.New(st.Message()), hops: hops}
+		}
+		switch st.Code() {
+		case codes.DeadlineExceeded, codes.Canceled:
+			return nil, 0, withCode(codeDownstreamTimeout, http.StatusGatewayTimeout, err)
+		case codes.Unavailable:
+			return nil, 0, withCode(codeDownstreamUnreachable, http.StatusBadGateway, err)
+		}
+		return nil, 0, withCode(codeDownstreamError, http.StatusBadGateway, err)
+	}
+
+	result := &backEndResponse{
+		TopDog:         reply.TopDog,
+		BackendVersion: reply.BackendVersion,
+		RequestID:      reply.RequestID,
+		Tenant:         reply.Tenant,
+		BackendMillis:  reply.BackendMillis,
+		Baggage:        reply.Baggage,
+		MidtierVersion: reply.MidtierVersion,
+		MidtierMillis:  reply.MidtierMillis,
+	}
+	if d, err := time.ParseDuration(first(header.Get(retryWaitedHeader))); err == nil {
+		result.retryWaited = d
+	}
+	result.cacheHit = first(header.Get(cacheHeader)) == "HIT"
+	result.serverTiming = first(header.Get(serverTimingHeader))
+	return result, http.StatusOK, nil
+}
+
+// first returns the first value, or "" if there are none.
+func first(vs []string) string {
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
@@ -1,17 +1,35 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the ID Envoy assigns to each request, which every
+// tier passes on and echoes back.
+const requestIDHeader = "x-request-id"
+
+// traceIDHeader returns the trace ID of a /query call, so the UI can link to
+// the trace of a failed call too.
+const traceIDHeader = "x-topdog-trace-id"
 
 var headersToCopy = []string{
-	"x-request-id",
-	"x-b3-traceid",
-	"x-b3-spanid",
-	"x-b3-parentspanid",
-	"x-b3-sampled",
-	"x-b3-flags",
 	"x-ot-span-context",
+	baggageHeader,
+	favoriteHeader,
+	backendOverrideHeader,
 }
 
+// copyHeaders copies the headers needed for Istio, and passes on the request
+// ID, user, cohort, and tenant from the request context. If the incoming request has
+// no B3 context, as when topdog runs outside the mesh, a new one is generated
+// so the downstream tiers still share a trace.
 func copyHeaders(toReq *http.Request, fromReq *http.Request) {
 	// Copy headers needed for Istio
 	for _, h := range headersToCopy {
@@ -20,4 +38,91 @@ func copyHeaders(toReq *http.Request, fromReq *http.Request) {
 			toReq.Header.Set(h, val)
 		}
 	}
+	rc := getRequestContext(fromReq)
+	id := rc.RequestID
+	if id == "" {
+		id = newRequestID()
+	}
+	toReq.Header.Set(requestIDHeader, id)
+	if rc.User != "" {
+		toReq.Header.Set(userHeader, rc.User)
+	}
+	if rc.Cohort != "" {
+		toReq.Header.Set(cohortHeader, rc.Cohort)
+	}
+	if rc.Tenant != "" {
+		toReq.Header.Set(tenantHeader, rc.Tenant)
+	}
+	copyB3(toReq, fromReq)
+	copyTraceContext(toReq, fromReq)
+}
+
+// w3c reads and writes the W3C traceparent and tracestate headers.
+var w3c = propagation.TraceContext{}
+
+// w3cSpanContext returns the W3C trace context sent by the caller, if any.
+func w3cSpanContext(h http.Header) trace.SpanContext {
+	return trace.SpanContextFromContext(w3c.Extract(context.Background(), propagation.HeaderCarrier(h)))
+}
+
+// copyTraceContext propagates the W3C traceparent, tracestate, and baggage
+// headers used by newer Istio and OpenTelemetry setups. When we started a span
+// for the call, it becomes the parent.
+func copyTraceContext(toReq *http.Request, fromReq *http.Request) {
+	if sc := trace.SpanContextFromContext(fromReq.Context()); sc.IsValid() && !sc.IsRemote() {
+		w3c.Inject(fromReq.Context(), propagation.HeaderCarrier(toReq.Header))
+	} else if v := fromReq.Header.Get("traceparent"); v != "" {
+		toReq.Header.Set("traceparent", v)
+	}
+	for _, h := range []string{"tracestate", "baggage"} {
+		if v := fromReq.Header.Get(h); v != "" && toReq.Header.Get(h) == "" {
+			toReq.Header.Set(h, v)
+		}
+	}
+}
+
+// withTraceIDs returns req, or a copy of it with a generated B3 context when
+// it arrived without one, so the UI tier can report the trace it starts.
+func withTraceIDs(req *http.Request) *http.Request {
+	if _, ok := readB3(req.Header); ok {
+		return req
+	}
+	r := req.Clone(req.Context())
+	c := newB3Context(req)
+	c.writeMulti(r.Header)
+	getRequestContext(req).noteTraceID(c.traceID)
+	return r
+}
+
+// newB3Context starts a B3 trace, continuing our own span or the caller's
+// W3C trace when there is one.
+func newB3Context(req *http.Request) b3Context {
+	sc := trace.SpanContextFromContext(req.Context())
+	if !sc.IsValid() {
+		sc = w3cSpanContext(req.Header)
+	}
+	if sc.IsValid() {
+		c := b3Context{traceID: sc.TraceID().String(), spanID: sc.SpanID().String(), sampled: "0"}
+		if sc.IsSampled() {
+			c.sampled = "1"
+		}
+		return c
+	}
+	return b3Context{traceID: randomHex(16), spanID: randomHex(8), sampled: "1"}
+}
+
+// newRequestID returns a random UUID, the format Envoy uses for x-request-id.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// randomHex returns n random bytes as lowercase hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
@@ -3,44 +3,164 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
+	"flag"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/ancientlore/go-health"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	errNotDirectory = errors.New("Static path is not a directory")
 )
 
+var healthInterval = flag.Duration("health_interval", 30*time.Second, "How often to run the health checks in the background, keeping their metrics current between /health requests (0 runs them only for /health)")
+
+var (
+	healthCheckUp = newMetric.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "topdog_health_check_up",
+		Help: "Whether the last run of a health check passed (1) or failed (0).",
+	}, []string{"check"})
+	healthCheckDuration = newMetric.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "topdog_health_check_duration_seconds",
+		Help: "Time taken by the last run of a health check.",
+	}, []string{"check"})
+	healthChecksTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+		Name: "topdog_health_checks_total",
+		Help: "Runs of each health check, by result, so flapping between scrapes still shows.",
+	}, []string{"check", "result"})
+)
+
 var healthCheck = health.Tester{
 	Log: func(testName, messageText, errorText string) {
-		log.Print(testName+": "+messageText, ": ", errorText)
+		slog.Warn(messageText, "test", testName, "err", errorText)
 	},
-	Tests: health.TestFuncs{
+	Tests: instrumentHealthChecks(health.TestFuncs{
 		"staticFiles": func(ctx context.Context) error {
-			fi, err := os.Stat(*staticPath)
-			if err != nil {
-				return err
-			}
-			if fi.IsDir() != true {
-				return errNotDirectory
-			}
-			filesToCheck := []string{"grim-reaper.png", "dog.png", "jquery.min.js", "dog.css", "index.html", "jquery-rotate.min.js"}
-			for _, f := range filesToCheck {
-				_, err = os.Stat(filepath.Join(*staticPath, f))
-				if err != nil {
-					return err
+			return checkStaticFiles()
+		},
+		"templates": func(ctx context.Context) error {
+			return checkTemplates()
+		},
+	}),
+}
+
+// instrumentHealthChecks records the result and duration of each health
+// check as metrics whenever it runs, so failures can be alerted on.
+func instrumentHealthChecks(tests health.TestFuncs) health.TestFuncs {
+	m := make(health.TestFuncs, len(tests))
+	for name, test := range tests {
+		m[name] = func(ctx context.Context) error {
+			start := time.Now()
+			record := func(up bool) {
+				result, v := "ok", 1.0
+				if !up {
+					result, v = "error", 0
 				}
+				healthCheckUp.WithLabelValues(name).Set(v)
+				healthCheckDuration.WithLabelValues(name).Set(time.Since(start).Seconds())
+				healthChecksTotal.WithLabelValues(name, result).Inc()
 			}
-			for _, dog := range dogs {
-				_, err = os.Stat(filepath.Join(*staticPath, dog+".png"))
-				if err != nil {
-					return err
+			// a panicking check fails; the tester recovers the panic itself
+			defer func() {
+				if r := recover(); r != nil {
+					record(false)
+					panic(r)
 				}
-			}
-			return nil
-		},
-	},
+			}()
+			err := test(ctx)
+			record(err == nil)
+			return err
+		}
+	}
+	return m
+}
+
+// startHealthChecks runs the health checks every health_interval, so their
+// metrics don't depend on something polling /health.
+func startHealthChecks() {
+	if *healthInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			healthCheck.Run()
+			time.Sleep(*healthInterval)
+		}
+	}()
+}
+
+// checkStaticFiles verifies that the static folder holds the files the UI needs.
+func checkStaticFiles() error {
+	fi, err := os.Stat(*staticPath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() != true {
+		return errNotDirectory
+	}
+	filesToCheck := []string{"grim-reaper.png", "dog.png", "jquery.min.js", "dog.css", "index.html", "error.html", "jquery-rotate.min.js"}
+	for _, f := range filesToCheck {
+		_, err = os.Stat(filepath.Join(*staticPath, f))
+		if err != nil {
+			return err
+		}
+	}
+	for _, dog := range dogs {
+		_, err = os.Stat(filepath.Join(*staticPath, dog+".png"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTemplates parses the templates from disk and renders them with sample
+// data, catching breakage before a user loads the page.
+func checkTemplates() error {
+	t, err := template.ParseGlob(filepath.Join(*staticPath, "*.html"))
+	if err != nil {
+		return err
+	}
+	for _, page := range t.Templates() {
+		name := page.Name()
+		if !strings.HasPrefix(name, "index") {
+			continue
+		}
+		err = t.ExecuteTemplate(io.Discard, name, uiData("0123456789abcdef", ""))
+		if err != nil {
+			return err
+		}
+	}
+	if t.Lookup("admin.html") != nil {
+		err = t.ExecuteTemplate(io.Discard, "admin.html", newAdminPageData())
+		if err != nil {
+			return err
+		}
+	}
+	if t.Lookup("maintenance.html") != nil {
+		err = t.ExecuteTemplate(io.Discard, "maintenance.html", &errorPageData{Tier: tierUI, Version: *version, RetryURL: "/"})
+		if err != nil {
+			return err
+		}
+	}
+	return t.ExecuteTemplate(io.Discard, "error.html", &errorPageData{
+		Tier:      tierUI,
+		Version:   *version,
+		Status:    http.StatusInternalServerError,
+		Title:     http.StatusText(http.StatusInternalServerError),
+		Code:      codeInternal,
+		Detail:    "sample error",
+		RequestID: "sample-request",
+		TraceID:   "sample-trace",
+		TraceURL:  traceLink("sample-trace"),
+		RetryURL:  "/",
+	})
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	udpPort           = flag.Int("udp_port", 0, "Port to receive UDP heartbeats on (0 disables the receiver)")
+	heartbeatTarget   = flag.String("heartbeat_target", "", "host:port to send UDP heartbeats to, usually another instance's udp_port (empty disables the sender)")
+	heartbeatInterval = flag.Duration("heartbeat_interval", time.Second, "How often to send a UDP heartbeat")
+)
+
+var (
+	heartbeatsSent = newMetric.NewCounter(prometheus.CounterOpts{
+		Name: "topdog_udp_heartbeats_sent_total",
+		Help: "UDP heartbeats sent to heartbeat_target.",
+	})
+	heartbeatsReceived = newMetric.NewCounter(prometheus.CounterOpts{
+		Name: "topdog_udp_heartbeats_received_total",
+		Help: "UDP heartbeats received on udp_port.",
+	})
+	heartbeatsMissed = newMetric.NewCounter(prometheus.CounterOpts{
+		Name: "topdog_udp_heartbeats_missed_total",
+		Help: "UDP heartbeats that never arrived, judged by gaps in each sender's sequence numbers.",
+	})
+)
+
+// heartbeatMagic starts every heartbeat, which is "topdog <sender> <seq>".
+const heartbeatMagic = "topdog"
+
+// startHeartbeats starts the UDP heartbeat receiver and sender, as
+// configured, to show how the mesh treats UDP: sidecars don't capture it, so
+// it bypasses mTLS and the mesh's metrics and policies.
+func startHeartbeats() (net.PacketConn, error) {
+	var pc net.PacketConn
+	if *udpPort != 0 {
+		var err error
+		pc, err = net.ListenPacket("udp", fmt.Sprintf(":%d", *udpPort))
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Receiving UDP heartbeats", "addr", pc.LocalAddr().String())
+		go receiveHeartbeats(pc)
+	}
+	if *heartbeatTarget != "" {
+		conn, err := net.Dial("udp", *heartbeatTarget)
+		if err != nil {
+			if pc != nil {
+				pc.Close()
+			}
+			return nil, err
+		}
+		slog.Info("Sending UDP heartbeats", "target", *heartbeatTarget, "interval", heartbeatInterval.String())
+		go sendHeartbeats(conn)
+	}
+	return pc, nil
+}
+
+// sendHeartbeats sends a numbered heartbeat every heartbeat_interval.
+// Errors, such as ICMP port unreachable, are logged once per run of failures.
+func sendHeartbeats(conn net.Conn) {
+	host, _ := os.Hostname()
+	sender := fmt.Sprintf("%s/%d", host, os.Getpid())
+	failing := false
+	for seq := uint64(1); ; seq++ {
+		_, err := conn.Write([]byte(heartbeatMagic + " " + sender + " " + strconv.FormatUint(seq, 10)))
+		if err != nil {
+			if !failing {
+				slog.Warn("Cannot send UDP heartbeat", "target", *heartbeatTarget, "err", err)
+			}
+		} else {
+			heartbeatsSent.Inc()
+		}
+		failing = err != nil
+		time.Sleep(*heartbeatInterval)
+	}
+}
+
+// receiveHeartbeats counts heartbeats until the connection is closed.
+func receiveHeartbeats(pc net.PacketConn) {
+	last := make(map[string]uint64) // sequence number by sender
+	buf := make([]byte, 512)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(buf[:n]))
+		if len(fields) != 3 || fields[0] != heartbeatMagic {
+			continue
+		}
+		seq, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		heartbeatsReceived.Inc()
+		if prev, ok := last[fields[1]]; ok && seq > prev+1 {
+			heartbeatsMissed.Add(float64(seq - prev - 1))
+		}
+		if seq > last[fields[1]] || seq == 1 {
+			last[fields[1]] = seq
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg" // decode JPEG sources
+	"image/png"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/image/draw"
+)
+
+var (
+	imageCacheSize = flag.Int("image_cache", 64, "Number of resized images /images keeps in memory (0 resizes and encodes on every request, for a CPU-bound workload)")
+	imageMaxSize   = flag.Int("image_max_size", 1024, "Largest width or height, in pixels, that /images resizes to")
+)
+
+// Formats /images can return.
+const (
+	imagePNG  = "png"
+	imageWebP = "webp"
+)
+
+var imageTypes = map[string]string{
+	imagePNG:  "image/png",
+	imageWebP: "image/webp",
+}
+
+var errImageType = errors.New("only PNG and JPEG images can be resized")
+
+var imageRequestsTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_image_requests_total",
+	Help: "Images served by /images, by format and whether the render cache was hit.",
+}, []string{"format", "cache"})
+
+var imageRenderDuration = newMetric.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "topdog_image_render_duration_seconds",
+	Help:    "Time taken to decode, resize, and encode an image for /images.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"format"})
+
+// checkImages verifies the image settings.
+func checkImages() error {
+	if *imageMaxSize < 1 {
+		return fmt.Errorf("image_max_size %d must be at least 1", *imageMaxSize)
+	}
+	return nil
+}
+
+// imageFormat picks WebP for clients that accept it and PNG otherwise.
+func imageFormat(req *http.Request) string {
+	for _, accept := range req.Header.Values("Accept") {
+		if strings.Contains(accept, "image/webp") {
+			return imageWebP
+		}
+	}
+	return imagePNG
+}
+
+// imageSize reads the w and h query parameters. Zero means the dimension
+// follows from the other one, or from the source image if both are zero.
+func imageSize(req *http.Request) (w, h int, err error) {
+	q := req.URL.Query()
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{{"w", &w}, {"h", &h}} {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > *imageMaxSize {
+			return 0, 0, fmt.Errorf("%s must be between 1 and %d", p.name, *imageMaxSize)
+		}
+		*p.v = n
+	}
+	return w, h, nil
+}
+
+// fitImage returns the size to scale src to so it fits within w by h,
+// keeping its aspect ratio. Images are never enlarged.
+func fitImage(src image.Rectangle, w, h int) image.Rectangle {
+	sw, sh := src.Dx(), src.Dy()
+	scale := 1.0
+	if w > 0 && w < sw {
+		scale = float64(w) / float64(sw)
+	}
+	if h > 0 && h < sh && float64(h)/float64(sh) < scale {
+		scale = float64(h) / float64(sh)
+	}
+	return image.Rect(0, 0, max(1, int(float64(sw)*scale+0.5)), max(1, int(float64(sh)*scale+0.5)))
+}
+
+// renderImage decodes a static image, scales it to fit w by h, and encodes it
+// in the given format.
+func renderImage(name string, w, h int, format string) ([]byte, time.Time, error) {
+	f, fi, err := openStatic(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, time.Time{}, withCode(codeBadRequest, http.StatusUnsupportedMediaType, errImageType)
+	}
+	dst := image.NewNRGBA(fitImage(src.Bounds(), w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	var buf bytes.Buffer
+	if format == imageWebP {
+		err = nativewebp.Encode(&buf, dst, nil)
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, time.Time{}, withCode(codeEncodeFailed, http.StatusInternalServerError, err)
+	}
+	return buf.Bytes(), fi.ModTime(), nil
+}
+
+// imageCache holds rendered images until the source file changes.
+type imageCache struct {
+	lock    sync.Mutex
+	entries map[string]imageEntry
+}
+
+type imageEntry struct {
+	data    []byte
+	modTime time.Time
+}
+
+var renderedImages = &imageCache{entries: make(map[string]imageEntry)}
+
+// get returns a rendered image if its source has not changed since.
+func (c *imageCache) get(key, name string) ([]byte, time.Time, bool) {
+	c.lock.Lock()
+	e, ok := c.entries[key]
+	c.lock.Unlock()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	f, fi, err := openStatic(name)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	f.Close()
+	if !fi.ModTime().Equal(e.modTime) {
+		return nil, time.Time{}, false
+	}
+	return e.data, e.modTime, true
+}
+
+// put stores a rendered image, evicting another when the cache is full.
+func (c *imageCache) put(key string, data []byte, modTime time.Time) {
+	if *imageCacheSize <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= *imageCacheSize {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = imageEntry{data: data, modTime: modTime}
+}
+
+// imagesAPI serves a PNG or JPEG from the static folder resized to the w
+// and h query parameters, as WebP for browsers that accept it. Rendering is
+// CPU-bound, so with image_cache set to 0 it gives autoscaling something to
+// react to.
+func imagesAPI(resp http.ResponseWriter, req *http.Request) {
+	tier := tierUI
+	name := req.PathValue("name")
+	if !validStaticPath(name) {
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusBadRequest, errStaticPath))
+		return
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".png", ".jpg", ".jpeg":
+	default:
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusUnsupportedMediaType, errImageType))
+		return
+	}
+	w, h, err := imageSize(req)
+	if err != nil {
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	format := imageFormat(req)
+	key := fmt.Sprintf("%s|%d|%d|%s", name, w, h, format)
+
+	cache := "HIT"
+	data, modTime, ok := renderedImages.get(key, name)
+	if !ok {
+		cache = "MISS"
+		start := time.Now()
+		data, modTime, err = renderImage(name, w, h, format)
+		if err != nil {
+			if errors.Is(err, errStaticNotFound) || errors.Is(err, errStaticPath) {
+				err = withCode(codeNotFound, http.StatusNotFound, errStaticNotFound)
+			}
+			requestLogger(req).Warn("Cannot render image", "name", name, "err", err)
+			writeError(resp, tier, err)
+			return
+		}
+		imageRenderDuration.WithLabelValues(format).Observe(time.Since(start).Seconds())
+		renderedImages.put(key, data, modTime)
+	}
+	imageRequestsTotal.WithLabelValues(format, strings.ToLower(cache)).Inc()
+
+	resp.Header().Set("Content-Type", imageTypes[format])
+	resp.Header().Add("Vary", "Accept")
+	resp.Header().Set("Cache-Control", "public, max-age=3600")
+	resp.Header().Set(cacheHeader, cache)
+	http.ServeContent(resp, req, "", modTime, bytes.NewReader(data))
+}
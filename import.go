@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// importMaxBytes limits the body of POST /admin/import.
+const importMaxBytes = 64 << 20
+
+// importSummary counts what an import added.
+type importSummary struct {
+	Favorites int `json:"favorites"`
+	History   int `json:"history"`
+	Tallies   int `json:"tallies"`
+}
+
+// voteImport is a parsed import, ready to apply.
+type voteImport struct {
+	tenant    string
+	favorites map[string]string         // by store key
+	history   map[string][]historyEntry // by store key, oldest first
+	tallies   []exportRecord
+}
+
+// parseImport reads records in the form /api/v1/export writes as JSON,
+// checking them all before anything is applied.
+func parseImport(r io.Reader, tenant string) (*voteImport, error) {
+	var records []exportRecord
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, err
+	}
+	imp := &voteImport{tenant: tenant, favorites: make(map[string]string), history: make(map[string][]historyEntry)}
+	for i, rec := range records {
+		if err := checkImportRecord(&rec, tenant); err != nil {
+			return nil, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		key := (&requestContext{Tenant: tenant, User: rec.User}).storeKey()
+		switch rec.Type {
+		case exportTally:
+			imp.tallies = append(imp.tallies, rec)
+		case exportFavorite:
+			imp.favorites[key] = rec.Dog
+		case exportHistory:
+			e := historyEntry{Time: *rec.Time, Kind: rec.Kind, Dog: rec.Dog, ErrorCode: rec.ErrorCode}
+			e.BackendVersion, _ = strconv.Atoi(strings.TrimPrefix(rec.Version, "v"))
+			imp.history[key] = append(imp.history[key], e)
+		}
+	}
+	for _, h := range imp.history {
+		sort.SliceStable(h, func(i, j int) bool { return h[i].Time.Before(h[j].Time) })
+	}
+	return imp, nil
+}
+
+// checkImportRecord verifies one imported record.
+func checkImportRecord(r *exportRecord, tenant string) error {
+	if r.Dog != "" && !isDog(tenant, r.Dog) {
+		return fmt.Errorf("unknown dog %q", r.Dog)
+	}
+	if r.Version != "" {
+		if n, err := strconv.Atoi(strings.TrimPrefix(r.Version, "v")); err != nil || n < 1 || !strings.HasPrefix(r.Version, "v") {
+			return fmt.Errorf("version %q is not like v1", r.Version)
+		}
+	}
+	switch r.Type {
+	case exportTally:
+		switch {
+		case r.Tally != "votes" && r.Tally != "results":
+			return fmt.Errorf("tally %q is not votes or results", r.Tally)
+		case r.Dog == "" || r.Count < 1:
+			return errors.New("a tally needs a dog and a positive count")
+		case r.Tally == "results" && r.Version == "":
+			return errors.New("a results tally needs a version")
+		}
+	case exportFavorite:
+		if r.User == "" || r.Dog == "" {
+			return errors.New("a favorite needs a user and a dog")
+		}
+	case exportHistory:
+		switch {
+		case r.User == "" || r.Time == nil:
+			return errors.New("a history entry needs a user and a time")
+		case r.Kind != historyResult && r.Kind != historyVote:
+			return fmt.Errorf("kind %q is not %s or %s", r.Kind, historyResult, historyVote)
+		case r.Dog == "" && r.ErrorCode == "":
+			return errors.New("a history entry needs a dog or an error code")
+		}
+	default:
+		return fmt.Errorf("type %q is not %s, %s, or %s", r.Type, exportTally, exportFavorite, exportHistory)
+	}
+	return nil
+}
+
+// apply adds the favorites and history to the store, and the tallies to
+// this process's tallies when withTallies is set.
+func (imp *voteImport) apply(s store, withTallies bool) (importSummary, error) {
+	sum := importSummary{Favorites: len(imp.favorites)}
+	for _, h := range imp.history {
+		sum.History += len(h)
+	}
+	if err := s.Merge(imp.favorites, imp.history); err != nil {
+		return importSummary{}, err
+	}
+	if !withTallies {
+		return sum, nil
+	}
+	for _, t := range imp.tallies {
+		if t.Tally == "votes" {
+			votesVar.Add(tallyKey(imp.tenant, t.Dog), t.Count)
+		} else {
+			addResults(imp.tenant, t.Version, t.Dog, t.Count)
+		}
+	}
+	sum.Tallies = len(imp.tallies)
+	return sum, nil
+}
+
+// runImport implements "topdog import -file votes.json", which seeds the
+// file store before an instance starts. The memory store wouldn't outlive
+// the command, and tallies only live in a running process, so those need
+// POST /admin/import instead.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := fs.String("file", "", "JSON records as /api/v1/export writes them (- for standard input)")
+	tenant := fs.String("tenant", "", "Tenant the records belong to, when multi-tenancy is on")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "import: -file is required")
+		return 2
+	}
+	if *storeKind != "file" {
+		fmt.Fprintln(os.Stderr, "import: the memory store wouldn't outlive this command; use -store file, or POST /admin/import to a running instance")
+		return 1
+	}
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "import:", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	imp, err := parseImport(r, *tenant)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	s, err := getStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	sum, err := imp.apply(s, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	fmt.Printf("Imported %d favorites and %d history entries into %s\n", sum.Favorites, sum.History, *storeFile)
+	if len(imp.tallies) > 0 {
+		fmt.Printf("Skipped %d tallies, which only a running instance keeps; use POST /admin/import\n", len(imp.tallies))
+	}
+	return 0
+}
+
+// adminImport seeds the store and the tallies from records in the form
+// /api/v1/export writes as JSON, so a demo can start from an interesting
+// state. Nothing is applied unless every record is valid.
+func adminImport(resp http.ResponseWriter, req *http.Request) {
+	tier := tierForPath(req.URL.Path)
+	imp, err := parseImport(http.MaxBytesReader(resp, req.Body, importMaxBytes), getRequestContext(req).Tenant)
+	if err != nil {
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	s, err := getStore()
+	if err != nil {
+		writeError(resp, tier, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	sum, err := imp.apply(s, true)
+	if err != nil {
+		writeError(resp, tier, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	requestLogger(req).Info("Vote data imported", "favorites", sum.Favorites, "history", sum.History, "tallies", sum.Tallies)
+	auditRequest(req, "import", sum)
+	b, err := json.Marshal(&sum)
+	if err != nil {
+		writeError(resp, tier, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+var (
+	proxyProtocol = flag.Bool("proxy_protocol", false, "Accept PROXY protocol v1/v2 headers from trusted proxies on the service port")
+	listenAddress = flag.String("listen_address", "", "Comma-separated addresses to bind the service port to: an IP address, ipv4 (all IPv4), ipv6 (all IPv6 only), or empty for dual-stack on all interfaces")
+)
+
+// listenSpec is a network and address to pass to net.Listen.
+type listenSpec struct {
+	network string
+	address string
+}
+
+// parseListenAddresses turns the listen_address setting into listen specs.
+func parseListenAddresses(s string, port int) ([]listenSpec, error) {
+	var specs []listenSpec
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		switch strings.ToLower(a) {
+		case "", "dual":
+			specs = append(specs, listenSpec{"tcp", fmt.Sprintf(":%d", port)})
+		case "ipv4":
+			specs = append(specs, listenSpec{"tcp4", fmt.Sprintf("0.0.0.0:%d", port)})
+		case "ipv6":
+			specs = append(specs, listenSpec{"tcp6", fmt.Sprintf("[::]:%d", port)})
+		default:
+			ip := net.ParseIP(strings.Trim(a, "[]"))
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address, ipv4, ipv6, or dual", a)
+			}
+			network := "tcp6"
+			if ip.To4() != nil {
+				network = "tcp4"
+			}
+			specs = append(specs, listenSpec{network, net.JoinHostPort(ip.String(), strconv.Itoa(port))})
+		}
+	}
+	return specs, nil
+}
+
+// listenAll opens a listener for each configured address.
+func listenAll() ([]net.Listener, error) {
+	specs, err := parseListenAddresses(*listenAddress, *port)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	for _, spec := range specs {
+		ln, err := listen(spec)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// listen opens the service port, optionally decoding PROXY protocol headers so
+// the original client address survives a TCP load balancer.
+func listen(spec listenSpec) (net.Listener, error) {
+	ln, err := net.Listen(spec.network, spec.address)
+	if err != nil {
+		return nil, err
+	}
+	if !*proxyProtocol {
+		return ln, nil
+	}
+	return &proxyproto.Listener{
+		Listener: ln,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			// only trusted proxies may tell us who the client is
+			if tcp, ok := upstream.(*net.TCPAddr); ok && isTrustedProxy(tcp.IP) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.REJECT, nil
+		},
+	}, nil
+}
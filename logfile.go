@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	logFile        = flag.String("logfile", "", "File to write logs to instead of standard error, for VMs where nothing collects standard error")
+	logMaxSize     = flag.Int("log_max_size", 100, "Rotate logfile when it would grow past this many megabytes (0 never rotates by size)")
+	logRotateEvery = flag.Duration("log_rotate_every", 0, "Also rotate logfile after it has been open this long, such as 24h (0 never rotates by time)")
+	logMaxFiles    = flag.Int("log_max_files", 7, "Rotated log files to keep (0 keeps them all)")
+	logMaxAge      = flag.Duration("log_max_age", 0, "Delete rotated log files older than this, such as 168h (0 keeps them)")
+)
+
+// rotatedSuffix is appended to a log file's name when it is rotated.
+const rotatedSuffix = "20060102-150405.000"
+
+// rotatingFile is a log file that is renamed and replaced when it gets too
+// big or too old, removing the oldest rotated files.
+type rotatingFile struct {
+	lock   sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// checkLogFile verifies the settings for logfile.
+func checkLogFile() error {
+	if *logMaxSize < 0 || *logRotateEvery < 0 || *logMaxFiles < 0 || *logMaxAge < 0 {
+		return errors.New("log_max_size, log_rotate_every, log_max_files, and log_max_age must not be negative")
+	}
+	if *logFile == "" {
+		return nil
+	}
+	fi, err := os.Stat(filepath.Dir(*logFile))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(*logFile))
+	}
+	return nil
+}
+
+// openLogFile opens logfile for appending.
+func openLogFile() (*rotatingFile, error) {
+	if err := checkLogFile(); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: *logFile}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size, r.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+// Write appends to the file, rotating it first if needed. If rotation fails
+// logging carries on in the current file rather than losing lines.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot rotate %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// due reports whether writing n more bytes calls for a new file.
+func (r *rotatingFile) due(n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if *logMaxSize > 0 && r.size+int64(n) > int64(*logMaxSize)<<20 {
+		return true
+	}
+	return *logRotateEvery > 0 && time.Since(r.opened) >= *logRotateEvery
+}
+
+// rotate renames the current file with the time, opens a new one, and
+// removes old rotated files.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, r.path+"."+time.Now().Format(rotatedSuffix)); err != nil {
+		r.open() // keep writing to the old file
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	go r.prune()
+	return nil
+}
+
+// prune removes rotated files beyond log_max_files or older than log_max_age.
+func (r *rotatingFile) prune() {
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	type rotated struct {
+		path string
+		at   time.Time
+	}
+	var files []rotated
+	for _, m := range matches {
+		at, err := time.ParseInLocation(rotatedSuffix, strings.TrimPrefix(m, r.path+"."), time.Local)
+		if err == nil {
+			files = append(files, rotated{m, at})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].at.After(files[j].at) })
+	for i, f := range files {
+		if (*logMaxFiles > 0 && i >= *logMaxFiles) || (*logMaxAge > 0 && time.Since(f.at) > *logMaxAge) {
+			os.Remove(f.path)
+		}
+	}
+}
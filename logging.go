@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+var (
+	logLevel  = flag.String("loglevel", "info", "Lowest level to log: debug, info, warn, or error")
+	logFormat = flag.String("log_format", "text", "Log output format: text or json")
+	logSample = flag.Int("log_sample", 1, "Log 1 in N successful requests; failed requests are always logged (1 logs every request)")
+)
+
+// sampledRequests counts successful requests for log sampling.
+var sampledRequests atomic.Uint64
+
+// sampleRequest reports whether to log a request with the given status, so
+// the load generator doesn't bury the failures under successes.
+func sampleRequest(status int) bool {
+	if status >= http.StatusBadRequest || *logSample <= 1 {
+		return true
+	}
+	return sampledRequests.Add(1)%uint64(*logSample) == 0
+}
+
+// setupLogging makes slog the default logger, including for the log package,
+// with the app and version on every line, also sending it to syslog and the
+// OTLP collector if asked.
+func setupLogging() error {
+	var w io.Writer = os.Stderr
+	if *logFile != "" {
+		f, err := openLogFile()
+		if err != nil {
+			return fmt.Errorf("logfile: %w", err)
+		}
+		w = f
+	}
+	h, err := newLogHandler(w)
+	if err != nil {
+		return err
+	}
+	if *syslogAddr != "" {
+		sw, err := newSyslogWriter()
+		if err != nil {
+			return fmt.Errorf("syslog_addr: %w", err)
+		}
+		sh, err := newLogHandler(sw)
+		if err != nil {
+			return err
+		}
+		h = teeHandler{h, &syslogHandler{Handler: sh, w: sw}}
+	}
+	if *otlpLogs {
+		oh, err := startOTLPLogs()
+		if err != nil {
+			return err
+		}
+		h = teeHandler{h, oh}
+	}
+	attrs := []any{"app", appName, "version", *version}
+	pod := podMetadata()
+	for _, k := range []string{"pod", "namespace", "node"} {
+		if v, ok := pod[k]; ok {
+			attrs = append(attrs, k, v)
+		}
+	}
+	slog.SetDefault(slog.New(h).With(attrs...))
+	return nil
+}
+
+// newLogHandler returns the handler chosen by the loglevel and log_format
+// flags, writing to w.
+func newLogHandler(w io.Writer) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return nil, fmt.Errorf("loglevel: %w", err)
+	}
+	if *logSample < 1 {
+		return nil, fmt.Errorf("log_sample: %d is less than 1", *logSample)
+	}
+	opts := &slog.HandlerOptions{
+		Level:     level,
+		AddSource: true,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// file:line is enough to find the call
+			if s, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+				a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(s.File), s.Line))
+			}
+			return a
+		},
+	}
+	switch *logFormat {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("log_format %q is not text or json", *logFormat)
+}
+
+// requestLogger returns the logger of the request being served, which adds
+// its tier, request ID, and trace ID so log lines can be matched with traces.
+func requestLogger(req *http.Request) *slog.Logger {
+	return getRequestContext(req).Logger()
+}
+
+// contextLogger returns the logger of the request a context belongs to, or
+// the default logger outside a request.
+func contextLogger(ctx context.Context) *slog.Logger {
+	if rc, ok := ctx.Value(requestContextKey{}).(*requestContext); ok {
+		return rc.Logger()
+	}
+	return slog.Default()
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
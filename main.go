@@ -7,19 +7,24 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"time"
 
-	"github.com/NYTimes/gziphandler"
 	"github.com/facebookgo/flagenv"
 )
 
+// serverWriteTimeout bounds how long a response may take to write, unless a
+// handler extends its own deadline.
+const serverWriteTimeout = 10 * time.Second
+
 var (
 	appName = "topdog"
 
@@ -38,43 +43,175 @@ var (
 	backendURL = flag.String("backend", "http://localhost:5000", "Location of backend API")
 	midtierURL = flag.String("midtier", "http://localhost:5000", "Location of midtier API")
 	version    = flag.Int("version", 1, "Version (1, 2, or 3)")
+
+	traceURL      = flag.String("trace_url", "", "Link to a trace in Jaeger or Zipkin, with {traceId} as a placeholder (e.g. http://localhost:16686/trace/{traceId})")
+	cacheControl  = flag.String("cache_control", "", "Cache-Control header for backend responses, such as max-age=5 (empty disables caching)")
+	validateOnly  = flag.Bool("validate", false, "Check the configuration, print a report, and exit")
+	defaultSchema = flag.Int("schema", schemaV1, "Default response schema version when the client does not negotiate one (1 or 2)")
 )
 
 func main() {
 	// parse flags & env vars
 	flag.Parse()
+	versionSource := versionFlagSource()
 	flagenv.Parse()
 
+	// seed the store instead of serving
+	if flag.Arg(0) == "import" {
+		os.Exit(runImport(flag.Args()[1:]))
+	}
+
+	// check configuration only
+	if *validateOnly {
+		if !validateConfig(os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// initialize logging
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	recordVersionChange(0, *version, versionSource)
 
 	// check static folder
 	fi, err := os.Stat(*staticPath)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot read static folder", "err", err)
 	} else if !fi.IsDir() {
-		log.Fatal(*staticPath, " is not a directory")
+		fatal("Static path is not a directory", "path", *staticPath)
+	}
+
+	// telemetry labels are known once flags are parsed
+	registerMetrics()
+	publishBuildInfo()
+	if err := startStatsd(); err != nil {
+		fatal("Cannot send StatsD metrics", "err", err)
+	}
+
+	// start exporting spans, if configured
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		fatal("Cannot start tracing", "err", err)
+	}
+
+	// open the store early so problems show up at startup
+	if _, err := getStore(); err != nil {
+		fatal("Cannot open store", "err", err)
+	}
+
+	// gate readiness on the downstream tier, if configured
+	startReadinessGate()
+	startDependencyChecks()
+	startHealthChecks()
+	startBackups()
+	startProfilePush()
+	startRemoteWrite()
+
+	// record admin actions
+	if err := openAuditLog(); err != nil {
+		fatal("Cannot open audit log", "file", *auditFile, "err", err)
+	}
+
+	// apply the settings file, if configured
+	if err := startSettingsFile(); err != nil {
+		fatal("Cannot apply settings file", "file", *settingsFile, "err", err)
 	}
 
 	// initialize routes - all tiers
-	http.Handle("/health", healthCheck)
+	routes, err := newRouter()
+	if err != nil {
+		fatal("Invalid middleware", "err", err)
+	}
+	routes.handle(routeInfo{Name: "health", Pattern: "/health", Summary: "Health checks"}, healthCheck)
+	routes.handle(routeInfo{Name: "metrics", Pattern: "/metrics", Summary: "Prometheus metrics"}, metricsHandler())
+	routes.handle(routeInfo{Name: "version", Pattern: "GET /version", Summary: "Build and version of the binary"}, http.HandlerFunc(versionInfo))
+	routes.handle(routeInfo{Name: "readyz", Pattern: "/readyz", Summary: "Readiness, including the downstream tier"}, http.HandlerFunc(readyz))
+	routes.handle(routeInfo{Name: "whoami", Group: groupDebug, Pattern: "/whoami", Summary: "What topdog sees of the caller"}, http.HandlerFunc(whoAmI))
+	routes.handle(routeInfo{Name: "authzCheck", Group: groupDebug, Pattern: "/authz-check", Summary: "Check the caller against the expected authorization policy"}, http.HandlerFunc(authzCheck))
+
+	// initialize routes - admin
+	routes.handle(routeInfo{Name: "adminPage", Group: groupAdmin, Pattern: "/admin", Summary: "Admin page"}, http.HandlerFunc(adminPage))
+	routes.handle(routeInfo{Name: "maintenance", Group: groupAdmin, Pattern: "/admin/maintenance", Methods: []string{"GET", "POST"}, Summary: "Maintenance mode"}, http.HandlerFunc(adminMaintenance))
+	routes.handle(routeInfo{Name: "settings", Group: groupAdmin, Pattern: "/admin/api/settings", Methods: []string{"GET", "PUT", "POST"}, Summary: "Runtime settings"}, http.HandlerFunc(adminAPI))
+	routes.handle(routeInfo{Name: "scenarioStart", Group: groupAdmin, Pattern: "POST /admin/scenario/start", Summary: "Start the scenario"}, http.HandlerFunc(scenarioStart))
+	routes.handle(routeInfo{Name: "scenarioStop", Group: groupAdmin, Pattern: "POST /admin/scenario/stop", Summary: "Stop the scenario"}, http.HandlerFunc(scenarioStop))
+	routes.handle(routeInfo{Name: "audit", Group: groupAdmin, Pattern: "GET /admin/audit", Summary: "Admin actions, oldest first"}, http.HandlerFunc(adminAudit))
+	routes.handle(routeInfo{Name: "configDiff", Group: groupAdmin, Pattern: "GET /admin/config/diff", Summary: "How the settings file differs from the applied settings"}, http.HandlerFunc(configDiff))
+	routes.handle(routeInfo{Name: "configReload", Group: groupAdmin, Pattern: "POST /admin/config/reload", Summary: "Apply the settings file"}, http.HandlerFunc(configReload))
+	routes.handle(routeInfo{Name: "import", Group: groupAdmin, Pattern: "POST /admin/import", Summary: "Seed the store and tallies from exported records"}, http.HandlerFunc(adminImport))
+	routes.handle(routeInfo{Name: "backup", Group: groupAdmin, Pattern: "POST /admin/backup", Summary: "Back up the store now"}, http.HandlerFunc(adminBackup))
+	routes.handle(routeInfo{Name: "backups", Group: groupAdmin, Pattern: "GET /admin/backups", Summary: "List the backups in the backup directory"}, http.HandlerFunc(adminBackups))
+	routes.handle(routeInfo{Name: "restore", Group: groupAdmin, Pattern: "POST /admin/restore", Summary: "Replace the store's data with a backup"}, http.HandlerFunc(adminRestore))
+	routes.handle(routeInfo{Name: "scenarioStatus", Group: groupAdmin, Pattern: "GET /admin/scenario/status", Summary: "Scenario progress"}, http.HandlerFunc(scenarioStatusAPI))
+
+	// initialize routes - debugging
+	routes.handle(routeInfo{Name: "requests", Group: groupDebug, Pattern: "/debug/requests", Summary: "Recent requests"}, http.HandlerFunc(debugRequests))
+	routes.handle(routeInfo{Name: "echo", Group: groupDebug, Pattern: "/debug/echo", Summary: "Headers, peer, and TLS state of the request as received"}, http.HandlerFunc(debugEcho))
+	routes.handle(routeInfo{Name: "topology", Group: groupDebug, Pattern: "GET /debug/topology", Summary: "Configured tiers and the versions last seen downstream"}, http.HandlerFunc(debugTopology))
+	routes.handle(routeInfo{Name: "slo", Group: groupDebug, Pattern: "GET /slo", Summary: "Rolling latency percentiles and error rates"}, http.HandlerFunc(sloAPI))
+	routes.handle(routeInfo{Name: "versionEvents", Group: groupDebug, Pattern: "GET /events", Summary: "Changes to the version in effect, for lining up traffic shifts with metrics"}, http.HandlerFunc(versionEvents))
+	routes.handle(routeInfo{Name: "events", Group: groupDebug, Pattern: "/debug/events", Summary: "Lifecycle events, for a timeline of an incident"}, http.HandlerFunc(debugEvents))
+	routes.handle(routeInfo{Name: "vars", Group: groupDebug, Pattern: "/debug/vars", Summary: "expvar counters"}, expvar.Handler())
+	routes.handle(routeInfo{Name: "tap", Group: groupDebug, Pattern: "/debug/tap", Summary: "Live request and response stream"}, http.HandlerFunc(debugTap))
 
 	// initialize routes - backend tier
-	http.Handle("/backend", gziphandler.GzipHandler(http.HandlerFunc(backEnd)))
+	routes.handle(routeInfo{Name: "backend", Group: groupService, Pattern: "/backend", Summary: "Vote for the top dog"}, http.HandlerFunc(backEnd))
 
 	// initialize routes - mid tier
-	http.Handle("/midtier", gziphandler.GzipHandler(http.HandlerFunc(midTier)))
+	routes.handle(routeInfo{Name: "midtier", Group: groupService, Pattern: "/midtier", Summary: "Ask the backend for the top dog"}, http.HandlerFunc(midTier))
+	routes.handle(routeInfo{Name: "dependency", Group: groupService, Pattern: "GET /dependency", Summary: "A fake dependency, such as a license server, for other instances to check"}, http.HandlerFunc(dependencyAPI))
+	routes.handle(routeInfo{Name: "external", Group: groupService, Pattern: "GET /external", Summary: "Fetch external_url, for egress demos"}, http.HandlerFunc(externalAPI))
 
 	// initialize routes - UI tier
-	http.Handle("/static/", gziphandler.GzipHandler(http.StripPrefix("/static/", http.FileServer(http.Dir(*staticPath)))))
-	http.Handle("/query", gziphandler.GzipHandler(http.HandlerFunc(jsonQuery)))
-	http.Handle("/", gziphandler.GzipHandler(http.HandlerFunc(ui)))
+	routes.handle(routeInfo{Name: "static", Group: groupStatic, Pattern: "/static/", Summary: "Static files"}, http.StripPrefix("/static/", http.HandlerFunc(staticFiles)))
+	routes.handle(routeInfo{Name: "images", Group: groupStatic, Pattern: "GET /images/{name}", Summary: "Static images resized to w and h, as WebP when accepted"}, http.HandlerFunc(imagesAPI))
+	routes.handle(routeInfo{Name: "query", Group: groupService, Pattern: "/query", Summary: "Ask the midtier for the top dog"}, http.HandlerFunc(jsonQuery))
+	routes.handle(routeInfo{Name: "favorite", Group: groupAPI, Pattern: "/api/v1/me/favorite", Methods: []string{"GET", "PUT", "POST", "DELETE"}, Summary: "The user's favorite dog"}, http.HandlerFunc(favoriteAPI))
+	routes.handle(routeInfo{Name: "history", Group: groupAPI, Pattern: "/api/v1/me/history", Summary: "The user's recent top dogs"}, http.HandlerFunc(historyAPI))
+	routes.handle(routeInfo{Name: "export", Group: groupAPI, Pattern: "GET /api/v1/export", Summary: "Tallies, favorites, and history as CSV or JSON"}, http.HandlerFunc(exportAPI))
+	routes.handle(routeInfo{Name: "strategyPreview", Group: groupAPI, Pattern: "GET /api/v1/strategy/preview", Summary: "Simulated vote distribution of a strategy and weights"}, http.HandlerFunc(strategyPreviewAPI))
+	routes.handle(routeInfo{Name: "apiIndex", Group: groupAPI, Pattern: "GET /api", Summary: "This list of routes"}, http.HandlerFunc(routes.apiIndex))
+	routes.handle(routeInfo{Name: "openapi", Group: groupAPI, Pattern: "GET /api/openapi.json", Summary: "OpenAPI description of the routes"}, http.HandlerFunc(routes.openAPI))
+	routes.handle(routeInfo{Name: "ui", Group: groupPage, Pattern: "/", Summary: "The UI page"}, http.HandlerFunc(ui))
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", *port),
-		Handler:      http.DefaultServeMux,
-		ReadTimeout:  10 * time.Second, // Time to read the request
-		WriteTimeout: 10 * time.Second, // Time to write the response
+		Handler:      withRequestContext(routeTenants(recordRequests(captureEnvoyHeaders(tapRequests(countClients(recoverPanics(checkMaintenance(routes.mux)))))))),
+		ReadTimeout:  10 * time.Second,   // Time to read the request
+		WriteTimeout: serverWriteTimeout, // Time to write the response
+	}
+
+	// terminate TLS when a certificate is configured
+	if err := configureTLS(server); err != nil {
+		fatal("Cannot load TLS certificate", "err", err)
+	}
+
+	// serve profiling on its own port
+	adminServer, err := startAdminServer()
+	if err != nil {
+		fatal("Cannot start profiling", "err", err)
+	}
+
+	// echo raw TCP on its own port
+	tcpListener, err := startTCPEcho()
+	if err != nil {
+		fatal("Cannot start TCP echo", "err", err)
+	}
+
+	// serve votes over gRPC on its own port
+	grpcServer, err := startGRPC(server.Handler)
+	if err != nil {
+		fatal("Cannot start gRPC", "err", err)
+	}
+
+	// send and receive UDP heartbeats
+	udpConn, err := startHeartbeats()
+	if err != nil {
+		fatal("Cannot start UDP heartbeats", "err", err)
 	}
 
 	// Handle graceful shutdown
@@ -85,7 +222,8 @@ func main() {
 		select {
 		case <-done:
 		case sig := <-stop:
-			log.Print("Received signal ", sig.String())
+			slog.Info("Received signal", "signal", sig.String())
+			recordEvent(eventShutdown, "Received %s, shutting down", sig)
 			d := time.Second * 5
 			if sig == os.Kill {
 				d = time.Second * 15
@@ -94,17 +232,72 @@ func main() {
 			defer cancel()
 			err := server.Shutdown(wait)
 			if err != nil {
-				log.Print(err)
+				slog.Error("Cannot shut down cleanly", "err", err)
+			}
+			if adminServer != nil {
+				adminServer.Close()
+			}
+			if tcpListener != nil {
+				tcpListener.Close()
+			}
+			if grpcServer != nil {
+				grpcServer.GracefulStop()
+			}
+			if udpConn != nil {
+				udpConn.Close()
 			}
 		}
 	}(context.Background())
 
-	log.Printf(appName+" starting on port %d", *port)
-
 	// listen for requests and serve responses.
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	listeners, err := listenAll()
+	if err != nil {
+		fatal("Cannot listen", "err", err)
 	}
+	startWarmup()
+	for _, ln := range listeners {
+		slog.Info(appName+" starting", "addr", ln.Addr().String(), "tls", server.TLSConfig != nil, "commit", binaryBuild().Commit)
+		recordEvent(eventStartup, "%s version %d listening on %s", appName, *version, ln.Addr())
+	}
+	serve := func(ln net.Listener) error {
+		if server.TLSConfig != nil {
+			return server.ServeTLS(ln, "", "")
+		}
+		return server.Serve(ln)
+	}
+	for _, ln := range listeners[1:] {
+		go func(ln net.Listener) {
+			if err := serve(ln); err != nil && err != http.ErrServerClosed {
+				fatal("Cannot serve", "err", err)
+			}
+		}(ln)
+	}
+	if err := serve(listeners[0]); err != nil && err != http.ErrServerClosed {
+		fatal("Cannot serve", "err", err)
+	}
+
+	// flush spans that are still queued
+	wait, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(wait); err != nil {
+		slog.Error("Cannot flush spans", "err", err)
+	}
+
+	// save the history and quota changes the file store is holding
+	saveStore()
+
+	// save what this instance has in case its node doesn't come back
+	if *backupTarget != "" {
+		if _, err := backupStore(wait); err != nil {
+			slog.Error("Cannot back up store", "backup", *backupTarget, "err", err)
+		}
+	}
+
+	// push the final counts, since nothing scrapes this instance
+	flushRemoteWrite(wait)
+
+	slog.Info(appName + " shutting down")
 
-	log.Print(appName + " shutting down")
+	// send the last log lines, including that one
+	shutdownOTLPLogs(wait)
 }
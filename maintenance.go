@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maintenanceRetryAfter = flag.Duration("maintenance_retry_after", 5*time.Minute, "Retry-After sent with 503 responses in maintenance mode")
+	maintenanceFailHealth = flag.Bool("maintenance_fail_health", false, "Fail /health and /readyz in maintenance mode too, so the pod leaves load balancing instead of only failing requests")
+)
+
+var errMaintenance = errors.New("down for maintenance")
+
+// maintenance turns away everything but the admin routes with a 503.
+var maintenance atomic.Bool
+
+// setMaintenance turns maintenance mode on or off.
+func setMaintenance(ctx context.Context, on bool) {
+	if maintenance.Swap(on) == on {
+		return
+	}
+	contextLogger(ctx).Warn("Maintenance mode changed", "on", on)
+	if on {
+		recordEvent(eventMaintenance, "Maintenance mode started")
+	} else {
+		recordEvent(eventMaintenance, "Maintenance mode ended")
+	}
+}
+
+// maintenanceExempt reports whether a path is served during maintenance. The
+// static files are needed by the maintenance page itself.
+func maintenanceExempt(path string) bool {
+	switch {
+	case path == "/admin" || strings.HasPrefix(path, "/admin/"):
+		return true
+	case strings.HasPrefix(path, "/static/"):
+		return true
+	case path == "/metrics":
+		return true
+	case path == "/health" || path == "/readyz":
+		return !*maintenanceFailHealth
+	}
+	return false
+}
+
+// checkMaintenance answers requests with 503 and Retry-After while in
+// maintenance mode, as a styled page for browsers, so a gateway can be shown
+// failing over to another deployment.
+func checkMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !maintenance.Load() || maintenanceExempt(req.URL.Path) {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		tier := tierForPath(req.URL.Path)
+		if acceptsHTML(req) {
+			if t, err := loadTemplates(); err == nil && t.Lookup("maintenance.html") != nil {
+				var buf bytes.Buffer
+				if err = t.ExecuteTemplate(&buf, "maintenance.html", &errorPageData{Tier: tier, Version: *version, RetryURL: req.URL.RequestURI()}); err == nil {
+					resp.Header().Set("Content-type", "text/html; charset=utf-8")
+					resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(maintenanceRetryAfter.Seconds()))))
+					resp.Header().Set(errorCodeHeader, codeMaintenance)
+					resp.WriteHeader(http.StatusServiceUnavailable)
+					resp.Write(buf.Bytes())
+					return
+				}
+				requestLogger(req).Error("Cannot render maintenance page", "err", err)
+			}
+		}
+		writeError(resp, tier, &codedError{
+			code:       codeMaintenance,
+			status:     http.StatusServiceUnavailable,
+			err:        errMaintenance,
+			retryAfter: *maintenanceRetryAfter,
+		})
+	})
+}
+
+// adminMaintenance shows whether maintenance mode is on, and turns it on or
+// off on POST with ?on=true or ?on=false.
+func adminMaintenance(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		on, err := strconv.ParseBool(req.URL.Query().Get("on"))
+		if err != nil {
+			writeError(resp, tierForPath(req.URL.Path), withCode(codeBadRequest, http.StatusBadRequest, errors.New("on must be true or false")))
+			return
+		}
+		setMaintenance(req.Context(), on)
+		auditRequest(req, "maintenance", on)
+	}
+	b, err := json.Marshal(map[string]bool{"maintenance": maintenance.Load()})
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
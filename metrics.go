@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	appLabel     = flag.String("app", appName, "Value of the app label on telemetry; match the Kubernetes app label")
+	versionLabel = flag.String("version_label", "", "Value of the version label on telemetry; match the Kubernetes version label (defaults to v<version>)")
+	extraLabels  = flag.String("telemetry_labels", "", "Additional labels for all telemetry, such as team=demo,cluster=east")
+	podLabels    = flag.Bool("pod_labels", true, "Label telemetry with the pod, namespace, and node from the POD_NAME, POD_NAMESPACE, and NODE_NAME environment variables, when set")
+
+	metricsRoutes     = flag.String("metrics_routes", "", "Routes, such as /query,/images/{name}, that get their own route label on request metrics; others are labeled other (empty labels every route)")
+	metricsRouteLimit = flag.Int("metrics_route_limit", 50, "Most route label values on request metrics; routes registered after that are labeled other (0 for no limit)")
+)
+
+// pendingRegisterer holds metrics defined at startup until flags are parsed
+// and the workload labels are known.
+type pendingRegisterer struct {
+	collectors []prometheus.Collector
+}
+
+func (p *pendingRegisterer) Register(c prometheus.Collector) error {
+	p.collectors = append(p.collectors, c)
+	return nil
+}
+
+func (p *pendingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	p.collectors = append(p.collectors, cs...)
+}
+
+func (p *pendingRegisterer) Unregister(prometheus.Collector) bool {
+	return false
+}
+
+var (
+	pendingMetrics  = &pendingRegisterer{}
+	newMetric       = promauto.With(pendingMetrics)
+	metricsRegistry = prometheus.NewRegistry()
+)
+
+// parseLabels reads a comma-separated list of name=value pairs.
+func parseLabels(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%q is not name=value", item)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
+
+// podMetadata returns the pod, namespace, and node labels from the
+// environment variables the Kubernetes downward API sets, so replicas can be
+// told apart. Variables that aren't set are left out.
+func podMetadata() map[string]string {
+	m := make(map[string]string)
+	if !*podLabels {
+		return m
+	}
+	for label, env := range map[string]string{"pod": "POD_NAME", "namespace": "POD_NAMESPACE", "node": "NODE_NAME"} {
+		if v := strings.TrimSpace(os.Getenv(env)); v != "" {
+			m[label] = v
+		}
+	}
+	return m
+}
+
+// workloadLabels returns the labels attached to all telemetry, matching the
+// app and version labels Kiali uses for the workload, and the pod metadata
+// unless telemetry_labels sets the same label.
+func workloadLabels() map[string]string {
+	m, _ := parseLabels(*extraLabels)
+	if m == nil {
+		m = make(map[string]string)
+	}
+	for k, v := range podMetadata() {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	m["app"] = *appLabel
+	m["version"] = *versionLabel
+	if m["version"] == "" {
+		m["version"] = fmt.Sprintf("v%d", *version)
+	}
+	return m
+}
+
+// registerMetrics registers the application metrics with the workload labels
+// attached. Runtime metrics are left alone since go_info has its own version label.
+func registerMetrics() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	reg := prometheus.WrapRegistererWith(workloadLabels(), metricsRegistry)
+	reg.MustRegister(pendingMetrics.collectors...)
+}
+
+// metricsHandler serves the registered metrics.
+func metricsHandler() http.Handler {
+	// exemplars are only sent to scrapers that ask for OpenMetrics
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+var (
+	httpRequestsTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+		Name: "topdog_http_requests_total",
+		Help: "HTTP requests served, by tier, route, method, and status code.",
+	}, []string{"tier", "route", "method", "code"})
+	httpRequestDuration = newMetric.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "topdog_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by tier and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tier", "route"})
+)
+
+// otherRoute is the route label of routes that don't get their own.
+const otherRoute = "other"
+
+// checkMetricsRoutes verifies the route label settings.
+func checkMetricsRoutes() error {
+	for _, r := range strings.Split(*metricsRoutes, ",") {
+		r = strings.TrimSpace(r)
+		if r != "" && !strings.HasPrefix(r, "/") {
+			return fmt.Errorf("metrics_routes: %q is not a path", r)
+		}
+	}
+	if *metricsRouteLimit < 0 {
+		return fmt.Errorf("metrics_route_limit %d is negative", *metricsRouteLimit)
+	}
+	return nil
+}
+
+// routeLabels hands out the route label of each instrumented route.
+var routeLabels = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// routeLabel returns the label for a route on request metrics. The route is
+// the ServeMux path, so a request for /images/mike.png?w=64 is already
+// counted as /images/{name}; remainder wildcards like {file...} are written
+// as {file}.
+// Routes left out of metrics_routes, or beyond metrics_route_limit, share
+// the label other, keeping the number of series bounded as routes are added.
+func routeLabel(route string) string {
+	label := pathParam.ReplaceAllString(route, "{$1}")
+	if *metricsRoutes != "" {
+		listed := false
+		for _, r := range strings.Split(*metricsRoutes, ",") {
+			r = strings.TrimSpace(r)
+			if r == route || r == label {
+				listed = true
+			}
+		}
+		if !listed {
+			return otherRoute
+		}
+	}
+	routeLabels.Lock()
+	defer routeLabels.Unlock()
+	if !routeLabels.seen[label] {
+		if *metricsRouteLimit > 0 && len(routeLabels.seen) >= *metricsRouteLimit {
+			slog.Warn("Route labeled other on metrics", "route", route, "metrics_route_limit", *metricsRouteLimit)
+			return otherRoute
+		}
+		routeLabels.seen[label] = true
+	}
+	return label
+}
+
+// methodLabel limits the method label to standard methods.
+func methodLabel(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodPatch:
+		return m
+	}
+	return "OTHER"
+}
+
+// instrumentRoute counts, times, and traces requests to a route. The route,
+// not the request path, is used as a label to keep cardinality bounded.
+func instrumentRoute(route string, next http.Handler) http.Handler {
+	tier := tierForPath(route)
+	label := routeLabel(route)
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		req, span := startServerSpan(route, tier, req)
+		rec := &statusRecorder{ResponseWriter: resp}
+		next.ServeHTTP(rec, req)
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		endServerSpan(span, status)
+		d := time.Since(start)
+		httpRequestsTotal.WithLabelValues(tier, label, methodLabel(req.Method), strconv.Itoa(status)).Inc()
+		requestsVar.Add(label, 1)
+		observeSLO(route, status, d)
+		observeWithTrace(req.Context(), httpRequestDuration.WithLabelValues(tier, label), d.Seconds())
+		statsd.count("http.requests", "tier", tier, "route", label, "method", methodLabel(req.Method), "code", strconv.Itoa(status))
+		statsd.timing("http.request_duration", d, "tier", tier, "route", label)
+	})
+}
+
+var votesTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_votes_total",
+	Help: "Votes cast by the backend, by winning dog and the version whose voting strategy was used.",
+}, []string{"dog", "tier", "strategy", "tenant"})
+
+// countVote records a successful backend vote. The version comes from the
+// workload labels; strategy differs from it only when changed on the admin
+// page. The tenant is empty without multi-tenancy.
+func countVote(dog, tenant string) {
+	strategy := fmt.Sprintf("v%d", strategyVersion())
+	votesTotal.WithLabelValues(dog, tierBackend, strategy, tenant).Inc()
+	votesVar.Add(tallyKey(tenant, dog), 1)
+	if tenant == "" {
+		statsd.count("votes", "dog", dog, "tier", tierBackend, "strategy", strategy)
+	} else {
+		statsd.count("votes", "dog", dog, "tier", tierBackend, "strategy", strategy, "tenant", tenant)
+	}
+}
+
+var voteFailuresTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_vote_failures_total",
+	Help: "Votes the backend failed to cast, by the version whose voting strategy was used.",
+}, []string{"tier", "strategy"})
+
+// countVoteFailure records a failed backend vote, such as the v2 strategy's
+// "Oops", for error budget burn-rate alerts alongside topdog_votes_total.
+func countVoteFailure() {
+	strategy := fmt.Sprintf("v%d", strategyVersion())
+	voteFailuresTotal.WithLabelValues(tierBackend, strategy).Inc()
+	statsd.count("vote_failures", "tier", tierBackend, "strategy", strategy)
+}
+
+var panicsTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_panics_total",
+	Help: "Panics recovered while serving requests.",
+}, []string{"tier"})
+
+var downstreamRequestsTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_downstream_requests_total",
+	Help: "Calls to downstream tiers, by outcome class and error code.",
+}, []string{"tier", "target", "class", "code"})
+
+var downstreamFailuresTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_downstream_failures_total",
+	Help: "Failed calls to downstream tiers, by error code.",
+}, []string{"tier", "target", "code"})
+
+var downstreamDuration = newMetric.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "topdog_downstream_request_duration_seconds",
+	Help:    "Time taken by calls to downstream tiers, including Retry-After waits, by outcome class.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"tier", "target", "class"})
+
+// Outcome classes for downstream calls, comparable to Envoy's response flags.
+const (
+	classOK                = "ok"
+	classTimeout           = "timeout"
+	classConnectionRefused = "connection_refused"
+	classConnectionError   = "connection_error"
+	classThrottled         = "throttled"
+	classJSONParse         = "json_parse"
+	classChecksum          = "checksum"
+	class4xx               = "4xx"
+	class5xx               = "5xx"
+)
+
+// downstreamClass assigns an outcome class to a downstream call. A status of
+// zero means no complete response was received.
+func downstreamClass(status int, err error) string {
+	if err == nil {
+		return classOK
+	}
+	code, _ := errorCode(err)
+	switch {
+	case code == codeDownstreamThrottled:
+		return classThrottled
+	case code == codeDownstreamBadResponse:
+		return classJSONParse
+	case code == codeChecksumMismatch && status >= 200 && status <= 299:
+		return classChecksum
+	case status == 0 && code == codeDownstreamTimeout:
+		return classTimeout
+	case status == 0 && errors.Is(err, syscall.ECONNREFUSED):
+		return classConnectionRefused
+	case status == 0:
+		return classConnectionError
+	case status >= 400 && status <= 499:
+		return class4xx
+	}
+	return class5xx
+}
+
+// observeWithTrace adds a sample to a histogram, with the trace ID as an
+// exemplar when spans are exported and the request is sampled, so Grafana
+// can jump from a latency spike to a trace of it.
+func observeWithTrace(ctx context.Context, o prometheus.Observer, v float64) {
+	if sc := trace.SpanContextFromContext(ctx); tracingEnabled && sc.IsSampled() {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": sc.TraceID().String()})
+			return
+		}
+	}
+	o.Observe(v)
+}
+
+// countDownstream records the outcome and duration of a call from tier to
+// target. ctx carries the call's span.
+func countDownstream(ctx context.Context, tier, target string, status int, err error, d time.Duration) {
+	code := ""
+	if err != nil {
+		code, _ = errorCode(err)
+	}
+	class := downstreamClass(status, err)
+	downstreamRequestsTotal.WithLabelValues(tier, target, class, code).Inc()
+	observeWithTrace(ctx, downstreamDuration.WithLabelValues(tier, target, class), d.Seconds())
+	statsd.count("downstream.requests", "tier", tier, "target", target, "class", class, "code", code)
+	statsd.timing("downstream.request_duration", d, "tier", tier, "target", target, "class", class)
+	if err != nil {
+		downstreamFailuresTotal.WithLabelValues(tier, target, code).Inc()
+		downstreamErrorsVar.Add(tier+"→"+target+" "+code, 1)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	middlewareChains = flag.String("middleware", defaultChains, "Middleware for each route group, outermost first, as group=name,... separated by semicolons")
+	rateLimit        = flag.Float64("rate_limit", 10, "Requests per second allowed on each route by the ratelimit middleware")
+)
+
+// defaultChains is the middleware used when the middleware flag isn't set.
+const defaultChains = "service=metrics,quota,timeout,faults,gzip;page=metrics,quota,timeout,gzip;api=metrics,quota,gzip;admin=auth,gzip;debug=gzip;static=gzip"
+
+// Route groups, each sharing a middleware chain.
+const (
+	groupService = "service" // /query, /midtier, and /backend
+	groupPage    = "page"    // the UI page
+	groupAPI     = "api"     // user APIs
+	groupAdmin   = "admin"   // admin page and APIs
+	groupDebug   = "debug"   // debugging pages
+	groupStatic  = "static"  // static files
+)
+
+var routeGroups = []string{groupService, groupPage, groupAPI, groupAdmin, groupDebug, groupStatic}
+
+// middleware wraps the handler for a route.
+type middleware func(route string, next http.Handler) http.Handler
+
+// middlewares are the named middleware that can appear in a chain.
+var middlewares = map[string]middleware{
+	"auth":      func(route string, next http.Handler) http.Handler { return requireAdmin(next) },
+	"faults":    injectFaults,
+	"gzip":      compressRoute,
+	"log":       logRequests,
+	"metrics":   instrumentRoute,
+	"quota":     enforceQuota,
+	"ratelimit": limitRate,
+	"recover":   func(route string, next http.Handler) http.Handler { return recoverPanics(next) },
+	"timeout":   withTimeout,
+}
+
+// parseChains reads the middleware setting. Groups that aren't listed get no middleware.
+func parseChains(s string) (map[string][]string, error) {
+	known := make(map[string]bool)
+	for _, g := range routeGroups {
+		known[g] = true
+	}
+	chains := make(map[string][]string)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		group, list, ok := strings.Cut(entry, "=")
+		group = strings.TrimSpace(group)
+		if !ok {
+			return nil, fmt.Errorf("%q is not group=name,...", entry)
+		}
+		if !known[group] {
+			return nil, fmt.Errorf("unknown route group %q", group)
+		}
+		var names []string
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if _, ok := middlewares[name]; !ok {
+				return nil, fmt.Errorf("%s: unknown middleware %q", group, name)
+			}
+			names = append(names, name)
+		}
+		chains[group] = names
+	}
+	if !contains(chains[groupAdmin], "auth") {
+		return nil, errors.New("the admin group must include auth")
+	}
+	return chains, nil
+}
+
+// contains reports whether list includes s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// router registers routes with the middleware for their group.
+type router struct {
+	mux    *http.ServeMux
+	chains map[string][]string
+	routes []*routeInfo
+}
+
+// newRouter returns a router using the configured middleware chains.
+func newRouter() (*router, error) {
+	chains, err := parseChains(*middlewareChains)
+	if err != nil {
+		return nil, err
+	}
+	return &router{mux: http.NewServeMux(), chains: chains}, nil
+}
+
+// handle registers a route with the middleware for its group. Patterns are
+// those of http.ServeMux, such as "GET /status/{code}"; the path, without the
+// method, names the route for middleware and metrics.
+func (r *router) handle(ri routeInfo, h http.Handler) {
+	chain := r.chains[ri.Group]
+	ri.register(chain)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = middlewares[chain[i]](ri.Path, h)
+	}
+	r.mux.Handle(ri.Pattern, h)
+	r.routes = append(r.routes, &ri)
+}
+
+// logRequests logs each request to a route once it is served.
+func logRequests(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: resp}
+		next.ServeHTTP(rec, req)
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if !sampleRequest(status) {
+			return
+		}
+		logger := requestLogger(req)
+		if status < http.StatusBadRequest && *logSample > 1 {
+			logger = logger.With("sampled", *logSample) // this line stands for N requests
+		}
+		logger.Info("Request", "method", req.Method, "route", route, "path", req.URL.Path, "status", status, "duration", time.Since(start).String(), "client", clientIP(req))
+	})
+}
+
+// tokenBucket allows rate requests per second, with bursts of up to the
+// same number.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// take uses a token if one is available, or returns how long until one will be.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	burst := math.Max(b.rate, 1)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// limitRate rejects requests to a route beyond rate_limit per second with a
+// 429 and Retry-After, which upstream tiers honor.
+func limitRate(route string, next http.Handler) http.Handler {
+	if *rateLimit <= 0 {
+		return next
+	}
+	b := &tokenBucket{rate: *rateLimit, tokens: math.Max(*rateLimit, 1), last: time.Now()}
+	tier := tierForPath(route)
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ok, wait := b.take()
+		if !ok {
+			writeError(resp, tier, &codedError{
+				code:       codeRateLimited,
+				status:     http.StatusTooManyRequests,
+				err:        fmt.Errorf("more than %g requests per second to %s", *rateLimit, route),
+				retryAfter: wait,
+			})
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
@@ -1,26 +1,167 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	midtierBehavior      = flag.String("midtier_behavior", "2:latency=200ms;3:cache=5s", "Per-version midtier behavior, as version:setting=value,... separated by semicolons (settings: latency, cache)")
+	backendOverrideHosts = flag.String("backend_override_hosts", "", "Hosts, or host:port pairs, that the x-topdog-backend header may send a request to, separated by commas (empty disables overrides)")
+)
+
+// backendOverrideHeader names a backend URL to use for just this request.
+const backendOverrideHeader = "x-topdog-backend"
+
+// behavior describes what a midtier version does beyond stamping its version.
+type behavior struct {
+	latency  time.Duration // added to every response
+	cacheTTL time.Duration // how long to reuse backend results
+}
+
+// parseBehaviors reads the midtier_behavior setting.
+func parseBehaviors(s string) (map[int]behavior, error) {
+	m := make(map[int]behavior)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		vs, settings, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not version:setting=value", entry)
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(vs))
+		if err != nil {
+			return nil, fmt.Errorf("%q: bad version: %w", entry, err)
+		}
+		var b behavior
+		for _, setting := range strings.Split(settings, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", setting, err)
+			}
+			switch name {
+			case "latency":
+				b.latency = d
+			case "cache":
+				b.cacheTTL = d
+			default:
+				return nil, fmt.Errorf("%q: unknown setting %q", entry, name)
+			}
+		}
+		m[v] = b
+	}
+	return m, nil
+}
+
+var (
+	behaviorOnce sync.Once
+	behaviors    map[int]behavior
+	midtierCache = &responseCache{entries: make(map[string]cacheEntry)}
+)
+
+// currentBehavior returns the configured behavior for this midtier version.
+func currentBehavior() behavior {
+	behaviorOnce.Do(func() {
+		var err error
+		behaviors, err = parseBehaviors(*midtierBehavior)
+		if err != nil {
+			slog.Error("Invalid midtier_behavior", "err", err)
+		}
+	})
+	return behaviors[*version]
+}
+
 func midTier(resp http.ResponseWriter, req *http.Request) {
-	result, err := queryDownstreamService(*backendURL+"/backend", req)
+	if headVote(resp, req) {
+		return
+	}
+	b := currentBehavior()
+	if b.latency > 0 {
+		select {
+		case <-time.After(b.latency):
+		case <-req.Context().Done():
+		}
+	}
+
+	result, err := queryBackend(req, b)
+	noteDownstream(req, describeResult(result, err))
 	if err != nil {
-		log.Print("Cannot query backend service: ", err)
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		requestLogger(req).Error("Cannot query backend service", "err", err)
+		writeError(resp, tierMidtier, err)
 		return
 	}
 	result.MidtierVersion = *version
-	b, err := json.Marshal(result)
+	result.RequestID = getRequestContext(req).RequestID
+	result.MidtierMillis = elapsedMillis(req)
+	schema := negotiateSchema(req)
+	data, err := marshalResponse(result, schema)
 	if err != nil {
-		log.Print("Cannot marshal JSON: ", err)
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		requestLogger(req).Error("Cannot marshal JSON", "err", err)
+		writeError(resp, tierMidtier, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
 		return
 	}
 
-	resp.Header().Set("Content-type", "application/json")
-	resp.Write(b)
+	setSchemaHeaders(resp, schema)
+	setRetryHeaders(resp, result)
+	setCacheHeaders(resp, result)
+	setServerTiming(resp, req, tierMidtier, result)
+	resp.Write(setChecksum(resp, data))
+}
+
+// backendFor returns the backend base URL for a request, honoring an
+// x-topdog-backend override when its host is allowed.
+func backendFor(req *http.Request) (string, error) {
+	v := req.Header.Get(backendOverrideHeader)
+	if v == "" {
+		return *backendURL, nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", withCode(codeBadRequest, http.StatusBadRequest, fmt.Errorf("%s %q is not an http or https URL", backendOverrideHeader, v))
+	}
+	for _, h := range strings.Split(*backendOverrideHosts, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && (h == u.Host || h == u.Hostname()) {
+			return strings.TrimSuffix(v, "/"), nil
+		}
+	}
+	return "", withCode(codeOverrideDenied, http.StatusForbidden, fmt.Errorf("%s is not in backend_override_hosts", u.Host))
+}
+
+// queryBackend calls the backend, reusing recent results when this version caches.
+func queryBackend(req *http.Request, b behavior) (*backEndResponse, error) {
+	base, err := backendFor(req)
+	if err != nil {
+		return nil, err
+	}
+	if base != *backendURL {
+		requestLogger(req).Info("Backend overridden", "backend", base)
+	}
+	url := base + "/backend"
+	if *backendGRPC != "" && base == *backendURL {
+		url = grpcVoteURL(*backendGRPC, grpcBackendService)
+	}
+	key := cacheKey(url, req)
+	if b.cacheTTL > 0 && !bypassCache(req) {
+		if result, ok := midtierCache.get(key); ok {
+			result.cacheHit = true
+			result.BackendMillis = 0 // the backend wasn't called
+			return result, nil
+		}
+	}
+	result, err := queryDownstreamService(tierMidtier, tierBackend, url, req)
+	if err == nil && b.cacheTTL > 0 {
+		midtierCache.putFor(key, result, b.cacheTTL)
+	}
+	return result, err
 }
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var otlpLogs = flag.Bool("otlp_logs", false, "Also send logs to the otlp_endpoint collector as OTLP, with trace IDs so a trace links to its log lines")
+
+// otlpLogBatch is the most records sent in one export.
+const otlpLogBatch = 512
+
+var otlpLogRecords = newMetric.NewCounterVec(prometheus.CounterOpts{Name: "topdog_otlp_log_records_total", Help: "Log records for the OTLP collector, by result: sent, dropped when the queue was full, or failed."}, []string{"result"})
+
+// checkOTLPLogs verifies that logs have a collector to go to.
+func checkOTLPLogs() error {
+	if !*otlpLogs {
+		return nil
+	}
+	if *otlpEndpoint == "" {
+		return fmt.Errorf("otlp_logs needs otlp_endpoint")
+	}
+	_, err := otlpLogsURL()
+	return err
+}
+
+// otlpLogsURL returns the collector's OTLP/HTTP logs URL. Only the scheme
+// and host of otlp_endpoint are used, since its path, if any, is for spans.
+func otlpLogsURL() (string, error) {
+	u, err := url.Parse(*otlpEndpoint)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http or https URL", *otlpEndpoint)
+	}
+	return u.Scheme + "://" + u.Host + "/v1/logs", nil
+}
+
+// otlpLogExporter queues log records and sends them to the collector in
+// batches. Records are dropped rather than blocking the caller when the
+// queue is full, and export failures are only counted, since logging them
+// would feed the queue.
+type otlpLogExporter struct {
+	url      string
+	resource *resourcepb.Resource
+	records  chan *logspb.LogRecord
+	flushReq chan chan struct{}
+}
+
+// logExporter is the exporter, or nil when otlp_logs is off.
+var logExporter *otlpLogExporter
+
+// startOTLPLogs starts the exporter and returns a handler that feeds it.
+func startOTLPLogs() (slog.Handler, error) {
+	u, err := otlpLogsURL()
+	if err != nil {
+		return nil, fmt.Errorf("otlp_endpoint: %w", err)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return nil, fmt.Errorf("loglevel: %w", err)
+	}
+	attrs := []*commonpb.KeyValue{
+		otlpAttr("service.name", slog.StringValue(appName)),
+		otlpAttr("service.version", slog.StringValue(fmt.Sprintf("v%d", *version))),
+	}
+	for k, v := range workloadLabels() {
+		attrs = append(attrs, otlpAttr(k, slog.StringValue(v)))
+	}
+	e := &otlpLogExporter{
+		url:      u,
+		resource: &resourcepb.Resource{Attributes: attrs},
+		records:  make(chan *logspb.LogRecord, 4*otlpLogBatch),
+		flushReq: make(chan chan struct{}),
+	}
+	go e.send(time.Second)
+	logExporter = e
+	return &otlpLogHandler{exporter: e, level: level}, nil
+}
+
+// send exports queued records, at least once per interval.
+func (e *otlpLogExporter) send(interval time.Duration) {
+	var batch []*logspb.LogRecord
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			otlpLogRecords.WithLabelValues("failed").Add(float64(len(batch)))
+		} else {
+			otlpLogRecords.WithLabelValues("sent").Add(float64(len(batch)))
+		}
+		batch = nil
+	}
+	tick := time.NewTicker(interval)
+	for {
+		select {
+		case r := <-e.records:
+			batch = append(batch, r)
+			if len(batch) >= otlpLogBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		case done := <-e.flushReq:
+			for len(e.records) > 0 {
+				batch = append(batch, <-e.records)
+			}
+			flush()
+			close(done)
+		}
+	}
+}
+
+// export posts one batch of records as an OTLP/HTTP protobuf request.
+func (e *otlpLogExporter) export(records []*logspb.LogRecord) error {
+	b, err := proto.Marshal(&collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: e.resource,
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: "github.com/ancientlore/topdog"},
+				LogRecords: records,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST returned %s", resp.Status)
+	}
+	return nil
+}
+
+// shutdownOTLPLogs sends the records still queued.
+func shutdownOTLPLogs(ctx context.Context) {
+	if logExporter == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case logExporter.flushReq <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// otlpLogHandler turns slog records into OTLP log records. A trace_id
+// attribute, added by the request's logger, becomes the record's trace ID.
+type otlpLogHandler struct {
+	exporter *otlpLogExporter
+	level    slog.Level
+	attrs    []*commonpb.KeyValue
+	prefix   string // of the open groups, such as "g1.g2."
+	traceID  []byte
+}
+
+func (h *otlpLogHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level
+}
+
+func (h *otlpLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	lr := &logspb.LogRecord{
+		TimeUnixNano:         uint64(r.Time.UnixNano()),
+		ObservedTimeUnixNano: uint64(time.Now().UnixNano()),
+		SeverityNumber:       otlpSeverity(r.Level),
+		SeverityText:         r.Level.String(),
+		Body:                 otlpValue(slog.StringValue(r.Message)),
+		Attributes:           append([]*commonpb.KeyValue(nil), h.attrs...),
+		TraceId:              h.traceID,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		tid, sid := sc.TraceID(), sc.SpanID()
+		lr.TraceId, lr.SpanId = tid[:], sid[:]
+	}
+	if r.PC != 0 {
+		f, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		lr.Attributes = append(lr.Attributes,
+			otlpAttr("code.filepath", slog.StringValue(filepath.Base(f.File))),
+			otlpAttr("code.lineno", slog.IntValue(f.Line)))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		lr.Attributes = h.appendAttr(lr.Attributes, a)
+		return true
+	})
+	select {
+	case h.exporter.records <- lr:
+	default:
+		otlpLogRecords.WithLabelValues("dropped").Inc()
+	}
+	return nil
+}
+
+func (h *otlpLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	u := *h
+	u.attrs = append([]*commonpb.KeyValue(nil), h.attrs...)
+	for _, a := range attrs {
+		if a.Key == "trace_id" && h.prefix == "" {
+			if b, err := hex.DecodeString(a.Value.String()); err == nil && len(b) == 16 {
+				u.traceID = b
+			}
+		}
+		u.attrs = u.appendAttr(u.attrs, a)
+	}
+	return &u
+}
+
+func (h *otlpLogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	u := *h
+	u.prefix = h.prefix + name + "."
+	return &u
+}
+
+// appendAttr adds an attribute under the open groups, flattening groups
+// into dotted keys as OpenTelemetry semantic conventions do.
+func (h *otlpLogHandler) appendAttr(kvs []*commonpb.KeyValue, a slog.Attr) []*commonpb.KeyValue {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return kvs
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		g := &otlpLogHandler{prefix: h.prefix}
+		if a.Key != "" {
+			g.prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			kvs = g.appendAttr(kvs, ga)
+		}
+		return kvs
+	}
+	return append(kvs, otlpAttr(h.prefix+a.Key, a.Value))
+}
+
+// otlpAttr returns an OTLP attribute.
+func otlpAttr(key string, v slog.Value) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: otlpValue(v)}
+}
+
+// otlpValue converts a slog value to an OTLP value.
+func otlpValue(v slog.Value) *commonpb.AnyValue {
+	switch v.Kind() {
+	case slog.KindString:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v.String()}}
+	case slog.KindInt64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v.Int64()}}
+	case slog.KindUint64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v.Uint64())}}
+	case slog.KindFloat64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v.Float64()}}
+	case slog.KindBool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v.Bool()}}
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v.String()}}
+}
+
+// otlpSeverity maps a log level to an OTLP severity number.
+func otlpSeverity(l slog.Level) logspb.SeverityNumber {
+	switch {
+	case l >= slog.LevelError:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_ERROR
+	case l >= slog.LevelWarn:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_WARN
+	case l >= slog.LevelInfo:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_INFO
+	}
+	return logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+var adminPort = flag.Int("admin_port", 0, "Port on localhost for the pprof profiling handlers (0 disables them)")
+
+// startAdminServer serves pprof on its own localhost listener, away from the
+// service port, returning nil when it is disabled.
+func startAdminServer() (*http.Server, error) {
+	if *adminPort == 0 {
+		return nil, nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", *adminPort))
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+		// no write timeout, since CPU profiles and traces run for a while
+	}
+	slog.Info("Profiling available", "addr", ln.Addr().String())
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Cannot serve profiling", "err", err)
+		}
+	}()
+	return server, nil
+}
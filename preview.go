@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	previewSamples    = 10000
+	previewMaxSamples = 1000000
+)
+
+// previewDog is one dog's share of a simulated vote.
+type previewDog struct {
+	Count int     `json:"count"`
+	Share float64 `json:"share"` // of all samples, including failures
+}
+
+// strategyPreview is the outcome of simulating a voting strategy.
+type strategyPreview struct {
+	Strategy    int                   `json:"strategy"`
+	Weights     string                `json:"weights"`
+	Samples     int                   `json:"samples"`
+	Failures    int                   `json:"failures"`
+	FailureRate float64               `json:"failureRate"`
+	Dogs        map[string]previewDog `json:"dogs"`
+}
+
+// previewStrategy votes samples times with a strategy and weights, using its
+// own random source so the live votes, their metrics, and the tallies are
+// left alone.
+func previewStrategy(strategy int, weightSpec string, samples int, seed int64) (*strategyPreview, error) {
+	s, err := buildSamplers(weightSpec)
+	if err != nil {
+		return nil, fmt.Errorf("weights: %w", err)
+	}
+	p := &strategyPreview{
+		Strategy: strategy,
+		Weights:  weightSpec,
+		Samples:  samples,
+		Dogs:     make(map[string]previewDog, len(dogs)),
+	}
+	counts := make(map[string]int, len(dogs))
+	vote := getVoteFunc(strategy)
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < samples; i++ {
+		dog, err := vote(r, s[strategy])
+		if err != nil {
+			p.Failures++
+			continue
+		}
+		counts[dog]++
+	}
+	for _, d := range dogs {
+		p.Dogs[d] = previewDog{Count: counts[d], Share: float64(counts[d]) / float64(samples)}
+	}
+	p.FailureRate = float64(p.Failures) / float64(samples)
+	return p, nil
+}
+
+// strategyPreviewAPI simulates the voting strategy in effect, or the one in
+// ?strategy=, with the current weights, or the ones in ?weights=, and returns
+// the distribution, so a weight change can be checked before real traffic
+// is sent to it. ?seed= makes the result repeatable.
+func strategyPreviewAPI(resp http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	samples := previewSamples
+	if s := q.Get("samples"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > previewMaxSamples {
+			writeError(resp, tierUI, withCode(codeBadRequest, http.StatusBadRequest, fmt.Errorf("samples must be between 1 and %d", previewMaxSamples)))
+			return
+		}
+		samples = n
+	}
+	strategy := strategyVersion()
+	if s := q.Get("strategy"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 3 {
+			writeError(resp, tierUI, withCode(codeBadRequest, http.StatusBadRequest, errors.New("strategy must be 1, 2, or 3")))
+			return
+		}
+		strategy = n
+	}
+	weightSpec := currentWeights()
+	if q.Has("weights") {
+		weightSpec = q.Get("weights")
+	}
+	seed := time.Now().UnixNano()
+	if s := q.Get("seed"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			writeError(resp, tierUI, withCode(codeBadRequest, http.StatusBadRequest, errors.New("seed must be an integer")))
+			return
+		}
+		seed = n
+	}
+
+	p, err := previewStrategy(strategy, weightSpec, samples, seed)
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	profilePush         = flag.String("profile_push", "", "Pyroscope-compatible /ingest URL to push CPU profiles to, for flame graphs of a running demo (empty disables it)")
+	profilePushInterval = flag.Duration("profile_push_interval", 15*time.Second, "Length of each CPU profile pushed to profile_push, and how often a heap profile is pushed")
+	profilePushTypes    = flag.String("profile_push_types", "cpu,heap", "Profiles pushed to profile_push, separated by commas: cpu, heap, or both")
+)
+
+var profilePushes = newMetric.NewCounterVec(prometheus.CounterOpts{Name: "topdog_profile_pushes_total", Help: "Profiles pushed to profile_push, by type and result."}, []string{"type", "result"})
+
+// parseProfileTypes reads the profile_push_types setting.
+func parseProfileTypes(s string) (cpu, heap bool, err error) {
+	for _, t := range strings.Split(s, ",") {
+		switch strings.TrimSpace(t) {
+		case "cpu":
+			cpu = true
+		case "heap":
+			heap = true
+		case "":
+		default:
+			return false, false, fmt.Errorf("profile type %q is not cpu or heap", strings.TrimSpace(t))
+		}
+	}
+	if !cpu && !heap {
+		return false, false, fmt.Errorf("profile_push_types lists no profiles")
+	}
+	return cpu, heap, nil
+}
+
+// checkProfilePush verifies the profile push settings.
+func checkProfilePush() error {
+	if *profilePush == "" {
+		return nil
+	}
+	u, err := url.Parse(*profilePush)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s is not an http or https URL", u.Redacted())
+	}
+	if *profilePushInterval < time.Second {
+		return fmt.Errorf("profile_push_interval %s must be at least 1s", *profilePushInterval)
+	}
+	_, _, err = parseProfileTypes(*profilePushTypes)
+	return err
+}
+
+// profileAppName names the pushed profiles of a type in Pyroscope's form,
+// as topdog.cpu{app=topdog,version=v1,...}, so instances and versions can be
+// told apart or compared.
+func profileAppName(kind string) string {
+	labels := workloadLabels()
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(appName + "." + kind + "{")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k + "=" + labels[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// startProfilePush profiles the CPU continuously, pushing a profile every
+// profile_push_interval, and pushes a heap profile after each. A CPU profile
+// is skipped while something else, such as /debug/pprof/profile on
+// admin_port, has the CPU profiler.
+func startProfilePush() {
+	if *profilePush == "" {
+		return
+	}
+	target, err := url.Parse(*profilePush)
+	if err != nil {
+		return
+	}
+	cpu, heap, err := parseProfileTypes(*profilePushTypes)
+	if err != nil {
+		return
+	}
+	push := func(kind string, from, until time.Time, profile []byte) {
+		if err := pushProfile(target, profileAppName(kind), from, until, profile); err != nil {
+			slog.Warn("Cannot push profile", "url", target.Redacted(), "type", kind, "err", err)
+			profilePushes.WithLabelValues(kind, "error").Inc()
+		} else {
+			profilePushes.WithLabelValues(kind, "ok").Inc()
+		}
+	}
+	go func() {
+		for {
+			var buf bytes.Buffer
+			from := time.Now()
+			if !cpu {
+				time.Sleep(*profilePushInterval)
+			} else if err := pprof.StartCPUProfile(&buf); err != nil {
+				slog.Debug("Cannot start CPU profile", "err", err)
+				profilePushes.WithLabelValues("cpu", "busy").Inc()
+				time.Sleep(*profilePushInterval)
+			} else {
+				time.Sleep(*profilePushInterval)
+				pprof.StopCPUProfile()
+				push("cpu", from, time.Now(), buf.Bytes())
+			}
+			if heap {
+				// allocations since startup; Pyroscope shows the in-use and allocated space and objects
+				var hb bytes.Buffer
+				if err := pprof.Lookup("heap").WriteTo(&hb, 0); err == nil {
+					push("heap", from, time.Now(), hb.Bytes())
+				}
+			}
+		}
+	}()
+}
+
+// pushProfile sends a pprof profile to Pyroscope's /ingest API as a
+// multipart form, the way its own Go client does.
+func pushProfile(target *url.URL, name string, from, until time.Time, profile []byte) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("profile", "profile.pprof")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(profile); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	u := *target
+	q := u.Query()
+	q.Set("name", name)
+	q.Set("from", strconv.FormatInt(from.Unix(), 10))
+	q.Set("until", strconv.FormatInt(until.Unix(), 10))
+	q.Set("format", "pprof")
+	q.Set("spyName", "gospy")
+	q.Set("sampleRate", "100")
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST returned %s", resp.Status)
+	}
+	return nil
+}
@@ -1,53 +1,224 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var (
 	transport = &http.Transport{DisableKeepAlives: false, MaxIdleConnsPerHost: 10, DisableCompression: false, ResponseHeaderTimeout: time.Second * 5}
 	client    = &http.Client{Transport: transport, Timeout: time.Second * 10}
+
+	retryAfterMax = flag.Duration("retry_after_max", 2*time.Second, "Longest total Retry-After delay to honor from a downstream service (0 to never wait)")
 )
 
-func queryDownstreamService(url string, originalRequest *http.Request) (*backEndResponse, error) {
+// maxRetryAfterAttempts bounds how many times a Retry-After response is retried.
+const maxRetryAfterAttempts = 3
+
+const retryWaitedHeader = "x-topdog-retry-waited"
+
+// queryDownstreamService calls the target tier on behalf of the given tier.
+func queryDownstreamService(tier, target, url string, originalRequest *http.Request) (*backEndResponse, error) {
+	req, span := startClientSpan(tier, target, url, originalRequest)
+	start := time.Now()
+	var result *backEndResponse
+	var status int
+	var err error
+	if strings.HasPrefix(url, "grpc://") {
+		result, status, err = fetchGRPC(tier, target, url, req)
+	} else {
+		result, status, err = fetchDownstream(tier, target, url, req)
+	}
+	countDownstream(req.Context(), tier, target, status, err, time.Since(start))
+	endClientSpan(span, status, err)
+	noteDownstreamVersions(target, url, status, result, err)
+	if err != nil {
+		err = addHop(err, hop{
+			From:      tier,
+			To:        target,
+			Status:    status,
+			RequestID: getRequestContext(originalRequest).RequestID,
+		})
+	}
+	return result, err
+}
+
+// fetchDownstream issues the downstream request, returning the final HTTP status if one was received.
+func fetchDownstream(tier, target, url string, originalRequest *http.Request) (*backEndResponse, int, error) {
+	logger := requestLogger(originalRequest)
+
 	// create request
-	request, err := http.NewRequest("GET", url, nil)
+	ctx := originalRequest.Context()
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create request", "err", err)
 	}
 	request.Close = false
 
 	// copy headers for Istio and correlation id
 	copyHeaders(request, originalRequest)
 
-	// issue request
-	response, err := client.Do(request)
-	if err != nil {
-		log.Print("HTTP request error on "+url+": ", err)
-		return nil, err
+	// ask for the newest schema we understand; older tiers ignore this
+	request.Header.Set(schemaHeader, strconv.Itoa(latestSchema))
+
+	// serve from cache when downstream said we could
+	if bypassCache(originalRequest) {
+		request.Header.Set("Cache-Control", "no-cache")
+	} else if result, ok := downstreamCache.get(cacheKey(url, request)); ok {
+		result.cacheHit = true
+		result.serverTiming = "" // nothing below was called
+		result.BackendMillis, result.MidtierMillis = 0, 0
+		return result, http.StatusOK, nil
 	}
 
-	var data []byte
-	data, err = ioutil.ReadAll(response.Body)
-	response.Body.Close()
+	var waited time.Duration
+	for attempt := 1; ; attempt++ {
+		// issue request, timing the connection
+		traceCtx, timings := withConnTimings(ctx)
+		response, err := client.Do(request.WithContext(traceCtx))
+		timings.record(ctx, tier, target)
+		if err != nil {
+			logger.Warn("HTTP request error", "url", url, "err", err)
+			return nil, 0, classifyTransportError(err)
+		}
+
+		var data []byte
+		data, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		if err != nil {
+			logger.Warn("Unable to read response", "url", url, "err", err)
+			return nil, 0, classifyTransportError(err)
+		}
+
+		if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+			if d, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+				if attempt < maxRetryAfterAttempts && fitsDeadline(getRequestContext(originalRequest).Deadline, waited+d) {
+					logger.Info("Honoring Retry-After", "url", url, "status", response.StatusCode, "retry_after", d.String())
+					select {
+					case <-time.After(d):
+					case <-ctx.Done():
+						return nil, 0, classifyTransportError(ctx.Err())
+					}
+					waited += d
+					continue
+				}
+				logger.Warn("Giving up, Retry-After exceeds deadline", "url", url, "status", response.StatusCode, "retry_after", d.String())
+				detail := string(data)
+				var hops []hop
+				if p, ok := parseProblem(data); ok {
+					detail = p.Detail
+					hops = p.Hops
+				}
+				return nil, response.StatusCode, &codedError{
+					code:       codeDownstreamThrottled,
+					status:     response.StatusCode,
+					err:        fmt.Errorf("downstream asked to retry after %s: %s", d, detail),
+					retryAfter: d,
+					hops:       hops,
+				}
+			}
+		}
+
+		if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
+			// keep the downstream code so callers see the original failure mode
+			if p, ok := parseProblem(data); ok {
+				err = &codedError{code: p.Code, status: response.StatusCode, err: errors.New(p.Detail), hops: p.Hops}
+			} else {
+				err = withCode(codeDownstreamError, http.StatusBadGateway, errors.New(string(data)))
+			}
+			logger.Warn("HTTP error", "url", url, "status", response.StatusCode, "err", err)
+			return nil, response.StatusCode, err
+		}
+
+		if err = verifyChecksum(response.Header, data); err != nil {
+			logger.Warn("Corrupt response", "url", url, "err", err)
+			return nil, response.StatusCode, err
+		}
+
+		result, err := unmarshalResponse(data)
+		if err != nil {
+			logger.Warn("Unable to parse JSON", "url", url, "err", err)
+			return nil, response.StatusCode, withCode(codeDownstreamBadResponse, http.StatusBadGateway, err)
+		}
+		// include any waiting done further downstream
+		result.retryWaited = waited
+		if d, err := time.ParseDuration(response.Header.Get(retryWaitedHeader)); err == nil {
+			result.retryWaited += d
+		}
+		if seen := captureEnvoy(response.Header); seen != nil {
+			logger.Debug("Envoy response headers", "url", url, envoyAttr(seen))
+		}
+		result.cacheHit = response.Header.Get(cacheHeader) == "HIT"
+		result.serverTiming = response.Header.Get(serverTimingHeader)
+		downstreamCache.put(cacheKey(url, request), result, response.Header)
 
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		err = errors.New(string(data))
-		log.Printf("HTTP error %d on %s: %s", response.StatusCode, url, err)
-		return nil, err
+		return result, response.StatusCode, nil
 	}
+}
+
+// elapsedMillis returns the time since the request arrived in milliseconds,
+// for the per-tier latency fields of a response.
+func elapsedMillis(req *http.Request) float64 {
+	return float64(time.Since(getRequestContext(req).Start).Microseconds()) / 1000
+}
 
-	var result backEndResponse
-	err = json.Unmarshal(data, &result)
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(s)
 	if err != nil {
-		log.Print("Unable to parse JSON from "+url+": ", err)
-		return nil, err
+		return 0, false
+	}
+	d := time.Until(t)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// fitsDeadline reports whether waiting a total of d stays within the configured
+// limit and the request's own deadline, if it has one.
+func fitsDeadline(deadline time.Time, d time.Duration) bool {
+	if d > *retryAfterMax {
+		return false
+	}
+	if !deadline.IsZero() && time.Now().Add(d).After(deadline) {
+		return false
+	}
+	return true
+}
+
+// setRetryHeaders tells the caller when we waited on a downstream Retry-After.
+func setRetryHeaders(resp http.ResponseWriter, result *backEndResponse) {
+	if result.retryWaited > 0 {
+		resp.Header().Set(retryWaitedHeader, result.retryWaited.String())
 	}
+}
 
-	return &result, nil
+const serverTimingHeader = "Server-Timing"
+
+// setServerTiming adds this tier's time so far to the Server-Timing entries
+// of the tiers below, so browser devtools show where a /query call spent its time.
+func setServerTiming(resp http.ResponseWriter, req *http.Request, tier string, result *backEndResponse) {
+	d := time.Since(getRequestContext(req).Start)
+	entries := fmt.Sprintf("%s;dur=%.1f", tier, float64(d.Microseconds())/1000)
+	if result != nil && result.serverTiming != "" {
+		entries += ", " + result.serverTiming
+	}
+	resp.Header().Set(serverTimingHeader, entries)
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var quotaDaily = flag.Int("quota_daily", 0, "Requests each user or API key may make to the UI tier per day (UTC) through the quota middleware (0 is unlimited)")
+
+const apiKeyHeader = "x-api-key"
+
+// quotaClient identifies who a request counts against: the API key if one
+// was sent, or else the user. Keys are hashed so the store doesn't hold them.
+func quotaClient(req *http.Request) string {
+	if k := strings.TrimSpace(req.Header.Get(apiKeyHeader)); k != "" {
+		sum := sha256.Sum256([]byte(k))
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+	if u := getRequestContext(req).User; u != "" {
+		return "user:" + u
+	}
+	return ""
+}
+
+// enforceQuota counts each request against the client's daily quota in the
+// store, so it survives restarts with the file store, and answers with 429
+// once it is used up. Only the UI tier is counted, since the user is passed
+// down to the other tiers, and anonymous requests aren't limited.
+func enforceQuota(route string, next http.Handler) http.Handler {
+	tier := tierForPath(route)
+	if *quotaDaily <= 0 || tier != tierUI {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		client := quotaClient(req)
+		if client == "" {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		s, err := getStore()
+		if err != nil {
+			writeError(resp, tier, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+			return
+		}
+		now := time.Now().UTC()
+		reset := now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+		remaining, ok, err := s.TakeQuota(client, now.Format(time.DateOnly), *quotaDaily)
+		if err != nil {
+			// don't turn a store problem into an outage
+			requestLogger(req).Error("Cannot update quota", "err", err)
+			next.ServeHTTP(resp, req)
+			return
+		}
+		h := resp.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(*quotaDaily))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(int(reset.Seconds())))
+		if !ok {
+			writeError(resp, tier, &codedError{
+				code:       codeQuotaExceeded,
+				status:     http.StatusTooManyRequests,
+				err:        fmt.Errorf("daily quota of %d requests used", *quotaDaily),
+				retryAfter: reset,
+			})
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
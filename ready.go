@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	readinessDownstream = flag.String("readiness_downstream", "", "Downstream tier whose health gates /readyz: midtier, backend, or empty for none")
+	readinessInterval   = flag.Duration("readiness_interval", 5*time.Second, "How often to check the readiness_downstream tier")
+	readinessFailures   = flag.Int("readiness_failures", 3, "Consecutive failed downstream checks before /readyz fails")
+	readinessSuccesses  = flag.Int("readiness_successes", 2, "Consecutive good downstream checks before /readyz recovers")
+)
+
+// drained takes this instance out of service, from the admin page, without
+// stopping it.
+var drained atomic.Bool
+
+// downstreamGate tracks whether the downstream tier is reachable, only
+// changing its mind after several checks in a row agree.
+type downstreamGate struct {
+	mu        sync.Mutex
+	down      bool
+	failures  int
+	successes int
+	lastErr   error
+}
+
+var gate downstreamGate
+
+// record notes the result of one check and reports whether the gate
+// opened or closed because of it.
+func (g *downstreamGate) record(err error) (changed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lastErr = err
+	if err != nil {
+		g.failures++
+		g.successes = 0
+		if !g.down && g.failures >= *readinessFailures {
+			g.down = true
+			return true
+		}
+		return false
+	}
+	g.successes++
+	g.failures = 0
+	if g.down && g.successes >= *readinessSuccesses {
+		g.down = false
+		return true
+	}
+	return false
+}
+
+// state returns the reason the gate is closed, or nil when it is open.
+func (g *downstreamGate) state() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.down {
+		return nil
+	}
+	return g.lastErr
+}
+
+// readinessURL returns the health URL of the readiness_downstream tier.
+func readinessURL() (string, error) {
+	switch *readinessDownstream {
+	case "":
+		return "", nil
+	case tierMidtier:
+		return *midtierURL + "/health", nil
+	case tierBackend:
+		return *backendURL + "/health", nil
+	}
+	return "", fmt.Errorf("%q is not midtier, backend, or empty", *readinessDownstream)
+}
+
+// startReadinessGate checks the readiness_downstream tier in the background.
+func startReadinessGate() {
+	url, err := readinessURL()
+	if err != nil {
+		slog.Error("Invalid readiness_downstream", "err", err)
+		return
+	}
+	if url == "" {
+		return
+	}
+	go func() {
+		for {
+			err := checkHealth(url)
+			if gate.record(err) {
+				if err != nil {
+					slog.Warn("Not ready", "downstream", *readinessDownstream, "failures", *readinessFailures, "err", err)
+					recordEvent(eventReadiness, "Not ready: %s failed %d times: %v", *readinessDownstream, *readinessFailures, err)
+				} else {
+					slog.Info("Ready", "downstream", *readinessDownstream, "successes", *readinessSuccesses)
+					recordEvent(eventReadiness, "Ready: %s", *readinessDownstream)
+				}
+			}
+			time.Sleep(*readinessInterval)
+		}
+	}()
+}
+
+// checkHealth calls a health URL, which must answer 200 within the check interval.
+func checkHealth(url string) error {
+	c := &http.Client{Transport: transport, Timeout: *readinessInterval}
+	resp, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(url + " returned " + resp.Status)
+	}
+	return nil
+}
+
+// notReady returns why this instance shouldn't receive traffic, or nil.
+func notReady() error {
+	if drained.Load() {
+		return errors.New("drained from the admin page")
+	}
+	if err := gate.state(); err != nil {
+		return fmt.Errorf("%s is unreachable: %s", *readinessDownstream, err)
+	}
+	if err := dependencyGate.state(); err != nil && *dependencyRequired {
+		return fmt.Errorf("%s is down: %s", *dependencyName, err)
+	}
+	return nil
+}
+
+// readyz reports whether this instance should receive traffic.
+func readyz(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-type", "text/plain; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	if err := notReady(); err != nil {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(resp, "not ready: %s\n", err)
+		return
+	}
+	resp.Write([]byte("ready\n"))
+}
+
+// headVote answers a HEAD request to /query, /midtier, or /backend with the
+// headers of a vote, without casting one, which would skew the tallies and
+// load the tiers below. Since the tiers below aren't called, the status is
+// 503 only when /readyz would fail. It reports whether req was a HEAD.
+func headVote(resp http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodHead {
+		return false
+	}
+	setSchemaHeaders(resp, negotiateSchema(req))
+	if notReady() != nil {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	remoteWrite         = flag.String("remote_write", "", "Prometheus remote-write URL to push metrics to, for clusters that can't scrape (empty disables it)")
+	remoteWriteInterval = flag.Duration("remote_write_interval", 15*time.Second, "How often metrics are pushed to remote_write")
+	remoteWriteUser     = flag.String("remote_write_user", "", "User name for basic authentication to remote_write")
+	remoteWritePassword = flag.String("remote_write_password", "", "Password for basic authentication to remote_write; usually set with the REMOTE_WRITE_PASSWORD environment variable")
+)
+
+var remoteWrites = newMetric.NewCounterVec(prometheus.CounterOpts{Name: "topdog_remote_writes_total", Help: "Metric pushes to remote_write, by result."}, []string{"result"})
+
+// checkRemoteWrite verifies the remote-write settings.
+func checkRemoteWrite() error {
+	if *remoteWrite == "" {
+		return nil
+	}
+	u, err := url.Parse(*remoteWrite)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s is not an http or https URL", u.Redacted())
+	}
+	if *remoteWriteInterval < time.Second {
+		return fmt.Errorf("remote_write_interval %s must be at least 1s", *remoteWriteInterval)
+	}
+	if *remoteWritePassword != "" && *remoteWriteUser == "" {
+		return fmt.Errorf("remote_write_password is set without remote_write_user")
+	}
+	return nil
+}
+
+// startRemoteWrite pushes the registered metrics every remote_write_interval.
+func startRemoteWrite() {
+	if *remoteWrite == "" {
+		return
+	}
+	target, err := url.Parse(*remoteWrite)
+	if err != nil {
+		return
+	}
+	slog.Info("Pushing metrics with remote write", "url", target.Redacted(), "interval", *remoteWriteInterval)
+	go func() {
+		for range time.Tick(*remoteWriteInterval) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			pushMetrics(ctx, target)
+			cancel()
+		}
+	}()
+}
+
+// flushRemoteWrite pushes the metrics once more at shutdown, so the last
+// interval's counts aren't lost.
+func flushRemoteWrite(ctx context.Context) {
+	if *remoteWrite == "" {
+		return
+	}
+	if target, err := url.Parse(*remoteWrite); err == nil {
+		pushMetrics(ctx, target)
+	}
+}
+
+// pushMetrics sends the current value of every registered metric to
+// remote_write, counting and logging the result.
+func pushMetrics(ctx context.Context, target *url.URL) {
+	if err := writeMetrics(ctx, target); err != nil {
+		slog.Warn("Cannot push metrics", "url", target.Redacted(), "err", err)
+		remoteWrites.WithLabelValues("error").Inc()
+		return
+	}
+	remoteWrites.WithLabelValues("ok").Inc()
+}
+
+// writeMetrics gathers the registered metrics and posts them as a
+// snappy-compressed remote-write request.
+func writeMetrics(ctx context.Context, target *url.URL) error {
+	families, err := metricsRegistry.Gather()
+	if err != nil && len(families) == 0 {
+		return err
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(families, time.Now()))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if *remoteWriteUser != "" {
+		req.SetBasicAuth(*remoteWriteUser, *remoteWritePassword)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("POST returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// rwLabel is a label of a remote-write series.
+type rwLabel struct {
+	name, value string
+}
+
+// encodeWriteRequest encodes metric families as a remote-write WriteRequest
+// protobuf. Histograms and summaries are split into series the way the text
+// format shows them, with _bucket, _sum, and _count suffixes.
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	ts := now.UnixMilli()
+	var b []byte
+	series := func(name string, labels []*dto.LabelPair, value float64, extra ...rwLabel) {
+		ls := make([]rwLabel, 0, len(labels)+len(extra)+1)
+		ls = append(ls, rwLabel{"__name__", name})
+		for _, l := range labels {
+			ls = append(ls, rwLabel{l.GetName(), l.GetValue()})
+		}
+		ls = append(ls, extra...)
+		sort.Slice(ls, func(i, j int) bool { return ls[i].name < ls[j].name })
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeTimeSeries(ls, value, ts))
+	}
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			l := m.GetLabel()
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				series(name, l, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				series(name, l, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				series(name, l, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					series(name, l, q.GetValue(), rwLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				series(name+"_sum", l, s.GetSampleSum())
+				series(name+"_count", l, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bk := range h.GetBucket() {
+					if math.IsInf(bk.GetUpperBound(), 1) {
+						continue
+					}
+					series(name+"_bucket", l, float64(bk.GetCumulativeCount()), rwLabel{"le", formatFloat(bk.GetUpperBound())})
+				}
+				series(name+"_bucket", l, float64(h.GetSampleCount()), rwLabel{"le", "+Inf"})
+				series(name+"_sum", l, h.GetSampleSum())
+				series(name+"_count", l, float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return b
+}
+
+// encodeTimeSeries encodes a TimeSeries with one sample.
+func encodeTimeSeries(labels []rwLabel, value float64, ts int64) []byte {
+	var b []byte
+	for _, l := range labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.name)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.value)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	var sb []byte
+	sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+	sb = protowire.AppendFixed64(sb, math.Float64bits(value))
+	sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+	sb = protowire.AppendVarint(sb, uint64(ts))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, sb)
+}
+
+// formatFloat formats a bucket bound or quantile as Prometheus does.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
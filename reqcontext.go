@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cohortHeader names the experiment cohort a request belongs to, passed on
+// to every tier.
+const cohortHeader = "x-topdog-cohort"
+
+// requestContext is what every tier knows about the request it is serving.
+// It is created once per request by withRequestContext, so handlers, logs,
+// and downstream calls agree on the IDs without reading headers themselves.
+type requestContext struct {
+	RequestID string
+	Generated bool      // the request arrived without an ID, so topdog made one
+	Start     time.Time // when the request arrived
+	User      string    // empty for anonymous users
+	Cohort    string    // empty when not in an experiment
+	Tenant    string    // empty without multi-tenancy or a tenant
+	Deadline  time.Time // zero when the route has no timeout
+
+	lock    sync.Mutex
+	traceID string       // empty until a trace is known or started
+	logger  *slog.Logger // adds the tier, request ID, and trace ID
+}
+
+type requestContextKey struct{}
+
+// withRequestContext creates the request context. Requests that arrive
+// without an x-request-id, as when topdog runs outside the mesh, get a new
+// one, and the ID is echoed in the response so a click can be found in the
+// logs of every tier.
+func withRequestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		generated := req.Header.Get(requestIDHeader) == ""
+		if generated {
+			req.Header.Set(requestIDHeader, newRequestID())
+		}
+		rc := newRequestContext(req)
+		rc.Generated = generated
+		resp.Header().Set(requestIDHeader, rc.RequestID)
+		next.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), requestContextKey{}, rc)))
+	})
+}
+
+// newRequestContext reads the request context from the request headers.
+func newRequestContext(req *http.Request) *requestContext {
+	rc := &requestContext{
+		RequestID: req.Header.Get(requestIDHeader),
+		Start:     time.Now(),
+		traceID:   traceID(req),
+		User:      currentUser(req),
+		Cohort:    strings.TrimSpace(req.Header.Get(cohortHeader)),
+		Tenant:    currentTenant(req),
+	}
+	if d, ok := req.Context().Deadline(); ok {
+		rc.Deadline = d
+	}
+	rc.logger = slog.Default().With("tier", tierForPath(req.URL.Path), "request_id", rc.RequestID)
+	if rc.traceID != "" {
+		rc.logger = rc.logger.With("trace_id", rc.traceID)
+	}
+	if rc.Tenant != "" {
+		rc.logger = rc.logger.With("tenant", rc.Tenant)
+	}
+	return rc
+}
+
+// getRequestContext returns the context of the request being served. Outside
+// withRequestContext it is read from the headers each time.
+func getRequestContext(req *http.Request) *requestContext {
+	if rc, ok := req.Context().Value(requestContextKey{}).(*requestContext); ok {
+		return rc
+	}
+	return newRequestContext(req)
+}
+
+// TraceID returns the trace the request belongs to.
+func (rc *requestContext) TraceID() string {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.traceID
+}
+
+// noteTraceID records the trace ID once the serving tier starts a trace.
+func (rc *requestContext) noteTraceID(id string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.traceID == "" && id != "" {
+		rc.traceID = id
+		rc.logger = rc.logger.With("trace_id", id)
+	}
+}
+
+// Logger returns the logger for the request.
+func (rc *requestContext) Logger() *slog.Logger {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.logger
+}
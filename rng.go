@@ -0,0 +1,71 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"flag"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	rngMode = flag.String("rng", "pooled", "Random number source for votes: pooled (fast, seedable) or crypto")
+	rngSeed = flag.Int64("seed", 0, "Seed for the pooled random number source (0 seeds from the clock)")
+)
+
+// cryptoSource is a rand.Source64 backed by crypto/rand.
+type cryptoSource struct{}
+
+func (cryptoSource) Seed(int64) {}
+
+func (cryptoSource) Int63() int64 {
+	return int64(cryptoSource{}.Uint64() & (1<<63 - 1))
+}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+var (
+	seedOnce sync.Once
+	baseSeed int64
+	seedNext int64
+)
+
+// nextSeed hands out a distinct seed for each pooled generator. With -seed set,
+// the sequence of seeds is repeatable.
+func nextSeed() int64 {
+	seedOnce.Do(func() {
+		baseSeed = *rngSeed
+		if baseSeed == 0 {
+			baseSeed = time.Now().UnixNano()
+		}
+	})
+	return baseSeed + atomic.AddInt64(&seedNext, 1) - 1
+}
+
+// rngPool holds generators so concurrent requests don't contend on one lock.
+var rngPool = sync.Pool{
+	New: func() interface{} {
+		if *rngMode == "crypto" {
+			return rand.New(cryptoSource{})
+		}
+		return rand.New(rand.NewSource(nextSeed()))
+	},
+}
+
+// getRand borrows a generator for the current request; return it with putRand.
+func getRand() *rand.Rand {
+	return rngPool.Get().(*rand.Rand)
+}
+
+// putRand returns a generator to the pool.
+func putRand(r *rand.Rand) {
+	rngPool.Put(r)
+}
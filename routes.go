@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// routeInfo describes a route. Each route registers one, and the registry
+// drives the /api index, the OpenAPI spec, and the route label on metrics,
+// so they always agree with what is served.
+type routeInfo struct {
+	Name    string   `json:"name"`
+	Pattern string   `json:"-"`               // http.ServeMux pattern, such as "GET /status/{code}"
+	Path    string   `json:"path"`            // filled in from the pattern
+	Methods []string `json:"methods"`         // for patterns without a method; defaults to GET
+	Group   string   `json:"group,omitempty"` // empty for routes without middleware
+	Summary string   `json:"summary"`
+	Auth    bool     `json:"auth"`              // filled in from the group
+	Timeout string   `json:"timeout,omitempty"` // filled in from the group
+}
+
+// register fills in the derived fields of a route, using the middleware
+// chain of its group.
+func (ri *routeInfo) register(chain []string) {
+	ri.Path = ri.Pattern
+	if method, path, ok := strings.Cut(ri.Pattern, " "); ok {
+		ri.Methods = []string{method}
+		ri.Path = strings.TrimSpace(path)
+	}
+	if len(ri.Methods) == 0 {
+		ri.Methods = []string{http.MethodGet}
+	}
+	ri.Auth = contains(chain, "auth")
+	if contains(chain, "timeout") {
+		if d := routeTimeout(ri.Path); d > 0 {
+			ri.Timeout = d.String()
+		}
+	}
+}
+
+// apiIndex lists the registered routes.
+func (r *router) apiIndex(resp http.ResponseWriter, req *http.Request) {
+	writeRouteJSON(resp, req, "application/json", map[string]interface{}{"routes": r.routes})
+}
+
+// pathParam matches the wildcards in a ServeMux path, such as {code} or {file...}.
+var pathParam = regexp.MustCompile(`\{([^}.]*)(\.\.\.)?\}`)
+
+// openAPI returns an OpenAPI 3 description of the registered routes.
+func (r *router) openAPI(resp http.ResponseWriter, req *http.Request) {
+	paths := make(map[string]map[string]interface{})
+	for _, ri := range r.routes {
+		path := pathParam.ReplaceAllString(ri.Path, "{$1}")
+		var params []interface{}
+		for _, m := range pathParam.FindAllStringSubmatch(ri.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		for _, method := range ri.Methods {
+			op := map[string]interface{}{
+				"operationId": ri.Name,
+				"summary":     ri.Summary,
+				"responses": map[string]interface{}{
+					"200":     map[string]string{"description": "OK"},
+					"default": map[string]interface{}{"description": "Error", "content": map[string]interface{}{"application/problem+json": map[string]interface{}{}}},
+				},
+			}
+			if len(ri.Methods) > 1 {
+				op["operationId"] = ri.Name + "." + strings.ToLower(method)
+			}
+			if ri.Group != "" {
+				op["tags"] = []string{ri.Group}
+			}
+			if params != nil {
+				op["parameters"] = params
+			}
+			if ri.Auth {
+				op["security"] = []map[string][]string{{"adminToken": {}}}
+			}
+			if ri.Timeout != "" {
+				op["x-timeout"] = ri.Timeout
+			}
+			paths[path][strings.ToLower(method)] = op
+		}
+	}
+	tags := make([]map[string]string, 0, len(routeGroups))
+	for _, g := range routeGroups {
+		tags = append(tags, map[string]string{"name": g})
+	}
+	writeRouteJSON(resp, req, "application/vnd.oai.openapi+json", map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": appName, "version": workloadLabels()["version"]},
+		"tags":    tags,
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	})
+}
+
+// writeRouteJSON writes v as indented JSON.
+func writeRouteJSON(resp http.ResponseWriter, req *http.Request, contentType string, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", contentType)
+	resp.Write(b)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var scenarioFile = flag.String("scenario", "", "File with a timed demo script run from /admin/scenario/start")
+
+// scenarioStep changes the admin settings at an offset from the start of a scenario.
+type scenarioStep struct {
+	At       time.Duration `json:"-"`
+	Settings adminSettings `json:"settings"`
+	Applied  bool          `json:"applied"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// parseScenario reads a script with one step per line: an offset like 2m,
+// then the settings to apply as in /admin/api/settings. Blank lines and lines
+// starting with # are ignored.
+//
+//	0s  {"weights": "1:mike=5"}
+//	2m  {"errorRate": 0.3}
+//	4m  {"errorRate": 0}
+func parseScenario(r io.Reader) ([]scenarioStep, error) {
+	var steps []scenarioStep
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		offset, settings, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected an offset and settings", n)
+		}
+		at, err := time.ParseDuration(strings.TrimPrefix(offset, "t+"))
+		if err != nil || at < 0 {
+			return nil, fmt.Errorf("line %d: bad offset %q", n, offset)
+		}
+		if len(steps) > 0 && at < steps[len(steps)-1].At {
+			return nil, fmt.Errorf("line %d: offset %s is before the previous step", n, at)
+		}
+		var s adminSettings
+		if err = json.Unmarshal([]byte(settings), &s); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		steps = append(steps, scenarioStep{At: at, Settings: s})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("no steps")
+	}
+	return steps, nil
+}
+
+// loadScenario reads the configured scenario file.
+func loadScenario() ([]scenarioStep, error) {
+	if *scenarioFile == "" {
+		return nil, errors.New("no scenario file is configured")
+	}
+	f, err := os.Open(*scenarioFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseScenario(f)
+}
+
+// scenarioRunner runs one scenario at a time.
+type scenarioRunner struct {
+	mu      sync.Mutex
+	steps   []scenarioStep
+	started time.Time
+	running bool
+	cancel  context.CancelFunc
+}
+
+var scenario scenarioRunner
+
+// start runs the steps from now, stopping any scenario already running.
+func (r *scenarioRunner) start(steps []scenarioStep) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.steps, r.started, r.running, r.cancel = steps, time.Now(), true, cancel
+	r.mu.Unlock()
+	slog.Info("Scenario started", "steps", len(steps))
+	recordEvent(eventScenario, "Scenario started with %d steps", len(steps))
+	go r.run(ctx, steps)
+}
+
+// run applies each step at its offset until the scenario ends or is stopped.
+func (r *scenarioRunner) run(ctx context.Context, steps []scenarioStep) {
+	start := time.Now()
+	for i := range steps {
+		select {
+		case <-time.After(time.Until(start.Add(steps[i].At))):
+		case <-ctx.Done():
+			return
+		}
+		err := applySettings(ctx, steps[i].Settings, sourceScenario)
+		if err == nil {
+			recordAudit(auditEntry{Who: "scenario", Action: "settings", Detail: steps[i].Settings})
+		}
+		r.mu.Lock()
+		steps[i].Applied = true
+		if err != nil {
+			steps[i].Error = err.Error()
+			slog.Warn("Scenario step failed", "at", steps[i].At.String(), "err", err)
+		} else {
+			slog.Info("Scenario step applied", "at", steps[i].At.String())
+		}
+		r.mu.Unlock()
+	}
+	r.mu.Lock()
+	if ctx.Err() == nil {
+		r.running = false
+	}
+	r.mu.Unlock()
+	slog.Info("Scenario finished")
+	recordEvent(eventScenario, "Scenario finished")
+}
+
+// stop cancels the remaining steps, leaving the settings as they are.
+func (r *scenarioRunner) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+	if r.running {
+		r.running = false
+		slog.Info("Scenario stopped")
+		recordEvent(eventScenario, "Scenario stopped")
+	}
+}
+
+// scenarioStatus is returned by the scenario API.
+type scenarioStatus struct {
+	File    string             `json:"file"`
+	Running bool               `json:"running"`
+	Started *time.Time         `json:"started,omitempty"`
+	Elapsed string             `json:"elapsed,omitempty"`
+	Steps   []scenarioStepJSON `json:"steps"`
+}
+
+type scenarioStepJSON struct {
+	At string `json:"at"`
+	scenarioStep
+}
+
+// status reports progress through the current or last scenario.
+func (r *scenarioRunner) status() scenarioStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := scenarioStatus{File: *scenarioFile, Running: r.running, Steps: []scenarioStepJSON{}}
+	if !r.started.IsZero() {
+		started := r.started
+		s.Started = &started
+		if r.running {
+			s.Elapsed = time.Since(r.started).Round(time.Second).String()
+		}
+	}
+	for _, step := range r.steps {
+		s.Steps = append(s.Steps, scenarioStepJSON{At: step.At.String(), scenarioStep: step})
+	}
+	return s
+}
+
+// scenarioStart starts the configured scenario from the beginning.
+func scenarioStart(resp http.ResponseWriter, req *http.Request) {
+	steps, err := loadScenario()
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	scenario.start(steps)
+	auditRequest(req, "scenario start", *scenarioFile)
+	scenarioStatusAPI(resp, req)
+}
+
+// scenarioStop stops the running scenario.
+func scenarioStop(resp http.ResponseWriter, req *http.Request) {
+	scenario.stop()
+	auditRequest(req, "scenario stop", nil)
+	scenarioStatusAPI(resp, req)
+}
+
+// scenarioStatusAPI reports on the current or last scenario.
+func scenarioStatusAPI(resp http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(scenario.status())
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	schemaV1      = 1 // flat version fields
+	schemaV2      = 2 // versions grouped under a "versions" object
+	latestSchema  = schemaV2
+	schemaHeader  = "x-topdog-schema"
+	schemaProfile = "topdog/v"
+)
+
+// tierVersions groups the version of each tier in the v2 response shape.
+type tierVersions struct {
+	Backend int `json:"backend,omitempty"`
+	Midtier int `json:"midtier,omitempty"`
+	UI      int `json:"ui,omitempty"`
+}
+
+// tierMillis groups the time taken by each tier in the v2 response shape.
+type tierMillis struct {
+	Backend float64 `json:"backend,omitempty"`
+	Midtier float64 `json:"midtier,omitempty"`
+	UI      float64 `json:"ui,omitempty"`
+}
+
+// backEndResponseV2 is the v2 response shape.
+type backEndResponseV2 struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	TopDog        string            `json:"topDog"`
+	Versions      tierVersions      `json:"versions"`
+	Millis        *tierMillis       `json:"millis,omitempty"`
+	TraceID       string            `json:"traceId,omitempty"`
+	RequestID     string            `json:"requestId,omitempty"`
+	Tenant        string            `json:"tenant,omitempty"`
+	Baggage       map[string]string `json:"baggage,omitempty"`
+}
+
+// wireResponse accepts either response shape when reading from a downstream tier.
+type wireResponse struct {
+	backEndResponse
+	Versions *tierVersions `json:"versions,omitempty"`
+	Millis   *tierMillis   `json:"millis,omitempty"`
+}
+
+// parseSchema converts a schema version string like "2" or "v2" into a number.
+func parseSchema(s string) (int, bool) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "v")
+	n, err := strconv.Atoi(s)
+	if err != nil || n < schemaV1 || n > latestSchema {
+		return 0, false
+	}
+	return n, true
+}
+
+// negotiateSchema selects the response schema based on the x-topdog-schema header
+// or an Accept profile such as application/json; profile="topdog/v2".
+func negotiateSchema(req *http.Request) int {
+	if n, ok := parseSchema(req.Header.Get(schemaHeader)); ok {
+		return n
+	}
+	for _, accept := range req.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			_, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+			profile := params["profile"]
+			if strings.HasPrefix(profile, schemaProfile) {
+				if n, ok := parseSchema(strings.TrimPrefix(profile, schemaProfile)); ok {
+					return n
+				}
+			}
+		}
+	}
+	if n, ok := parseSchema(strconv.Itoa(*defaultSchema)); ok {
+		return n
+	}
+	return schemaV1
+}
+
+// marshalResponse renders the response in the requested schema.
+func marshalResponse(r *backEndResponse, schema int) ([]byte, error) {
+	switch schema {
+	case schemaV2:
+		var millis *tierMillis
+		if r.BackendMillis != 0 || r.MidtierMillis != 0 || r.UIMillis != 0 {
+			millis = &tierMillis{Backend: r.BackendMillis, Midtier: r.MidtierMillis, UI: r.UIMillis}
+		}
+		return json.Marshal(&backEndResponseV2{
+			SchemaVersion: schemaV2,
+			TopDog:        r.TopDog,
+			Versions: tierVersions{
+				Backend: r.BackendVersion,
+				Midtier: r.MidtierVersion,
+				UI:      r.UIVersion,
+			},
+			Millis:    millis,
+			TraceID:   r.TraceID,
+			RequestID: r.RequestID,
+			Tenant:    r.Tenant,
+			Baggage:   r.Baggage,
+		})
+	}
+	v1 := *r
+	v1.SchemaVersion = schemaV1
+	return json.Marshal(&v1)
+}
+
+// unmarshalResponse reads a response in either schema.
+func unmarshalResponse(data []byte) (*backEndResponse, error) {
+	var w wireResponse
+	err := json.Unmarshal(data, &w)
+	if err != nil {
+		return nil, err
+	}
+	result := w.backEndResponse
+	if w.Versions != nil {
+		result.BackendVersion = w.Versions.Backend
+		result.MidtierVersion = w.Versions.Midtier
+		result.UIVersion = w.Versions.UI
+	}
+	if w.Millis != nil {
+		result.BackendMillis = w.Millis.Backend
+		result.MidtierMillis = w.Millis.Midtier
+		result.UIMillis = w.Millis.UI
+	}
+	return &result, nil
+}
+
+// setSchemaHeaders sets the content type and cache variance for the given schema.
+func setSchemaHeaders(resp http.ResponseWriter, schema int) {
+	resp.Header().Set("Content-type", fmt.Sprintf("application/json; profile=\"%s%d\"", schemaProfile, schema))
+	resp.Header().Add("Vary", "Accept, "+schemaHeader)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var settingsFile = flag.String("settings_file", "", "JSON file of runtime settings, as for /admin/api/settings, applied at startup and on reload; usually a mounted ConfigMap")
+
+var errNoSettingsFile = errors.New("no settings_file is configured")
+
+// settingsFileState records when the settings file was last applied.
+var settingsFileState struct {
+	lock     sync.Mutex
+	loaded   time.Time
+	modified time.Time // of the file when it was loaded
+}
+
+// readSettingsFile reads the settings file and its modification time.
+func readSettingsFile() (adminSettings, time.Time, error) {
+	var s adminSettings
+	b, err := os.ReadFile(*settingsFile)
+	if err != nil {
+		return s, time.Time{}, err
+	}
+	fi, err := os.Stat(*settingsFile)
+	if err != nil {
+		return s, time.Time{}, err
+	}
+	if err = json.Unmarshal(b, &s); err != nil {
+		return s, time.Time{}, err
+	}
+	return s, fi.ModTime(), nil
+}
+
+// reloadSettingsFile applies the settings file.
+func reloadSettingsFile(ctx context.Context) error {
+	s, modified, err := readSettingsFile()
+	if err != nil {
+		return err
+	}
+	if err = applySettings(ctx, s, sourceSettingsFile); err != nil {
+		return err
+	}
+	settingsFileState.lock.Lock()
+	settingsFileState.loaded, settingsFileState.modified = time.Now(), modified
+	settingsFileState.lock.Unlock()
+	contextLogger(ctx).Info("Applied settings file", "file", *settingsFile)
+	recordEvent(eventConfig, "Applied settings file %s", *settingsFile)
+	return nil
+}
+
+// startSettingsFile applies the settings file, if there is one, and reloads
+// it on SIGHUP.
+func startSettingsFile() error {
+	if *settingsFile == "" {
+		return nil
+	}
+	if err := reloadSettingsFile(context.Background()); err != nil {
+		return err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadSettingsFile(context.Background()); err != nil {
+				slog.Error("Cannot reload settings file", "file", *settingsFile, "err", err)
+				recordEvent(eventConfig, "Settings file reload failed: %v", err)
+				continue
+			}
+			recordAudit(auditEntry{Who: "SIGHUP", Action: "settings file reload", Detail: *settingsFile})
+		}
+	}()
+	return nil
+}
+
+// settingDiff is one setting that differs between what is applied and the file.
+type settingDiff struct {
+	Setting string      `json:"setting"`
+	Applied interface{} `json:"applied"`
+	File    interface{} `json:"file"`
+}
+
+// configDiffResponse is returned by /admin/config/diff.
+type configDiffResponse struct {
+	File        string        `json:"file"`
+	Loaded      *time.Time    `json:"loaded,omitempty"`
+	Modified    *time.Time    `json:"modified,omitempty"` // of the file now
+	Pending     bool          `json:"pending"`            // the file changed since it was applied
+	Differences []settingDiff `json:"differences"`
+}
+
+// diffSettings compares the settings given in the file with the applied ones.
+// Settings the file leaves out aren't compared.
+func diffSettings(applied, file adminSettings) []settingDiff {
+	a, f := settingsMap(applied), settingsMap(file)
+	diffs := []settingDiff{}
+	for k, fv := range f {
+		av := a[k]
+		if k == "latency" {
+			// compare durations, so 1s and 1000ms are the same
+			ad, _ := time.ParseDuration(av.(string))
+			fd, _ := time.ParseDuration(fv.(string))
+			if ad == fd {
+				continue
+			}
+		} else if reflect.DeepEqual(av, fv) {
+			continue
+		}
+		diffs = append(diffs, settingDiff{Setting: k, Applied: av, File: fv})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Setting < diffs[j].Setting })
+	return diffs
+}
+
+// settingsMap returns the settings that are set, by their JSON names.
+func settingsMap(s adminSettings) map[string]interface{} {
+	m := make(map[string]interface{})
+	b, _ := json.Marshal(s)
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// configDiff shows how the settings file differs from the applied settings,
+// so it's obvious when a ConfigMap changed but wasn't reloaded.
+func configDiff(resp http.ResponseWriter, req *http.Request) {
+	tier := tierForPath(req.URL.Path)
+	if *settingsFile == "" {
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusNotFound, errNoSettingsFile))
+		return
+	}
+	file, modified, err := readSettingsFile()
+	if err != nil {
+		writeError(resp, tier, withCode(codeInternal, http.StatusInternalServerError, err))
+		return
+	}
+	d := configDiffResponse{File: *settingsFile, Modified: &modified, Differences: diffSettings(currentSettings(), file)}
+	settingsFileState.lock.Lock()
+	if !settingsFileState.loaded.IsZero() {
+		loaded := settingsFileState.loaded
+		d.Loaded = &loaded
+	}
+	d.Pending = !modified.Equal(settingsFileState.modified)
+	settingsFileState.lock.Unlock()
+	b, err := json.Marshal(d)
+	if err != nil {
+		writeError(resp, tier, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
+
+// configReload applies the settings file, then shows the remaining differences.
+func configReload(resp http.ResponseWriter, req *http.Request) {
+	if *settingsFile == "" {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeBadRequest, http.StatusNotFound, errNoSettingsFile))
+		return
+	}
+	if err := reloadSettingsFile(req.Context()); err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeBadRequest, http.StatusBadRequest, err))
+		return
+	}
+	auditRequest(req, "settings file reload", *settingsFile)
+	configDiff(resp, req)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sloWindows = flag.String("slo_windows", "1m,5m,15m", "Comma-separated windows /slo summarizes latency and errors over, up to 1h")
+
+// sloMaxWindow bounds the windows, and with them the memory kept per route.
+const sloMaxWindow = time.Hour
+
+// sloRoutes are the routes /slo tracks, one per tier.
+var sloRoutes = []string{"/query", "/midtier", "/backend"}
+
+// Latencies are counted in exponential bins from 100µs, each 10% wider than
+// the last, so percentiles are within 10% of the true value up to a minute.
+const (
+	sloBins      = 140
+	sloBinBase   = 100 * time.Microsecond
+	sloBinFactor = 1.1
+)
+
+// sloBin returns the bin a latency falls in.
+func sloBin(d time.Duration) int {
+	if d <= sloBinBase {
+		return 0
+	}
+	b := int(math.Ceil(math.Log(float64(d)/float64(sloBinBase)) / math.Log(sloBinFactor)))
+	return min(b, sloBins-1)
+}
+
+// sloBinBound returns the upper bound of a bin.
+func sloBinBound(b int) time.Duration {
+	return time.Duration(float64(sloBinBase) * math.Pow(sloBinFactor, float64(b)))
+}
+
+// sloSecond counts the requests that finished in one second.
+type sloSecond struct {
+	sec    int64
+	counts [sloBins]uint32
+	errors uint32
+}
+
+// sloSeries is a ring of the last seconds of a route.
+type sloSeries struct {
+	lock sync.Mutex
+	ring []sloSecond
+}
+
+func (s *sloSeries) observe(now time.Time, d time.Duration, failed bool) {
+	sec := now.Unix()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b := &s.ring[sec%int64(len(s.ring))]
+	if b.sec != sec {
+		*b = sloSecond{sec: sec}
+	}
+	b.counts[sloBin(d)]++
+	if failed {
+		b.errors++
+	}
+}
+
+// sloSummary describes a route's requests over a window.
+type sloSummary struct {
+	Requests  uint64  `json:"requests"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+	P50Millis float64 `json:"p50Millis"`
+	P95Millis float64 `json:"p95Millis"`
+	P99Millis float64 `json:"p99Millis"`
+}
+
+// summary adds up the seconds within the window before now.
+func (s *sloSeries) summary(now time.Time, window time.Duration) sloSummary {
+	var counts [sloBins]uint64
+	var r sloSummary
+	since := now.Unix() - int64(window/time.Second)
+	s.lock.Lock()
+	for i := range s.ring {
+		b := &s.ring[i]
+		if b.sec <= since || b.sec > now.Unix() {
+			continue
+		}
+		for j, n := range b.counts {
+			counts[j] += uint64(n)
+			r.Requests += uint64(n)
+		}
+		r.Errors += uint64(b.errors)
+	}
+	s.lock.Unlock()
+	if r.Requests == 0 {
+		return r
+	}
+	r.ErrorRate = float64(r.Errors) / float64(r.Requests)
+	quantile := func(q float64) float64 {
+		want := uint64(math.Ceil(q * float64(r.Requests)))
+		var seen uint64
+		for j, n := range counts {
+			if seen += n; seen >= want {
+				return float64(sloBinBound(j).Microseconds()) / 1000
+			}
+		}
+		return float64(sloBinBound(sloBins-1).Microseconds()) / 1000
+	}
+	r.P50Millis, r.P95Millis, r.P99Millis = quantile(0.5), quantile(0.95), quantile(0.99)
+	return r
+}
+
+var (
+	sloOnce    sync.Once
+	sloTracked map[string]*sloSeries
+)
+
+// sloRouteSeries returns the series of each tracked route, sized for the
+// longest window.
+func sloRouteSeries() map[string]*sloSeries {
+	sloOnce.Do(func() {
+		size := int(sloMaxWindow / time.Second)
+		if windows, err := parseSLOWindows(*sloWindows); err == nil {
+			size = int(windows[len(windows)-1]/time.Second) + 1
+		}
+		sloTracked = make(map[string]*sloSeries, len(sloRoutes))
+		for _, r := range sloRoutes {
+			sloTracked[r] = &sloSeries{ring: make([]sloSecond, size)}
+		}
+	})
+	return sloTracked
+}
+
+// observeSLO counts a finished request to a tracked route. Server errors
+// count against the error rate; client errors don't.
+func observeSLO(route string, status int, d time.Duration) {
+	if s, ok := sloRouteSeries()[route]; ok {
+		s.observe(time.Now(), d, status >= 500)
+	}
+}
+
+// parseSLOWindows reads the slo_windows setting, shortest first.
+func parseSLOWindows(s string) ([]time.Duration, error) {
+	var windows []time.Duration
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		d, err := time.ParseDuration(item)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second || d > sloMaxWindow {
+			return nil, fmt.Errorf("window %s is not between 1s and %s", item, sloMaxWindow)
+		}
+		if len(windows) > 0 && d <= windows[len(windows)-1] {
+			return nil, errors.New("windows must be listed shortest first")
+		}
+		windows = append(windows, d)
+	}
+	if len(windows) == 0 {
+		return nil, errors.New("no windows given")
+	}
+	return windows, nil
+}
+
+// checkSLOWindows verifies the slo_windows setting.
+func checkSLOWindows() error {
+	_, err := parseSLOWindows(*sloWindows)
+	return err
+}
+
+// windowName formats a window the way it would be written, as 5m rather
+// than 5m0s.
+func windowName(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
+
+// sloWindow is the summary of each tracked route over one window.
+type sloWindow struct {
+	Window string                `json:"window"`
+	Routes map[string]sloSummary `json:"routes"`
+}
+
+// sloAPI returns the latency percentiles and error rate of the /query,
+// /midtier, and /backend routes over each of slo_windows, or over ?window=,
+// so a traffic shift shows up without Prometheus. Only requests served by
+// this instance are counted.
+func sloAPI(resp http.ResponseWriter, req *http.Request) {
+	windows, err := parseSLOWindows(*sloWindows)
+	if err != nil {
+		windows = []time.Duration{sloMaxWindow}
+	}
+	if w := req.URL.Query().Get("window"); w != "" {
+		d, err := time.ParseDuration(w)
+		longest := windows[len(windows)-1]
+		if err != nil || d < time.Second || d > longest {
+			writeError(resp, tierForPath(req.URL.Path), withCode(codeBadRequest, http.StatusBadRequest, fmt.Errorf("window must be a duration between 1s and %s", windowName(longest))))
+			return
+		}
+		windows = []time.Duration{d}
+	}
+	now := time.Now()
+	series := sloRouteSeries()
+	result := make([]sloWindow, 0, len(windows))
+	for _, w := range windows {
+		sw := sloWindow{Window: windowName(w), Routes: make(map[string]sloSummary, len(series))}
+		for route, s := range series {
+			sw.Routes[route] = s.summary(now, w)
+		}
+		result = append(result, sw)
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
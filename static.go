@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errStaticPath     = errors.New("invalid static file path")
+	errStaticNotFound = errors.New("static file not found")
+)
+
+// validStaticPath reports whether name, the request path below /static/, is
+// safe to look up. It rejects .. segments, hidden files, backslashes, and NUL
+// explicitly rather than relying on path cleaning to catch them.
+func validStaticPath(name string) bool {
+	if strings.ContainsAny(name, "\\\x00") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// openStatic opens a regular file in the static folder. Directories are not
+// served, and neither are symlinks that lead outside the folder.
+func openStatic(name string) (*os.File, os.FileInfo, error) {
+	root, err := filepath.EvalSymlinks(*staticPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return nil, nil, errStaticNotFound
+	}
+	if rel, err := filepath.Rel(root, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, nil, errStaticPath
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, errStaticNotFound
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, errStaticNotFound
+	}
+	return f, fi, nil
+}
+
+// staticFiles serves the files in the static folder, after /static/ has been
+// stripped from the path. Unlike http.FileServer it never lists directories.
+// http.ServeContent handles Range and conditional requests, so large images
+// and media can be fetched in parts and resumed.
+func staticFiles(resp http.ResponseWriter, req *http.Request) {
+	tier := tierUI
+	name := req.URL.Path
+	if !validStaticPath(name) {
+		requestLogger(req).Warn("Rejected static path", "path", name)
+		writeError(resp, tier, withCode(codeBadRequest, http.StatusBadRequest, errStaticPath))
+		return
+	}
+	f, fi, err := openStatic(name)
+	if err != nil {
+		if errors.Is(err, errStaticPath) {
+			requestLogger(req).Warn("Rejected static path", "path", name)
+		}
+		writeError(resp, tier, withCode(codeNotFound, http.StatusNotFound, errStaticNotFound))
+		return
+	}
+	defer f.Close()
+	http.ServeContent(resp, req, fi.Name(), fi.ModTime(), f)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serveStatic points static_path at a temporary folder holding a file, a
+// subfolder, a hidden file, and a symlink to a file outside the folder, and
+// returns the /static/ handler.
+func serveStatic(t *testing.T) http.Handler {
+	t.Helper()
+	root := t.TempDir()
+	outside := t.TempDir()
+	files := map[string]string{
+		filepath.Join(root, "dog.txt"):         "0123456789abcdefghij",
+		filepath.Join(root, "sub", "pup.txt"):  "pup",
+		filepath.Join(root, ".hidden"):         "hidden",
+		filepath.Join(outside, "secret.txt"):   "secret",
+		filepath.Join(root, "sub", ".env.txt"): "env",
+	}
+	for name, body := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt")); err != nil {
+		t.Skip("cannot make symlinks:", err)
+	}
+	old := *staticPath
+	*staticPath = root
+	t.Cleanup(func() { *staticPath = old })
+	return http.StripPrefix("/static/", http.HandlerFunc(staticFiles))
+}
+
+func TestStaticFiles(t *testing.T) {
+	h := serveStatic(t)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/static/dog.txt", nil))
+	if resp.Code != http.StatusOK || resp.Body.String() != "0123456789abcdefghij" {
+		t.Errorf("got %d %q, want the whole file", resp.Code, resp.Body.String())
+	}
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/static/sub/pup.txt", nil))
+	if resp.Code != http.StatusOK {
+		t.Errorf("got %d for a file in a subfolder, want 200", resp.Code)
+	}
+}
+
+func TestStaticFilesRange(t *testing.T) {
+	h := serveStatic(t)
+	req := httptest.NewRequest(http.MethodGet, "/static/dog.txt", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusPartialContent {
+		t.Fatalf("got %d, want 206", resp.Code)
+	}
+	if got, want := resp.Header().Get("Content-Range"), "bytes 0-9/20"; got != want {
+		t.Errorf("got Content-Range %q, want %q", got, want)
+	}
+	if got := resp.Body.String(); got != "0123456789" {
+		t.Errorf("got body %q, want the first 10 bytes", got)
+	}
+}
+
+func TestStaticFilesRefused(t *testing.T) {
+	h := serveStatic(t)
+	tests := []struct {
+		name, target string
+	}{
+		{"directory", "/static/sub/"},
+		{"directory without slash", "/static/sub"},
+		{"root", "/static/"},
+		{"missing", "/static/cat.txt"},
+		{"dot dot", "/static/../secret.txt"},
+		{"encoded dot dot", "/static/%2e%2e/secret.txt"},
+		{"nested dot dot", "/static/sub/../../secret.txt"},
+		{"backslash", "/static/..%5csecret.txt"},
+		{"NUL", "/static/dog.txt%00.png"},
+		{"dot file", "/static/.hidden"},
+		{"dot file in subfolder", "/static/sub/.env.txt"},
+		{"symlink outside", "/static/secret.txt"},
+	}
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if resp.Code != http.StatusBadRequest && resp.Code != http.StatusNotFound {
+			t.Errorf("%s: %s got %d, want 400 or 404", tt.name, tt.target, resp.Code)
+		}
+		if body := resp.Body.String(); body == "secret" || body == "hidden" || body == "env" {
+			t.Errorf("%s: %s served %q", tt.name, tt.target, body)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	statsdAddr   = flag.String("statsd_addr", "", "StatsD host:port to send request, latency, and vote metrics to over UDP, for when Prometheus can't scrape (empty disables it)")
+	statsdPrefix = flag.String("statsd_prefix", "topdog.", "Prefix for StatsD metric names")
+	statsdTags   = flag.Bool("statsd_tags", true, "Send labels as DogStatsD tags; when false, label values are appended to the metric name for plain StatsD")
+)
+
+// statsdMaxPacket keeps packets within a typical MTU.
+const statsdMaxPacket = 1432
+
+// statsdClient sends metrics to StatsD. Lines are queued and sent in
+// batches, and dropped rather than blocking a request when the queue is full.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+	common []string // workload labels as tags
+	lines  chan string
+}
+
+// statsd is the StatsD client, or nil when it is disabled.
+var statsd *statsdClient
+
+// startStatsd starts sending metrics when statsd_addr is set.
+func startStatsd() error {
+	if *statsdAddr == "" {
+		return nil
+	}
+	conn, err := net.Dial("udp", *statsdAddr)
+	if err != nil {
+		return err
+	}
+	c := &statsdClient{conn: conn, prefix: *statsdPrefix, tags: *statsdTags, lines: make(chan string, 1000)}
+	labels := workloadLabels()
+	for k, v := range labels {
+		c.common = append(c.common, k+":"+v)
+	}
+	sort.Strings(c.common)
+	go c.send(time.Second)
+	statsd = c
+	slog.Info("Sending StatsD metrics", "addr", *statsdAddr)
+	return nil
+}
+
+// send writes queued lines, flushing at least once per interval.
+func (c *statsdClient) send(interval time.Duration) {
+	var buf strings.Builder
+	flush := func() {
+		if buf.Len() > 0 {
+			c.conn.Write([]byte(buf.String())) // UDP, so errors are only logged by the receiver
+			buf.Reset()
+		}
+	}
+	tick := time.NewTicker(interval)
+	for {
+		select {
+		case line := <-c.lines:
+			if buf.Len()+len(line)+1 > statsdMaxPacket {
+				flush()
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(line)
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// statsdUnsafe matches characters that can't appear in a plain StatsD name.
+var statsdUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// emit queues one metric. Labels are name, value pairs.
+func (c *statsdClient) emit(name, value, kind string, labels ...string) {
+	if c == nil {
+		return
+	}
+	line := c.prefix + name
+	if c.tags {
+		tags := append([]string(nil), c.common...)
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i+1] != "" {
+				tags = append(tags, labels[i]+":"+strings.ReplaceAll(labels[i+1], ",", "_"))
+			}
+		}
+		line += ":" + value + "|" + kind + "|#" + strings.Join(tags, ",")
+	} else {
+		for i := 1; i < len(labels); i += 2 {
+			v := statsdUnsafe.ReplaceAllString(labels[i], "_")
+			if v == "" {
+				v = "none"
+			}
+			line += "." + v
+		}
+		line += ":" + value + "|" + kind
+	}
+	select {
+	case c.lines <- line:
+	default:
+	}
+}
+
+// count adds one to a counter.
+func (c *statsdClient) count(name string, labels ...string) {
+	c.emit(name, "1", "c", labels...)
+}
+
+// timing records a duration in milliseconds.
+func (c *statsdClient) timing(name string, d time.Duration, labels ...string) {
+	c.emit(name, fmt.Sprintf("%.3f", float64(d.Microseconds())/1000), "ms", labels...)
+}
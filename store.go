@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	storeKind   = flag.String("store", "memory", "Where user data is kept: memory or file")
+	storeFile   = flag.String("store_file", "topdog-store.json", "File used by the file store")
+	historySize = flag.Int("history_size", 100, "Number of history entries kept per user")
+	storeFlush  = flag.Duration("store_flush_interval", time.Second, "How often the file store saves history and quota changes; favorites are saved right away (0 saves every change)")
+)
+
+// store keeps per-user data. Implementations must be safe for concurrent use.
+type store interface {
+	// Favorite returns the user's favorite dog, or "" if none is set.
+	Favorite(user string) (string, error)
+	// SetFavorite sets the user's favorite dog; an empty dog clears it.
+	SetFavorite(user, dog string) error
+	// AddHistory appends an entry to the user's history, dropping the oldest beyond history_size.
+	AddHistory(user string, e historyEntry) error
+	// History returns the user's history, newest first.
+	History(user string) ([]historyEntry, error)
+	// Users returns the users with a favorite or history, sorted.
+	Users() ([]string, error)
+	// Merge sets the given favorites and appends the given history, oldest
+	// first, in one change.
+	Merge(favorites map[string]string, history map[string][]historyEntry) error
+	// Snapshot returns a copy of everything in the store.
+	Snapshot() (storeData, error)
+	// Restore replaces everything in the store with d.
+	Restore(d storeData) error
+	// TakeQuota uses one of the client's requests for the day unless all
+	// limit are used, returning how many remain.
+	TakeQuota(client, day string, limit int) (remaining int, ok bool, err error)
+}
+
+// Kinds of history entries.
+const (
+	historyResult = "result" // a /query result the user saw
+	historyVote   = "vote"   // a favorite the user submitted
+)
+
+// historyEntry is one event in a user's history.
+type historyEntry struct {
+	Time           time.Time `json:"time"`
+	Kind           string    `json:"kind"`
+	Dog            string    `json:"dog,omitempty"`
+	BackendVersion int       `json:"backendVersion,omitempty"`
+	ErrorCode      string    `json:"errorCode,omitempty"`
+}
+
+// quotaUsage is how many requests a client made on a day.
+type quotaUsage struct {
+	Day  string `json:"day"`
+	Used int    `json:"used"`
+}
+
+// storeData is everything a store holds, in its serialized form.
+type storeData struct {
+	Favorites map[string]string         `json:"favorites"`
+	History   map[string][]historyEntry `json:"history"`
+	Quotas    map[string]quotaUsage     `json:"quotas,omitempty"`
+}
+
+func newStoreData() storeData {
+	return storeData{
+		Favorites: make(map[string]string),
+		History:   make(map[string][]historyEntry),
+		Quotas:    make(map[string]quotaUsage),
+	}
+}
+
+// memoryStore keeps data in memory only.
+type memoryStore struct {
+	lock sync.RWMutex
+	data storeData
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: newStoreData()}
+}
+
+func (s *memoryStore) Favorite(user string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.data.Favorites[user], nil
+}
+
+func (s *memoryStore) SetFavorite(user, dog string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if dog == "" {
+		delete(s.data.Favorites, user)
+	} else {
+		s.data.Favorites[user] = dog
+	}
+	return nil
+}
+
+func (s *memoryStore) AddHistory(user string, e historyEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := append(s.data.History[user], e)
+	if n := *historySize; n > 0 && len(h) > n {
+		h = append([]historyEntry(nil), h[len(h)-n:]...)
+	}
+	s.data.History[user] = h
+	return nil
+}
+
+func (s *memoryStore) Merge(favorites map[string]string, history map[string][]historyEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for user, dog := range favorites {
+		s.data.Favorites[user] = dog
+	}
+	for user, entries := range history {
+		h := append(s.data.History[user], entries...)
+		if n := *historySize; n > 0 && len(h) > n {
+			h = append([]historyEntry(nil), h[len(h)-n:]...)
+		}
+		s.data.History[user] = h
+	}
+	return nil
+}
+
+func (s *memoryStore) Snapshot() (storeData, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	d := newStoreData()
+	for user, dog := range s.data.Favorites {
+		d.Favorites[user] = dog
+	}
+	for user, h := range s.data.History {
+		d.History[user] = append([]historyEntry(nil), h...)
+	}
+	for client, q := range s.data.Quotas {
+		d.Quotas[client] = q
+	}
+	return d, nil
+}
+
+func (s *memoryStore) Restore(d storeData) error {
+	if d.Favorites == nil {
+		d.Favorites = make(map[string]string)
+	}
+	if d.History == nil {
+		d.History = make(map[string][]historyEntry)
+	}
+	if d.Quotas == nil {
+		d.Quotas = make(map[string]quotaUsage)
+	}
+	s.lock.Lock()
+	s.data = d
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memoryStore) History(user string) ([]historyEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	h := s.data.History[user]
+	result := make([]historyEntry, len(h))
+	for i, e := range h {
+		result[len(h)-1-i] = e
+	}
+	return result, nil
+}
+
+func (s *memoryStore) Users() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	users := make([]string, 0, len(s.data.History))
+	for u := range s.data.History {
+		users = append(users, u)
+	}
+	for u := range s.data.Favorites {
+		if _, ok := s.data.History[u]; !ok {
+			users = append(users, u)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (s *memoryStore) TakeQuota(client, day string, limit int) (int, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.data.Quotas[client]
+	if q.Day != day {
+		q = quotaUsage{Day: day}
+	}
+	if q.Used >= limit {
+		return 0, false, nil
+	}
+	q.Used++
+	s.data.Quotas[client] = q
+	return limit - q.Used, true, nil
+}
+
+// fileStore is a memoryStore that saves itself to a JSON file. Favorites
+// and bulk changes are saved right away; history and quota changes, which
+// come with every request, are saved every store_flush_interval so requests
+// don't wait on the disk.
+type fileStore struct {
+	memoryStore
+	path  string
+	save  sync.Mutex
+	dirty atomic.Bool // changes not yet saved
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: memoryStore{data: newStoreData()}, path: path}
+	b, err := os.ReadFile(path)
+	if err == nil {
+		var d storeData
+		err = json.Unmarshal(b, &d)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		s.memoryStore.Restore(d)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if *storeFlush > 0 {
+		go func() {
+			for range time.Tick(*storeFlush) {
+				if err := s.saveChanges(); err != nil {
+					slog.Error("Cannot save store", "file", s.path, "err", err)
+				}
+			}
+		}()
+	}
+	return s, nil
+}
+
+func (s *fileStore) SetFavorite(user, dog string) error {
+	err := s.memoryStore.SetFavorite(user, dog)
+	if err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) AddHistory(user string, e historyEntry) error {
+	err := s.memoryStore.AddHistory(user, e)
+	if err != nil {
+		return err
+	}
+	return s.changed()
+}
+
+func (s *fileStore) Merge(favorites map[string]string, history map[string][]historyEntry) error {
+	err := s.memoryStore.Merge(favorites, history)
+	if err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) Restore(d storeData) error {
+	err := s.memoryStore.Restore(d)
+	if err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) TakeQuota(client, day string, limit int) (int, bool, error) {
+	remaining, ok, err := s.memoryStore.TakeQuota(client, day, limit)
+	if err != nil || !ok {
+		return remaining, ok, err
+	}
+	return remaining, ok, s.changed()
+}
+
+// changed notes a change to save with the next periodic flush, or saves it
+// now if store_flush_interval is 0.
+func (s *fileStore) changed() error {
+	if *storeFlush <= 0 {
+		return s.flush()
+	}
+	s.dirty.Store(true)
+	return nil
+}
+
+// saveChanges saves the data if it changed since the last save.
+func (s *fileStore) saveChanges() error {
+	if !s.dirty.Load() {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush writes the data to a temporary file and renames it into place.
+func (s *fileStore) flush() error {
+	s.save.Lock()
+	defer s.save.Unlock()
+	s.dirty.Store(false)
+	s.lock.RLock()
+	b, err := json.MarshalIndent(&s.data, "", "  ")
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".topdog-store-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.dirty.Store(true)
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		s.dirty.Store(true)
+	}
+	return err
+}
+
+var (
+	storeOnce sync.Once
+	theStore  store
+	storeErr  error
+)
+
+// openStore creates the configured store.
+func openStore() (store, error) {
+	switch *storeKind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return newFileStore(*storeFile)
+	}
+	return nil, fmt.Errorf("%q is not memory or file", *storeKind)
+}
+
+// saveStore saves changes the file store is holding for its next periodic
+// flush, at shutdown.
+func saveStore() {
+	if s, ok := theStore.(*fileStore); ok {
+		if err := s.saveChanges(); err != nil {
+			slog.Error("Cannot save store", "file", s.path, "err", err)
+		}
+	}
+}
+
+// getStore returns the process-wide store, opening it on first use.
+func getStore() (store, error) {
+	storeOnce.Do(func() {
+		theStore, storeErr = openStore()
+	})
+	return theStore, storeErr
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	syslogAddr     = flag.String("syslog_addr", "", "Syslog server to also send logs to in RFC 5424 format, as udp://host:514 or tcp://host:514 (empty disables it)")
+	syslogFacility = flag.String("syslog_facility", "local0", "Syslog facility: user, daemon, or local0 to local7")
+)
+
+var syslogFacilities = map[string]int{"user": 1, "daemon": 3, "local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23}
+
+// parseSyslogAddr returns the network and address of syslog_addr.
+func parseSyslogAddr(s string) (string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return "", "", fmt.Errorf("%q is not a udp:// or tcp:// address", s)
+	}
+	if u.Port() == "" {
+		return "", "", fmt.Errorf("%q has no port", s)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// checkSyslog verifies the syslog flags.
+func checkSyslog() error {
+	if _, ok := syslogFacilities[*syslogFacility]; !ok {
+		return fmt.Errorf("syslog_facility %q is not user, daemon, or local0 to local7", *syslogFacility)
+	}
+	if *syslogAddr == "" {
+		return nil
+	}
+	_, _, err := parseSyslogAddr(*syslogAddr)
+	return err
+}
+
+// syslogWriter frames each log line as an RFC 5424 message. Over TCP
+// messages are octet counted, as in RFC 6587, and the connection is redialed
+// after an error. Lines that can't be sent are dropped, so a syslog outage
+// doesn't stop the service.
+type syslogWriter struct {
+	lock     sync.Mutex
+	network  string
+	addr     string
+	conn     net.Conn
+	facility int
+	severity int // of the line being written
+	hostname string
+}
+
+// newSyslogWriter connects to syslog_addr.
+func newSyslogWriter() (*syslogWriter, error) {
+	if err := checkSyslog(); err != nil {
+		return nil, err
+	}
+	network, addr, err := parseSyslogAddr(*syslogAddr)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "-"
+	}
+	w := &syslogWriter{network: network, addr: addr, facility: syslogFacilities[*syslogFacility], hostname: host}
+	if err = w.dial(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) dial() error {
+	conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write sends one log line at the current severity. The caller holds the lock.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", w.facility*8+w.severity, time.Now().Format(time.RFC3339Nano), w.hostname, appName, os.Getpid(), bytes.TrimRight(p, "\n"))
+	if w.network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if err := w.dial(); err != nil {
+				return len(p), nil
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := w.conn.Write([]byte(msg)); err == nil || w.network == "udp" {
+			break
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return len(p), nil
+}
+
+// syslogSeverity maps a log level to a syslog severity.
+func syslogSeverity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3 // err
+	case l >= slog.LevelWarn:
+		return 4 // warning
+	case l >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// syslogHandler formats records with the usual handler and sends them to
+// syslog with a severity matching their level.
+type syslogHandler struct {
+	slog.Handler
+	w *syslogWriter
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.lock.Lock()
+	defer h.w.lock.Unlock()
+	h.w.severity = syslogSeverity(r.Level)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), w: h.w}
+}
+
+// teeHandler sends records to several handlers.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	u := make(teeHandler, len(t))
+	for i, h := range t {
+		u[i] = h.WithAttrs(attrs)
+	}
+	return u
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	u := make(teeHandler, len(t))
+	for i, h := range t {
+		u[i] = h.WithGroup(name)
+	}
+	return u
+}
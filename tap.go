@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultTapDuration = 5 * time.Second
+	maxTapDuration     = time.Minute
+	maxTapCaptures     = 1000
+	tapBodyLimit       = 4096
+)
+
+// tapCapture is one captured request and response.
+type tapCapture struct {
+	Time            time.Time   `json:"time"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RemoteAddr      string      `json:"remoteAddr"`
+	ClientIP        string      `json:"clientIp"`
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	RequestBody     string      `json:"requestBody,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	ResponseBody    string      `json:"responseBody,omitempty"`
+	Duration        string      `json:"duration"`
+}
+
+// tap collects captures for requests matching a path prefix.
+type tap struct {
+	path     string
+	max      int
+	lock     sync.Mutex
+	captures []tapCapture
+}
+
+func (t *tap) matches(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, t.path)
+}
+
+func (t *tap) add(c tapCapture) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.captures) < t.max {
+		t.captures = append(t.captures, c)
+	}
+}
+
+// taps holds the active taps.
+var taps struct {
+	lock   sync.RWMutex
+	active map[*tap]struct{}
+}
+
+func startTap(t *tap) {
+	taps.lock.Lock()
+	defer taps.lock.Unlock()
+	if taps.active == nil {
+		taps.active = make(map[*tap]struct{})
+	}
+	taps.active[t] = struct{}{}
+}
+
+func stopTap(t *tap) {
+	taps.lock.Lock()
+	defer taps.lock.Unlock()
+	delete(taps.active, t)
+}
+
+// matchingTaps returns the active taps interested in a request.
+func matchingTaps(req *http.Request) []*tap {
+	taps.lock.RLock()
+	defer taps.lock.RUnlock()
+	var result []*tap
+	for t := range taps.active {
+		if t.matches(req) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// limitedBuffer keeps the first tapBodyLimit bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	total int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.total += len(p)
+	if room := tapBodyLimit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// String returns the captured text, noting truncation and binary content.
+func (b *limitedBuffer) String() string {
+	if b.total == 0 {
+		return ""
+	}
+	if !utf8.Valid(b.Bytes()) {
+		return fmt.Sprintf("(%d bytes of binary data)", b.total)
+	}
+	if b.total > b.Len() {
+		return fmt.Sprintf("%s... (%d bytes total)", b.Bytes(), b.total)
+	}
+	return b.Buffer.String()
+}
+
+// responseBody returns the captured text of a response body, decompressing
+// it if the gzip middleware compressed it on the way out.
+func responseBody(h http.Header, b *limitedBuffer) string {
+	if h.Get("Content-Encoding") != "gzip" || b.total == 0 {
+		return b.String()
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		return b.String()
+	}
+	// a small body can inflate a lot, so only read what could be shown
+	plain, err := io.ReadAll(io.LimitReader(zr, 1<<20))
+	var out limitedBuffer
+	out.Write(plain)
+	if err != nil || b.total > b.Len() {
+		// only the start of the compressed body was captured
+		if !utf8.Valid(out.Bytes()) {
+			return fmt.Sprintf("(%d bytes of gzipped binary data)", b.total)
+		}
+		return fmt.Sprintf("%s... (%d bytes gzipped)", out.Bytes(), b.total)
+	}
+	return out.String()
+}
+
+// tapRecorder captures the response for a tap.
+type tapRecorder struct {
+	http.ResponseWriter
+	status int
+	body   limitedBuffer
+}
+
+func (r *tapRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *tapRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *tapRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// tapRequests copies requests and responses to any matching active taps.
+// Admin requests are never captured, since /debug/tap has no auth and they
+// carry the admin token and settings, and credentials are redacted from
+// the headers of the rest.
+func tapRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/debug/") || req.URL.Path == "/admin" || strings.HasPrefix(req.URL.Path, "/admin/") {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		active := matchingTaps(req)
+		if len(active) == 0 {
+			next.ServeHTTP(resp, req)
+			return
+		}
+
+		start := time.Now()
+		var reqBody limitedBuffer
+		if req.Body != nil {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(req.Body, &reqBody), req.Body}
+		}
+		reqHeaders := redactedHeaders(req.Header)
+		rec := &tapRecorder{ResponseWriter: resp}
+		next.ServeHTTP(rec, req)
+
+		c := tapCapture{
+			Time:            start,
+			Method:          req.Method,
+			URL:             req.URL.String(),
+			RemoteAddr:      req.RemoteAddr,
+			ClientIP:        fmt.Sprint(clientIP(req)),
+			RequestHeaders:  reqHeaders,
+			RequestBody:     reqBody.String(),
+			Status:          rec.status,
+			ResponseHeaders: redactedHeaders(resp.Header()),
+			ResponseBody:    responseBody(resp.Header(), &rec.body),
+			Duration:        time.Since(start).String(),
+		}
+		if c.Status == 0 {
+			c.Status = http.StatusOK
+		}
+		for _, t := range active {
+			t.add(c)
+		}
+	})
+}
+
+// debugTap captures matching requests for a while and returns them as JSON.
+func debugTap(resp http.ResponseWriter, req *http.Request) {
+	d := defaultTapDuration
+	if s := req.URL.Query().Get("duration"); s != "" {
+		var err error
+		d, err = time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxTapDuration {
+			http.Error(resp, "duration must be between 0 and "+maxTapDuration.String(), http.StatusBadRequest)
+			return
+		}
+	}
+	t := &tap{path: req.URL.Query().Get("path"), max: maxTapCaptures}
+
+	// the tap outlives the server's usual write timeout
+	err := http.NewResponseController(resp).SetWriteDeadline(time.Now().Add(d + 10*time.Second))
+	if err != nil && d >= serverWriteTimeout {
+		requestLogger(req).Warn("Cannot extend write deadline", "err", err)
+		http.Error(resp, "duration must be under "+serverWriteTimeout.String()+" here, since the write deadline can't be extended", http.StatusBadRequest)
+		return
+	}
+
+	startTap(t)
+	select {
+	case <-time.After(d):
+	case <-req.Context().Done():
+	}
+	stopTap(t)
+
+	t.lock.Lock()
+	captures := t.captures
+	t.lock.Unlock()
+	if captures == nil {
+		captures = []tapCapture{}
+	}
+	b, err := json.Marshal(captures)
+	if err != nil {
+		requestLogger(req).Error("Cannot marshal JSON", "err", err)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tcpPort        = flag.Int("tcp_port", 0, "Port for a raw TCP echo listener, for TCP routing demos (0 disables it)")
+	tcpBanner      = flag.String("tcp_banner", "", "Line sent when a TCP echo connection opens, making it a server-first protocol; {version} is replaced (empty sends nothing)")
+	tcpIdleTimeout = flag.Duration("tcp_idle_timeout", 5*time.Minute, "Close TCP echo connections idle for this long")
+)
+
+var tcpConnectionsTotal = newMetric.NewCounter(prometheus.CounterOpts{
+	Name: "topdog_tcp_connections_total",
+	Help: "Connections accepted by the TCP echo listener.",
+})
+
+var tcpActiveConnections = newMetric.NewGauge(prometheus.GaugeOpts{
+	Name: "topdog_tcp_active_connections",
+	Help: "Open connections to the TCP echo listener.",
+})
+
+var tcpBytesTotal = newMetric.NewCounterVec(prometheus.CounterOpts{
+	Name: "topdog_tcp_bytes_total",
+	Help: "Bytes echoed by the TCP echo listener, by direction.",
+}, []string{"direction"})
+
+// startTCPEcho listens on tcp_port and echoes back whatever each
+// connection sends, so TCP routes, TLS sniffing, and TCP metrics can be shown
+// with the same workload as the HTTP tiers.
+func startTCPEcho() (net.Listener, error) {
+	if *tcpPort == 0 {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *tcpPort))
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("TCP echo listening", "addr", ln.Addr().String())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				return // closed
+			}
+			go echoTCP(conn)
+		}
+	}()
+	return ln, nil
+}
+
+// echoTCP sends the banner, then echoes data until the connection is closed
+// or idle for tcp_idle_timeout.
+func echoTCP(conn net.Conn) {
+	defer conn.Close()
+	tcpConnectionsTotal.Inc()
+	tcpActiveConnections.Inc()
+	defer tcpActiveConnections.Dec()
+	start := time.Now()
+	var received, sent int
+	defer func() {
+		slog.Debug("TCP echo connection closed", "client", conn.RemoteAddr().String(), "received", received, "sent", sent, "duration", time.Since(start).String())
+	}()
+	if *tcpBanner != "" {
+		banner := strings.ReplaceAll(*tcpBanner, "{version}", fmt.Sprintf("v%d", *version)) + "\r\n"
+		n, err := conn.Write([]byte(banner))
+		sent += n
+		tcpBytesTotal.WithLabelValues("sent").Add(float64(n))
+		if err != nil {
+			return
+		}
+	}
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(*tcpIdleTimeout))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			received += n
+			tcpBytesTotal.WithLabelValues("received").Add(float64(n))
+			w, werr := conn.Write(buf[:n])
+			sent += w
+			tcpBytesTotal.WithLabelValues("sent").Add(float64(w))
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	tenantSource = flag.String("tenant_source", "", "Where the tenant of a request comes from: header, jwt, or path (empty turns off multi-tenancy)")
+	tenantClaim  = flag.String("tenant_claim", "tenant", "JWT claim naming the tenant when tenant_source is jwt")
+	tenantList   = flag.String("tenants", "", "Tenants and the dogs each one votes among, such as acme=mike,dan,HD;globex=amit,reuben (requests for other tenants are refused)")
+)
+
+// tenantHeader carries the tenant between tiers, and from clients when
+// tenant_source is header.
+const tenantHeader = "x-topdog-tenant"
+
+// tenantPathPrefix starts the paths of a tenant when tenant_source is path,
+// as in /t/acme/query.
+const tenantPathPrefix = "/t/"
+
+var errUnknownTenant = errors.New("unknown tenant")
+
+// parseTenants reads the tenants setting into each tenant's dogs.
+func parseTenants(s string) (map[string][]string, error) {
+	m := make(map[string][]string)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, list, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("%q is not tenant=dog,dog", item)
+		}
+		var td []string
+		for _, d := range strings.Split(list, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			if !isDog("", d) {
+				return nil, fmt.Errorf("tenant %s: unknown dog %q", name, d)
+			}
+			td = append(td, d)
+		}
+		if len(td) == 0 {
+			return nil, fmt.Errorf("tenant %s has no dogs", name)
+		}
+		m[name] = td
+	}
+	return m, nil
+}
+
+var (
+	tenantsOnce sync.Once
+	tenants     map[string][]string
+)
+
+// tenantDogs returns each configured tenant's dogs.
+func tenantDogs() map[string][]string {
+	tenantsOnce.Do(func() {
+		var err error
+		if tenants, err = parseTenants(*tenantList); err != nil {
+			tenants = make(map[string][]string)
+		}
+	})
+	return tenants
+}
+
+// checkTenants verifies the multi-tenancy settings.
+func checkTenants() error {
+	switch *tenantSource {
+	case "":
+		return nil
+	case "header", "jwt", "path":
+	default:
+		return fmt.Errorf("tenant_source %q is not header, jwt, or path", *tenantSource)
+	}
+	m, err := parseTenants(*tenantList)
+	if err != nil {
+		return err
+	}
+	if len(m) == 0 {
+		return errors.New("tenants lists no tenants")
+	}
+	return nil
+}
+
+// dogsFor returns the dogs a tenant votes among; requests without a tenant
+// see all of them.
+func dogsFor(tenant string) []string {
+	if tenant == "" {
+		return dogs
+	}
+	return tenantDogs()[tenant]
+}
+
+// currentTenant returns the tenant of a request, from the configured source,
+// or "" if there is none. The tenant header is only believed when it is the
+// configured source, or on /midtier and /backend, where the tier above sets
+// it; otherwise a caller could pick any tenant by sending it. Even there it
+// can be sent by anyone, so it should be limited by an Istio
+// AuthorizationPolicy, the way a real deployment would rely on the mesh.
+func currentTenant(req *http.Request) string {
+	var t string
+	switch *tenantSource {
+	case "":
+		return ""
+	case "path":
+		t, _ = tenantFromPath(req.URL.Path)
+	case "jwt":
+		t = tenantFromJWT(req)
+	}
+	if t == "" && (*tenantSource == "header" || tierForPath(req.URL.Path) != tierUI) {
+		t = strings.TrimSpace(req.Header.Get(tenantHeader))
+	}
+	return t
+}
+
+// tenantFromPath splits /t/{tenant}/rest into the tenant and /rest.
+func tenantFromPath(path string) (tenant, rest string) {
+	if !strings.HasPrefix(path, tenantPathPrefix) {
+		return "", path
+	}
+	tenant, rest, _ = strings.Cut(strings.TrimPrefix(path, tenantPathPrefix), "/")
+	return tenant, "/" + rest
+}
+
+// tenantFromJWT reads the tenant_claim of the bearer token.
+func tenantFromJWT(req *http.Request) string {
+	t, _ := jwtClaims(req)[*tenantClaim].(string)
+	return strings.TrimSpace(t)
+}
+
+// jwtClaims decodes the claims of the bearer token, or returns nil if there
+// isn't one. The signature is not checked: that is left to an Istio
+// RequestAuthentication, which rejects requests with invalid tokens before
+// they get here.
+func jwtClaims(req *http.Request) map[string]interface{} {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	var claims map[string]interface{}
+	if json.Unmarshal(b, &claims) != nil {
+		return nil
+	}
+	return claims
+}
+
+// tenantBase returns the path prefix of the tenant's pages, so the UI calls
+// back into the same tenant.
+func tenantBase(tenant string) string {
+	if *tenantSource != "path" || tenant == "" {
+		return ""
+	}
+	return tenantPathPrefix + tenant
+}
+
+// routeTenants refuses requests for tenants that aren't configured and, when
+// tenant_source is path, strips the /t/{tenant} prefix before routing.
+func routeTenants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if *tenantSource == "" {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		tenant := getRequestContext(req).Tenant
+		if _, ok := tenantDogs()[tenant]; tenant != "" && !ok {
+			writeError(resp, tierForPath(req.URL.Path), withCode(codeUnknownTenant, http.StatusForbidden, fmt.Errorf("%w %q", errUnknownTenant, tenant)))
+			return
+		}
+		if *tenantSource == "path" && strings.HasPrefix(req.URL.Path, tenantPathPrefix) {
+			_, rest := tenantFromPath(req.URL.Path)
+			r := new(http.Request)
+			*r = *req
+			r.URL = new(url.URL)
+			*r.URL = *req.URL
+			r.URL.Path, r.URL.RawPath = rest, ""
+			req = r
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// storeKey is the key of the request's user in the store. When multi-tenancy
+// is on every key starts with the tenant, even for requests without one, so
+// a user name can't reach into another tenant's data.
+func (rc *requestContext) storeKey() string {
+	if *tenantSource == "" {
+		return rc.User
+	}
+	return rc.Tenant + "/" + rc.User
+}
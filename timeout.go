@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	handlerTimeout = flag.Duration("handler_timeout", 9*time.Second, "Time allowed for a handler to finish before returning 504 (0 disables)")
+	routeTimeouts  = flag.String("route_timeouts", "", "Per-route handler timeouts, such as /backend=2s,/midtier=4s")
+)
+
+// parseRouteTimeouts reads the route_timeouts setting.
+func parseRouteTimeouts(s string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		route, ds, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not route=duration", item)
+		}
+		d, err := time.ParseDuration(ds)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		m[strings.TrimSpace(route)] = d
+	}
+	return m, nil
+}
+
+// routeTimeout returns the handler timeout for a route.
+func routeTimeout(route string) time.Duration {
+	m, err := parseRouteTimeouts(*routeTimeouts)
+	if err == nil {
+		if d, ok := m[route]; ok {
+			return d
+		}
+	}
+	return *handlerTimeout
+}
+
+// timeoutWriter buffers a response so a timed-out handler never sends a partial one.
+type timeoutWriter struct {
+	lock     sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+// withTimeout limits how long the handler for route may run. The response is
+// buffered; if the handler overruns, a 504 problem response is sent instead.
+func withTimeout(route string, next http.Handler) http.Handler {
+	d := routeTimeout(route)
+	if d <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+		req = req.WithContext(ctx)
+		getRequestContext(req).Deadline, _ = ctx.Deadline()
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicChan := make(chan handlerPanic, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					// keep the handler's stack, which re-panicking loses
+					panicChan <- handlerPanic{value: p, stack: debug.Stack()}
+				}
+			}()
+			next.ServeHTTP(tw, req)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			panic(p)
+		case <-done:
+			tw.lock.Lock()
+			defer tw.lock.Unlock()
+			dst := resp.Header()
+			for k, v := range tw.header {
+				dst[k] = v
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			resp.WriteHeader(tw.status)
+			resp.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.lock.Lock()
+			tw.timedOut = true
+			tw.lock.Unlock()
+			writeError(resp, tierForPath(req.URL.Path), withCode(codeHandlerTimeout, http.StatusGatewayTimeout,
+				fmt.Errorf("%s did not finish within %s", req.URL.Path, d)))
+		}
+	})
+}
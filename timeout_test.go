@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func panickingHandler(resp http.ResponseWriter, req *http.Request) {
+	panic("boom")
+}
+
+// TestTimeoutPanicStack checks that a panic under the timeout middleware is
+// logged with the stack of the handler that panicked.
+func TestTimeoutPanicStack(t *testing.T) {
+	var logs bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(old)
+
+	h := recoverPanics(withTimeout("/query", http.HandlerFunc(panickingHandler)))
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/query", nil))
+	if resp.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500", resp.Code)
+	}
+	if !strings.Contains(logs.String(), "panickingHandler") {
+		t.Errorf("logged stack doesn't show the handler:\n%s", logs.String())
+	}
+}
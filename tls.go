@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+var (
+	tlsCert          = flag.String("tls_cert", "", "Certificate file for serving HTTPS on the service port (empty serves plain HTTP)")
+	tlsKey           = flag.String("tls_key", "", "Private key file for tls_cert")
+	tlsWatchInterval = flag.Duration("tls_watch_interval", 10*time.Second, "How often to check tls_cert and tls_key for changes (0 reloads only on SIGHUP)")
+	tlsMinVersion    = flag.String("tls_min_version", "1.2", "Lowest TLS version accepted when serving TLS: 1.0, 1.1, 1.2, or 1.3")
+	tlsCiphers       = flag.String("tls_ciphers", "", "Comma-separated cipher suites allowed for TLS 1.2 and below, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (empty uses Go's defaults)")
+	tlsALPN          = flag.String("tls_alpn", "h2,http/1.1", "Comma-separated ALPN protocols offered when serving TLS; leave out h2 to serve only HTTP/1.1")
+)
+
+// tlsVersions maps the tls_min_version values to versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsPolicy is the protocol policy set by the TLS flags.
+type tlsPolicy struct {
+	minVersion   uint16
+	cipherSuites []uint16 // nil for Go's defaults
+	nextProtos   []string
+	insecure     []string // weak cipher suites that were allowed
+}
+
+// parseTLSPolicy reads the tls_min_version, tls_ciphers, and tls_alpn settings.
+func parseTLSPolicy() (tlsPolicy, error) {
+	var p tlsPolicy
+	var ok bool
+	if p.minVersion, ok = tlsVersions[strings.TrimSpace(*tlsMinVersion)]; !ok {
+		return p, fmt.Errorf("tls_min_version %q is not 1.0, 1.1, 1.2, or 1.3", *tlsMinVersion)
+	}
+	ids := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		ids[c.Name] = c.ID
+	}
+	weak := make(map[string]uint16)
+	for _, c := range tls.InsecureCipherSuites() {
+		weak[c.Name] = c.ID
+	}
+	for _, name := range strings.Split(*tlsCiphers, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if id, ok := ids[name]; ok {
+			p.cipherSuites = append(p.cipherSuites, id)
+		} else if id, ok := weak[name]; ok {
+			p.cipherSuites = append(p.cipherSuites, id)
+			p.insecure = append(p.insecure, name)
+		} else {
+			return p, fmt.Errorf("unknown cipher suite %q", name)
+		}
+	}
+	for _, proto := range strings.Split(*tlsALPN, ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			p.nextProtos = append(p.nextProtos, proto)
+		}
+	}
+	if len(p.nextProtos) == 0 {
+		return p, errors.New("tls_alpn must offer at least one protocol")
+	}
+	return p, nil
+}
+
+// certReloader serves the certificate in a pair of files, reloading it when
+// the files change, as when cert-manager rotates a mounted secret. Each
+// handshake uses the latest certificate, so open connections are unaffected.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // newest of the two files when last loaded
+}
+
+// newCertReloader loads the certificate, failing if it can't be read.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the certificate and key, keeping the current pair on failure.
+func (r *certReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.lock.Unlock()
+	return nil
+}
+
+// filesModTime returns the newest modification time of the two files.
+// Stat follows symlinks, so a Kubernetes secret update is seen too.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// changed reports whether either file changed since it was loaded.
+func (r *certReloader) changed() bool {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return false // probably mid-update; check again later
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return !modTime.Equal(r.modTime)
+}
+
+// reload loads the certificate again and logs the outcome.
+func (r *certReloader) reload(reason string) {
+	if err := r.load(); err != nil {
+		slog.Error("Cannot reload TLS certificate, still serving the previous one", "reason", reason, "err", err)
+		recordEvent(eventTLS, "TLS certificate reload failed (%s): %v", reason, err)
+		return
+	}
+	slog.Info("Reloaded TLS certificate", "reason", reason)
+	recordEvent(eventTLS, "Reloaded TLS certificate (%s)", reason)
+}
+
+// watch reloads the certificate when the files change or on SIGHUP.
+func (r *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if *tlsWatchInterval > 0 {
+		tick = time.NewTicker(*tlsWatchInterval).C
+	}
+	for {
+		select {
+		case <-hup:
+			r.reload("SIGHUP")
+		case <-tick:
+			if r.changed() {
+				r.reload("files changed")
+			}
+		}
+	}
+}
+
+// getCertificate returns the current certificate for a handshake.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// checkTLSFiles verifies that the TLS flags are set together, and that
+// only one source of certificates is used.
+func checkTLSFiles() error {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if *tlsCert != "" && *acmeHosts != "" {
+		return errors.New("use tls_cert or acme_hosts, not both")
+	}
+	return nil
+}
+
+// serverTLSConfig returns the TLS configuration for the service port, with
+// certificates from ACME or from files reloaded as they change, or nil to
+// serve plain HTTP.
+func serverTLSConfig() (*tls.Config, error) {
+	if err := checkTLSFiles(); err != nil {
+		return nil, err
+	}
+	policy, err := parseTLSPolicy()
+	if err != nil {
+		return nil, err
+	}
+	var cfg *tls.Config
+	switch {
+	case *acmeHosts != "":
+		cfg, err = acmeTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		// the TLS challenge needs its own protocol
+		cfg.NextProtos = append(policy.nextProtos, acme.ALPNProto)
+	case *tlsCert != "":
+		r, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		go r.watch()
+		cfg = &tls.Config{GetCertificate: r.getCertificate, NextProtos: policy.nextProtos}
+	default:
+		return nil, nil
+	}
+	cfg.MinVersion = policy.minVersion
+	cfg.CipherSuites = policy.cipherSuites
+	if len(policy.insecure) > 0 {
+		slog.Warn("Allowing insecure cipher suites", "ciphers", policy.insecure)
+	}
+	return cfg, nil
+}
+
+// configureTLS sets up the server to terminate TLS when a certificate is
+// configured. HTTP/2 is turned off unless tls_alpn offers h2.
+func configureTLS(server *http.Server) error {
+	cfg, err := serverTLSConfig()
+	if err != nil || cfg == nil {
+		return err
+	}
+	server.TLSConfig = cfg
+	if !contains(cfg.NextProtos, "h2") {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// seenDownstream is the last response from a downstream tier.
+type seenDownstream struct {
+	Time           time.Time `json:"time"`
+	URL            string    `json:"url"`
+	Status         int       `json:"status,omitempty"`
+	MidtierVersion int       `json:"midtierVersion,omitempty"`
+	BackendVersion int       `json:"backendVersion,omitempty"`
+	Cached         bool      `json:"cached,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// lastSeen keeps the last response from each downstream tier.
+var lastSeen struct {
+	lock    sync.Mutex
+	targets map[string]seenDownstream
+}
+
+// noteDownstreamVersions records a call to a downstream tier, so the
+// versions actually answering can be compared with what was expected.
+func noteDownstreamVersions(target, url string, status int, result *backEndResponse, err error) {
+	s := seenDownstream{Time: time.Now(), URL: url, Status: status}
+	if err != nil {
+		s.Error = err.Error()
+	} else if result != nil {
+		s.MidtierVersion = result.MidtierVersion
+		s.BackendVersion = result.BackendVersion
+		s.Cached = result.cacheHit
+	}
+	lastSeen.lock.Lock()
+	if lastSeen.targets == nil {
+		lastSeen.targets = make(map[string]seenDownstream)
+	}
+	lastSeen.targets[target] = s
+	lastSeen.lock.Unlock()
+}
+
+// topologyTier is one tier as this instance would serve it.
+type topologyTier struct {
+	Tier  string `json:"tier"`
+	Calls string `json:"calls,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Self  bool   `json:"self,omitempty"` // the URL points back at this instance
+
+	Latency  string `json:"latency,omitempty"`  // midtier_behavior delay
+	CacheTTL string `json:"cacheTtl,omitempty"` // midtier_behavior reuse of backend results
+}
+
+// topology describes how this instance's tiers are wired together.
+type topology struct {
+	Version      int                       `json:"version"`
+	Effective    int                       `json:"effective"`
+	VersionLabel string                    `json:"versionLabel"`
+	Commit       string                    `json:"commit"`
+	Pod          map[string]string         `json:"pod,omitempty"`
+	Tenancy      string                    `json:"tenancy,omitempty"`
+	Tiers        []topologyTier            `json:"tiers"`
+	LastSeen     map[string]seenDownstream `json:"lastSeen"`
+}
+
+// pointsAtSelf reports whether a downstream URL is this instance's own
+// service port on a loopback address, as in the single-process setup.
+func pointsAtSelf(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	p := u.Port()
+	if p == "" {
+		p = "80"
+		if u.Scheme == "https" {
+			p = "443"
+		}
+	}
+	if p != strconv.Itoa(*port) {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+// currentTopology snapshots the tier graph as configured on this instance.
+func currentTopology() topology {
+	b := currentBehavior()
+	mid := topologyTier{Tier: tierMidtier, Calls: tierBackend, URL: *backendURL + "/backend", Self: pointsAtSelf(*backendURL)}
+	if *backendGRPC != "" {
+		mid.URL, mid.Self = grpcVoteURL(*backendGRPC, grpcBackendService), false
+	}
+	if b.latency > 0 {
+		mid.Latency = b.latency.String()
+	}
+	if b.cacheTTL > 0 {
+		mid.CacheTTL = b.cacheTTL.String()
+	}
+	t := topology{
+		Version:      *version,
+		Effective:    strategyVersion(),
+		VersionLabel: workloadLabels()["version"],
+		Commit:       binaryBuild().Commit,
+		Pod:          podMetadata(),
+		Tenancy:      *tenantSource,
+		Tiers: []topologyTier{
+			{Tier: tierUI, Calls: tierMidtier, URL: midtierCallURL(), Self: *midtierGRPC == "" && pointsAtSelf(*midtierURL)},
+			mid,
+			{Tier: tierBackend},
+		},
+		LastSeen: make(map[string]seenDownstream),
+	}
+	lastSeen.lock.Lock()
+	for k, v := range lastSeen.targets {
+		t.LastSeen[k] = v
+	}
+	lastSeen.lock.Unlock()
+	return t
+}
+
+// debugTopology shows the configured tier graph and the versions last seen
+// answering downstream, for debugging a miswired demo.
+func debugTopology(resp http.ResponseWriter, req *http.Request) {
+	b, err := json.MarshalIndent(currentTopology(), "", "  ")
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	traceBackend   = flag.String("trace_backend", "otlp", "Where to export spans: otlp or zipkin")
+	otlpEndpoint   = flag.String("otlp_endpoint", "", "OTLP/HTTP collector URL for spans, such as http://otel-collector:4318 (empty disables tracing)")
+	zipkinEndpoint = flag.String("zipkin_endpoint", "", "Zipkin collector URL for spans when trace_backend is zipkin, such as http://zipkin:9411/api/v2/spans (empty disables tracing)")
+)
+
+var tracer = otel.Tracer("github.com/ancientlore/topdog")
+
+// tracingEnabled is set when spans are being exported.
+var tracingEnabled bool
+
+// initTracing starts exporting spans to the configured collector, returning
+// a function that flushes them on shutdown.
+func initTracing() (func(context.Context) error, error) {
+	exporter, endpoint, err := newSpanExporter()
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(appName),
+		semconv.ServiceVersion(fmt.Sprintf("v%d", *version)),
+	}
+	for k, v := range workloadLabels() {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+	otel.SetTracerProvider(tp)
+	tracingEnabled = true
+	slog.Info("Exporting spans", "backend", *traceBackend, "endpoint", endpoint)
+	return tp.Shutdown, nil
+}
+
+// newSpanExporter returns the exporter for trace_backend and its collector
+// URL, or nil when that backend has no collector configured.
+func newSpanExporter() (sdktrace.SpanExporter, string, error) {
+	switch *traceBackend {
+	case "otlp":
+		if *otlpEndpoint == "" {
+			return nil, "", nil
+		}
+		opts, err := otlpOptions(*otlpEndpoint)
+		if err != nil {
+			return nil, "", err
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		return exporter, *otlpEndpoint, err
+	case "zipkin":
+		if *zipkinEndpoint == "" {
+			return nil, "", nil
+		}
+		if err := checkServiceURL(*zipkinEndpoint); err != nil {
+			return nil, "", err
+		}
+		exporter, err := zipkin.New(*zipkinEndpoint)
+		return exporter, *zipkinEndpoint, err
+	}
+	return nil, "", fmt.Errorf("trace_backend %q is not otlp or zipkin", *traceBackend)
+}
+
+// otlpOptions turns the collector URL into exporter options.
+func otlpOptions(endpoint string) ([]otlptracehttp.Option, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", endpoint)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	return opts, nil
+}
+
+// remoteSpanContext turns incoming B3 state into a parent for our spans, so
+// they join the trace Envoy started.
+func remoteSpanContext(c b3Context) trace.SpanContext {
+	tid := c.traceID
+	if len(tid) == 16 {
+		tid = strings.Repeat("0", 16) + tid
+	}
+	var cfg trace.SpanContextConfig
+	tb, err := hex.DecodeString(tid)
+	if err != nil || len(tb) != len(cfg.TraceID) {
+		return trace.SpanContext{}
+	}
+	sb, err := hex.DecodeString(c.spanID)
+	if err != nil || len(sb) != len(cfg.SpanID) {
+		return trace.SpanContext{}
+	}
+	copy(cfg.TraceID[:], tb)
+	copy(cfg.SpanID[:], sb)
+	if c.sampled != "0" {
+		cfg.TraceFlags = trace.FlagsSampled
+	}
+	cfg.Remote = true
+	return trace.NewSpanContext(cfg)
+}
+
+// startServerSpan starts the span for an inbound request to a route, joining
+// the caller's B3 trace, or its W3C trace if it sent no B3 headers.
+func startServerSpan(route, tier string, req *http.Request) (*http.Request, trace.Span) {
+	ctx := req.Context()
+	sc := w3cSpanContext(req.Header)
+	if c, ok := readB3(req.Header); ok {
+		if b3 := remoteSpanContext(c); b3.IsValid() {
+			sc = b3
+		}
+	}
+	if sc.IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, sc)
+	}
+	ctx, span := tracer.Start(ctx, req.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(req.Method),
+			semconv.HTTPRoute(route),
+			attribute.String("topdog.tier", tier),
+		))
+	if sc := span.SpanContext(); sc.IsValid() {
+		getRequestContext(req).noteTraceID(sc.TraceID().String())
+	}
+	return req.WithContext(ctx), span
+}
+
+// endServerSpan records the response status and ends the span.
+func endServerSpan(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPStatusCode(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// startClientSpan starts the span for a call to a downstream tier. The
+// returned request carries the span, so copyB3 sends it as the parent.
+func startClientSpan(tier, target, url string, req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(req.Context(), "GET "+target,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethod(http.MethodGet),
+			semconv.HTTPURL(url),
+			attribute.String("topdog.tier", tier),
+			attribute.String("topdog.target", target),
+		))
+	return req.WithContext(ctx), span
+}
+
+// endClientSpan records the downstream outcome and ends the span.
+func endClientSpan(span trace.Span, status int, err error) {
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+	}
+	if err != nil {
+		code, _ := errorCode(err)
+		span.SetAttributes(attribute.String("topdog.error_code", code))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, code)
+	}
+	span.End()
+}
+
+// b3FromSpan updates B3 state to make a local span the parent of the
+// downstream request, keeping the incoming trace ID as written.
+func b3FromSpan(c b3Context, sc trace.SpanContext) b3Context {
+	if c.traceID == "" {
+		c.traceID = sc.TraceID().String()
+	}
+	c.parentSpanID = c.spanID
+	c.spanID = sc.SpanID().String()
+	if c.sampled != "d" {
+		c.sampled = "0"
+		if sc.IsSampled() {
+			c.sampled = "1"
+		}
+	}
+	return c
+}
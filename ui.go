@@ -1,48 +1,198 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"sync"
 )
 
 var (
-	once sync.Once
-	tpl  *template.Template
+	once   sync.Once
+	tpl    *template.Template
+	tplErr error
 )
 
-func ui(resp http.ResponseWriter, req *http.Request) {
+// loadTemplates parses the HTML templates the first time they are needed.
+func loadTemplates() (*template.Template, error) {
 	once.Do(func() {
-		tpl = template.Must(template.ParseGlob(filepath.Join(*staticPath, "*.html")))
-		log.Print("Loaded templates")
+		tpl, tplErr = template.ParseGlob(filepath.Join(*staticPath, "*.html"))
+		if tplErr != nil {
+			slog.Error("Cannot load templates", "err", tplErr)
+			return
+		}
+		slog.Info("Loaded templates")
 	})
+	return tpl, tplErr
+}
+
+func ui(resp http.ResponseWriter, req *http.Request) {
+	tpl, err := loadTemplates()
+	if err != nil {
+		writeErrorPage(resp, req, tierUI, withCode(codeTemplateFailed, http.StatusInternalServerError, err))
+		return
+	}
+	// uptime checks and load balancers probe with HEAD, which only needs
+	// to know the page would render
+	if req.Method == http.MethodHead {
+		resp.Header().Set("Content-type", "text/html; charset=utf-8")
+		return
+	}
+	// render to a buffer so a failure doesn't leave a half-written page
+	var buf bytes.Buffer
+	name := uiTemplate(tpl, *version)
+	err = tpl.ExecuteTemplate(&buf, name, uiData(getRequestContext(req).TraceID(), getRequestContext(req).Tenant))
+	if err != nil {
+		requestLogger(req).Error("Cannot render template", "template", name, "path", req.URL.Path, "client", clientIP(req), "err", err)
+		writeErrorPage(resp, req, tierUI, withCode(codeTemplateFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "text/html; charset=utf-8")
+	_, err = resp.Write(buf.Bytes())
+	if err != nil {
+		requestLogger(req).Error("Write failure", "err", err)
+	}
+}
+
+// uiData returns the data used to render index.html. The page shows only the
+// tenant's dogs, and Base keeps its calls within the tenant's path.
+func uiData(traceID, tenant string) map[string]interface{} {
 	d := make(map[string]interface{})
-	d["Dogs"] = dogs
+	d["Dogs"] = dogsFor(tenant)
+	d["Base"] = tenantBase(tenant)
 	d["Midtier"] = *midtierURL
 	d["Backend"] = *backendURL
 	d["ServicePort"] = *port
 	d["Version"] = *version
-	tpl.ExecuteTemplate(resp, "index.html", d)
+	d["TraceID"] = traceID
+	d["TraceURL"] = *traceURL
+	d["Theme"] = uiThemes[*version]
+	d["ShowTally"] = *version >= 2
+	return d
+}
+
+// traceLink returns the trace_url link for a trace ID, or "" if trace_url
+// is not set.
+func traceLink(traceID string) string {
+	if *traceURL == "" || traceID == "" {
+		return ""
+	}
+	return strings.ReplaceAll(*traceURL, "{traceId}", traceID)
+}
+
+// uiThemes maps UI versions to the CSS class of the page body.
+var uiThemes = map[int]string{
+	1: "classic",
+	2: "dark",
+	3: "dark",
+}
+
+// uiTemplate returns the page template for a UI version: index-vN.html if
+// present, otherwise index.html.
+func uiTemplate(t *template.Template, v int) string {
+	name := fmt.Sprintf("index-v%d.html", v)
+	if t.Lookup(name) != nil {
+		return name
+	}
+	return "index.html"
 }
 
 func jsonQuery(resp http.ResponseWriter, req *http.Request) {
-	result, err := queryDownstreamService(*midtierURL+"/midtier", req)
+	req = withTraceIDs(req)
+	if id := getRequestContext(req).TraceID(); id != "" {
+		resp.Header().Set(traceIDHeader, id)
+	}
+	if headVote(resp, req) {
+		return
+	}
+	result, err := queryDownstreamService(tierUI, tierMidtier, midtierCallURL(), withFavorite(req))
+	if err == nil {
+		result.TopDog, err = decryptField(result.TopDog)
+	}
+	noteDownstream(req, describeResult(result, err))
+	recordResult(req, result, err)
 	if err != nil {
-		log.Print("Cannot query midtier service: ", err)
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		requestLogger(req).Error("Cannot query midtier service", "err", err)
+		writeErrorPage(resp, req, tierUI, err)
 		return
 	}
+	tallyResult(result)
 	result.UIVersion = *version
-	b, err := json.Marshal(result)
+	rc := getRequestContext(req)
+	result.TraceID = rc.TraceID()
+	result.RequestID = rc.RequestID
+	result.UIMillis = elapsedMillis(req)
+	schema := negotiateSchema(req)
+	b, err := marshalResponse(result, schema)
 	if err != nil {
-		log.Print("Cannot marshal JSON: ", err)
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		requestLogger(req).Error("Cannot marshal JSON", "err", err)
+		writeErrorPage(resp, req, tierUI, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+
+	setSchemaHeaders(resp, schema)
+	setRetryHeaders(resp, result)
+	setCacheHeaders(resp, result)
+	setServerTiming(resp, req, tierUI, result)
+	resp.Write(setChecksum(resp, b))
+}
+
+// errorPageData is passed to the error template.
+type errorPageData struct {
+	Tier      string
+	Version   int
+	Status    int
+	Title     string
+	Code      string
+	Detail    string
+	RequestID string
+	TraceID   string
+	TraceURL  string // link to the trace, if trace_url is set
+	RetryURL  string
+}
+
+// writeErrorPage renders the error template for browsers, and falls back to a
+// problem+json response for other clients or if the template is unavailable.
+func writeErrorPage(resp http.ResponseWriter, req *http.Request, tier string, err error) {
+	if !acceptsHTML(req) {
+		writeError(resp, tier, err)
+		return
+	}
+	t, terr := loadTemplates()
+	if terr != nil || t.Lookup("error.html") == nil {
+		writeError(resp, tier, err)
 		return
 	}
+	code, status := errorCode(err)
+	d := errorPageData{
+		Tier:      tier,
+		Version:   *version,
+		Status:    status,
+		Title:     http.StatusText(status),
+		Code:      code,
+		Detail:    err.Error(),
+		RequestID: getRequestContext(req).RequestID,
+		TraceID:   getRequestContext(req).TraceID(),
+		RetryURL:  req.URL.RequestURI(),
+	}
+	d.TraceURL = traceLink(d.TraceID)
+	var buf bytes.Buffer
+	if terr = t.ExecuteTemplate(&buf, "error.html", &d); terr != nil {
+		requestLogger(req).Error("Cannot render error page", "err", terr)
+		writeError(resp, tier, err)
+		return
+	}
+	resp.Header().Set("Content-type", "text/html; charset=utf-8")
+	resp.Header().Set(errorCodeHeader, code)
+	resp.WriteHeader(status)
+	resp.Write(buf.Bytes())
+}
 
-	resp.Header().Set("Content-type", "application/json")
-	resp.Write(b)
+// acceptsHTML reports whether the client prefers an HTML page, as a browser does.
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
 }
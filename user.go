@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	userHeader     = "x-user"
+	userCookie     = "user"
+	favoriteHeader = "x-topdog-favorite"
+)
+
+var favoriteBias = flag.Float64("favorite_bias", 0, "Chance (0 to 1) that the backend picks the user's favorite dog instead of voting")
+
+// currentUser identifies the user from the x-user header or the user cookie.
+func currentUser(req *http.Request) string {
+	if u := strings.TrimSpace(req.Header.Get(userHeader)); u != "" {
+		return u
+	}
+	if c, err := req.Cookie(userCookie); err == nil {
+		return strings.TrimSpace(c.Value)
+	}
+	return ""
+}
+
+// isDog reports whether name is one of the tenant's dogs, or of all the dogs
+// for an empty tenant.
+func isDog(tenant, name string) bool {
+	for _, d := range dogsFor(tenant) {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withFavorite returns a copy of req carrying the user's favorite dog for the
+// backend. Clients can't supply the favorite header themselves.
+func withFavorite(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Del(favoriteHeader)
+	rc := getRequestContext(req)
+	if rc.User == "" {
+		return r
+	}
+	s, err := getStore()
+	if err != nil {
+		return r
+	}
+	dog, err := s.Favorite(rc.storeKey())
+	if err != nil {
+		requestLogger(req).Error("Cannot read favorite", "err", err)
+		return r
+	}
+	if dog != "" {
+		r.Header.Set(favoriteHeader, dog)
+	}
+	return r
+}
+
+// biasVote sometimes replaces the vote with the user's favorite dog.
+func biasVote(req *http.Request, rnd *rand.Rand, dog string) string {
+	fav := req.Header.Get(favoriteHeader)
+	if *favoriteBias <= 0 || fav == "" || !isDog(getRequestContext(req).Tenant, fav) {
+		return dog
+	}
+	if rnd.Float64() < *favoriteBias {
+		return fav
+	}
+	return dog
+}
+
+type favoriteResponse struct {
+	User     string `json:"user"`
+	Favorite string `json:"favorite"`
+}
+
+// favoriteAPI reads, sets, or clears the current user's favorite dog.
+func favoriteAPI(resp http.ResponseWriter, req *http.Request) {
+	rc := getRequestContext(req)
+	user, key := rc.User, rc.storeKey()
+	if user == "" {
+		writeError(resp, tierUI, withCode(codeNoUser, http.StatusUnauthorized, errors.New("set the x-user header or user cookie")))
+		return
+	}
+	s, err := getStore()
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Dog string `json:"dog"`
+		}
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			err = json.NewDecoder(req.Body).Decode(&body)
+			if err != nil {
+				writeError(resp, tierUI, withCode(codeBadRequest, http.StatusBadRequest, err))
+				return
+			}
+		} else {
+			body.Dog = req.FormValue("dog")
+		}
+		if !isDog(rc.Tenant, body.Dog) {
+			writeError(resp, tierUI, withCode(codeBadRequest, http.StatusBadRequest, errors.New("unknown dog "+body.Dog)))
+			return
+		}
+		err = s.SetFavorite(key, body.Dog)
+		if err == nil {
+			err = s.AddHistory(key, historyEntry{Time: time.Now(), Kind: historyVote, Dog: body.Dog})
+		}
+	case http.MethodDelete:
+		err = s.SetFavorite(key, "")
+	default:
+		resp.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		writeError(resp, tierUI, withCode(codeBadRequest, http.StatusMethodNotAllowed, errors.New(req.Method+" not allowed")))
+		return
+	}
+	if err != nil {
+		requestLogger(req).Error("Cannot update favorite", "err", err)
+		writeError(resp, tierUI, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+
+	dog, err := s.Favorite(key)
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	b, err := json.Marshal(&favoriteResponse{User: user, Favorite: dog})
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Write(b)
+}
+
+// recordResult adds a /query outcome to the user's history.
+func recordResult(req *http.Request, result *backEndResponse, err error) {
+	rc := getRequestContext(req)
+	if rc.User == "" {
+		return
+	}
+	s, serr := getStore()
+	if serr != nil {
+		return
+	}
+	e := historyEntry{Time: time.Now(), Kind: historyResult}
+	if err != nil {
+		e.ErrorCode, _ = errorCode(err)
+	} else {
+		e.Dog = result.TopDog
+		e.BackendVersion = result.BackendVersion
+	}
+	if serr = s.AddHistory(rc.storeKey(), e); serr != nil {
+		requestLogger(req).Error("Cannot record history", "err", serr)
+	}
+}
+
+type historyResponse struct {
+	User    string         `json:"user"`
+	Results []historyEntry `json:"results"`
+	Votes   []historyEntry `json:"votes"`
+	Counts  map[string]int `json:"counts"` // results per dog
+}
+
+// historyAPI returns the current user's recent results and votes.
+func historyAPI(resp http.ResponseWriter, req *http.Request) {
+	rc := getRequestContext(req)
+	user := rc.User
+	if user == "" {
+		writeError(resp, tierUI, withCode(codeNoUser, http.StatusUnauthorized, errors.New("set the x-user header or user cookie")))
+		return
+	}
+	s, err := getStore()
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	h, err := s.History(rc.storeKey())
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeStoreFailed, http.StatusInternalServerError, err))
+		return
+	}
+	r := historyResponse{
+		User:    user,
+		Results: []historyEntry{},
+		Votes:   []historyEntry{},
+		Counts:  make(map[string]int),
+	}
+	for _, e := range h {
+		switch e.Kind {
+		case historyResult:
+			r.Results = append(r.Results, e)
+			if e.Dog != "" {
+				r.Counts[e.Dog]++
+			}
+		case historyVote:
+			r.Votes = append(r.Votes, e)
+		}
+	}
+	b, err := json.Marshal(&r)
+	if err != nil {
+		writeError(resp, tierUI, withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// validation is a named configuration check run by -validate.
+type validation struct {
+	name  string
+	check func() error
+}
+
+var validations = []validation{
+	{"static files", checkStaticFiles},
+	{"templates", checkTemplates},
+	{"logging", func() error {
+		if _, err := newLogHandler(io.Discard); err != nil {
+			return err
+		}
+		if err := checkLogFile(); err != nil {
+			return err
+		}
+		if err := checkSyslog(); err != nil {
+			return err
+		}
+		return checkOTLPLogs()
+	}},
+	{"service port", func() error {
+		if *port < 1 || *port > 65535 {
+			return fmt.Errorf("%d is not a valid port", *port)
+		}
+		return nil
+	}},
+	{"admin port", func() error {
+		if *adminPort == 0 {
+			return nil
+		}
+		if *adminPort < 0 || *adminPort > 65535 {
+			return fmt.Errorf("%d is not a valid port", *adminPort)
+		}
+		if *adminPort == *port {
+			return errors.New("must differ from service_port")
+		}
+		return nil
+	}},
+	{"dependency", func() error {
+		if *dependencyErrorRate < 0 || *dependencyErrorRate > 1 {
+			return fmt.Errorf("dependency_error_rate %g is not between 0 and 1", *dependencyErrorRate)
+		}
+		if *dependencyURL == "" {
+			return nil
+		}
+		u, err := url.Parse(*dependencyURL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("dependency_url %q is not an http or https URL", *dependencyURL)
+		}
+		return nil
+	}},
+	{"external url", func() error {
+		if *externalURL == "" {
+			return nil
+		}
+		u, err := url.Parse(*externalURL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("external_url %q is not an http or https URL", *externalURL)
+		}
+		return nil
+	}},
+	{"tcp port", func() error {
+		if *tcpPort == 0 {
+			return nil
+		}
+		if *tcpPort < 0 || *tcpPort > 65535 {
+			return fmt.Errorf("%d is not a valid port", *tcpPort)
+		}
+		if *tcpPort == *port || *tcpPort == *adminPort {
+			return errors.New("must differ from service_port and admin_port")
+		}
+		return nil
+	}},
+	{"udp heartbeats", func() error {
+		if *udpPort < 0 || *udpPort > 65535 {
+			return fmt.Errorf("%d is not a valid port", *udpPort)
+		}
+		if *heartbeatInterval <= 0 {
+			return errors.New("heartbeat_interval must be positive")
+		}
+		if *heartbeatTarget == "" {
+			return nil
+		}
+		_, _, err := net.SplitHostPort(*heartbeatTarget)
+		return err
+	}},
+	{"warmup", func() error {
+		if *warmupDuration < 0 || *warmupDelay < 0 {
+			return errors.New("warmup and warmup_delay must not be negative")
+		}
+		return nil
+	}},
+	{"gzip", checkGzip},
+	{"images", checkImages},
+	{"tenants", checkTenants},
+	{"authz policy", checkAuthzPolicy},
+	{"delay profile", func() error { return checkDelayProfile(*delayProfileFlag) }},
+	{"error profile", func() error { return checkErrorProfile(*errorProfileFlag) }},
+	{"metrics routes", checkMetricsRoutes},
+	{"slo windows", checkSLOWindows},
+	{"backup", checkBackup},
+	{"profile push", checkProfilePush},
+	{"remote write", checkRemoteWrite},
+	{"listen address", func() error {
+		_, err := parseListenAddresses(*listenAddress, *port)
+		return err
+	}},
+	{"tls certificate", func() error {
+		if err := checkTLSFiles(); err != nil || *tlsCert == "" {
+			return err
+		}
+		_, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		return err
+	}},
+	{"tls policy", func() error {
+		_, err := parseTLSPolicy()
+		return err
+	}},
+	{"acme hosts", func() error {
+		_, err := parseACMEHosts(*acmeHosts)
+		return err
+	}},
+	{"version", func() error {
+		if *version < 1 || *version > 3 {
+			return fmt.Errorf("%d is not 1, 2, or 3", *version)
+		}
+		return nil
+	}},
+	{"backend URL", func() error { return checkServiceURL(*backendURL) }},
+	{"backend gRPC", func() error { return checkGRPCAddr(*backendGRPC) }},
+	{"midtier URL", func() error { return checkServiceURL(*midtierURL) }},
+	{"midtier gRPC", func() error { return checkGRPCAddr(*midtierGRPC) }},
+	{"schema", func() error {
+		if _, ok := parseSchema(fmt.Sprint(*defaultSchema)); !ok {
+			return fmt.Errorf("%d is not a supported schema version", *defaultSchema)
+		}
+		return nil
+	}},
+	{"B3 format", func() error {
+		switch *b3Format {
+		case b3Multi, b3Single, b3Both:
+			return nil
+		}
+		return fmt.Errorf("%q is not multi, single, or both", *b3Format)
+	}},
+	{"trace URL", func() error {
+		if *traceURL == "" {
+			return nil
+		}
+		if !strings.Contains(*traceURL, "{traceId}") {
+			return errors.New("missing {traceId} placeholder")
+		}
+		return checkServiceURL(strings.ReplaceAll(*traceURL, "{traceId}", "x"))
+	}},
+	{"trace exporter", func() error {
+		switch *traceBackend {
+		case "otlp":
+			if *otlpEndpoint == "" {
+				return nil
+			}
+			_, err := otlpOptions(*otlpEndpoint)
+			return err
+		case "zipkin":
+			if *zipkinEndpoint == "" {
+				return nil
+			}
+			return checkServiceURL(*zipkinEndpoint)
+		}
+		return fmt.Errorf("trace_backend %q is not otlp or zipkin", *traceBackend)
+	}},
+	{"settings file", func() error {
+		if *settingsFile == "" {
+			return nil
+		}
+		_, _, err := readSettingsFile()
+		return err
+	}},
+	{"scenario", func() error {
+		if *scenarioFile == "" {
+			return nil
+		}
+		_, err := loadScenario()
+		return err
+	}},
+	{"readiness", func() error {
+		if _, err := readinessURL(); err != nil {
+			return err
+		}
+		if *readinessInterval <= 0 {
+			return errors.New("readiness_interval must be positive")
+		}
+		if *readinessFailures < 1 || *readinessSuccesses < 1 {
+			return errors.New("readiness_failures and readiness_successes must be at least 1")
+		}
+		return nil
+	}},
+	{"backend override hosts", func() error {
+		for _, h := range strings.Split(*backendOverrideHosts, ",") {
+			if strings.Contains(h, "/") {
+				return fmt.Errorf("%q should be a host or host:port, not a URL", strings.TrimSpace(h))
+			}
+		}
+		return nil
+	}},
+	{"corrupt rate", func() error {
+		if *corruptRate < 0 || *corruptRate > 1 {
+			return fmt.Errorf("%g is not between 0 and 1", *corruptRate)
+		}
+		return nil
+	}},
+	{"field key", func() error {
+		_, err := getFieldCipher()
+		return err
+	}},
+	{"middleware", func() error {
+		_, err := parseChains(*middlewareChains)
+		return err
+	}},
+	{"retry after max", func() error {
+		if *retryAfterMax < 0 {
+			return errors.New("must not be negative")
+		}
+		return nil
+	}},
+	{"handler timeouts", func() error {
+		_, err := parseRouteTimeouts(*routeTimeouts)
+		if err != nil {
+			return err
+		}
+		if *handlerTimeout < 0 {
+			return errors.New("handler_timeout must not be negative")
+		}
+		return nil
+	}},
+	{"trusted proxies", func() error {
+		_, err := parseCIDRs(*trustedProxies)
+		return err
+	}},
+	{"rng", func() error {
+		if *rngMode != "pooled" && *rngMode != "crypto" {
+			return fmt.Errorf("%q is not pooled or crypto", *rngMode)
+		}
+		return nil
+	}},
+	{"weights", func() error {
+		tables, err := parseWeights(*weights)
+		if err != nil {
+			return err
+		}
+		for v := 1; v <= 3; v++ {
+			if _, err := samplerFor(tables, v, dogs); err != nil {
+				return fmt.Errorf("version %d: %w", v, err)
+			}
+			for tenant, td := range tenantDogs() {
+				if _, err := samplerFor(tables, v, td); err != nil {
+					return fmt.Errorf("tenant %s, version %d: %w", tenant, v, err)
+				}
+			}
+		}
+		return nil
+	}},
+	{"midtier behavior", func() error {
+		_, err := parseBehaviors(*midtierBehavior)
+		return err
+	}},
+	{"store", func() error {
+		_, err := openStore()
+		return err
+	}},
+	{"favorite bias", func() error {
+		if *favoriteBias < 0 || *favoriteBias > 1 {
+			return fmt.Errorf("%g is not between 0 and 1", *favoriteBias)
+		}
+		return nil
+	}},
+	{"statsd address", func() error {
+		if *statsdAddr == "" {
+			return nil
+		}
+		_, _, err := net.SplitHostPort(*statsdAddr)
+		return err
+	}},
+	{"telemetry labels", func() error {
+		m, err := parseLabels(*extraLabels)
+		if err != nil {
+			return err
+		}
+		for k := range m {
+			if k == "app" || k == "version" {
+				return fmt.Errorf("use -app or -version_label to set %q", k)
+			}
+		}
+		return nil
+	}},
+	{"recent requests", func() error {
+		if *recentRequestCount < 0 {
+			return errors.New("must not be negative")
+		}
+		return nil
+	}},
+}
+
+// checkServiceURL verifies that s is an absolute http or https URL.
+func checkServiceURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q must use http or https", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", s)
+	}
+	return nil
+}
+
+// validateConfig runs all validations, writes a report, and returns whether they passed.
+func validateConfig(w io.Writer) bool {
+	ok := true
+	for _, v := range validations {
+		err := v.check()
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "FAIL  %-20s %s\n", v.name, err)
+		} else {
+			fmt.Fprintf(w, "ok    %s\n", v.name)
+		}
+	}
+	if ok {
+		fmt.Fprintln(w, "Configuration is valid.")
+	} else {
+		fmt.Fprintln(w, "Configuration has problems.")
+	}
+	return ok
+}
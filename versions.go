@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// versionMemory is how many version changes /events keeps.
+const versionMemory = 1000
+
+// Where a version came from.
+const (
+	sourceDefault      = "default"
+	sourceFlag         = "flag"
+	sourceEnv          = "env"
+	sourceAdmin        = "admin"
+	sourceScenario     = "scenario"
+	sourceSettingsFile = "settings file"
+)
+
+// versionChange is a change to the version whose behavior this instance
+// serves. Version is the version flag, which only changes on restart;
+// Effective is the voting strategy in effect, which the admin API, a
+// scenario, or the settings file can override.
+type versionChange struct {
+	Time      time.Time `json:"time"`
+	Version   int       `json:"version"`
+	Effective int       `json:"effective"`
+	Previous  int       `json:"previous,omitempty"` // zero at startup
+	Source    string    `json:"source"`
+}
+
+// versionLog keeps the most recent version changes.
+var versionLog struct {
+	lock    sync.Mutex
+	changes []versionChange
+}
+
+// versionFlagSource reports whether the version came from the command line,
+// the VERSION environment variable, or the default. Call it after flag.Parse
+// and before flagenv.Parse, which makes env values look like flags.
+func versionFlagSource() string {
+	source := sourceDefault
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "version" {
+			source = sourceFlag
+		}
+	})
+	if _, ok := os.LookupEnv("VERSION"); ok && source == sourceDefault {
+		source = sourceEnv
+	}
+	return source
+}
+
+// recordVersionChange adds a change to the version log and the lifecycle
+// event log.
+func recordVersionChange(previous, effective int, source string) {
+	c := versionChange{Time: time.Now(), Version: *version, Effective: effective, Previous: previous, Source: source}
+	versionLog.lock.Lock()
+	versionLog.changes = append(versionLog.changes, c)
+	if len(versionLog.changes) > versionMemory {
+		versionLog.changes = versionLog.changes[len(versionLog.changes)-versionMemory:]
+	}
+	versionLog.lock.Unlock()
+	if previous == 0 {
+		recordEvent(eventVersion, "Started as version %d (%s)", effective, source)
+	} else {
+		recordEvent(eventVersion, "Version %d behavior changed to version %d (%s)", previous, effective, source)
+	}
+}
+
+// setStrategy overrides the voting strategy, recording a version change
+// when the behavior in effect differs afterward.
+func setStrategy(ctx context.Context, v int, source string) {
+	previous := strategyVersion()
+	voteStrategy.Store(int32(v))
+	if effective := strategyVersion(); effective != previous {
+		contextLogger(ctx).Info("Effective version changed", "previous", previous, "effective", effective, "source", source)
+		recordVersionChange(previous, effective, source)
+	}
+}
+
+// versionEvents lists the version changes, oldest first, so traffic shifts
+// can be lined up with metric changes after a demo.
+func versionEvents(resp http.ResponseWriter, req *http.Request) {
+	versionLog.lock.Lock()
+	changes := append([]versionChange{}, versionLog.changes...)
+	versionLog.lock.Unlock()
+	b, err := json.Marshal(changes)
+	if err != nil {
+		writeError(resp, tierForPath(req.URL.Path), withCode(codeEncodeFailed, http.StatusInternalServerError, err))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(b)
+}
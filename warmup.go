@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	warmupDuration = flag.Duration("warmup", 0, "How long the backend takes to warm up after starting, slowing early requests (0 starts at full speed)")
+	warmupDelay    = flag.Duration("warmup_delay", 500*time.Millisecond, "Delay added to backend requests at the start of warmup, falling to nothing by its end")
+)
+
+// warmupStart is when the service started listening, in Unix nanoseconds.
+var warmupStart atomic.Int64
+
+// startWarmup begins the warmup period. /readyz passes throughout, as it
+// would for a JVM or a cold cache, which is what Envoy's slow start is for.
+func startWarmup() {
+	warmupStart.Store(time.Now().UnixNano())
+	if *warmupDuration > 0 {
+		slog.Info("Warming up", "duration", warmupDuration.String(), "delay", warmupDelay.String())
+		recordEvent(eventStartup, "Warming up for %s", *warmupDuration)
+	}
+}
+
+// currentWarmupDelay returns the delay for a request now, which shrinks
+// linearly from warmup_delay to zero over the warmup period.
+func currentWarmupDelay() time.Duration {
+	start := warmupStart.Load()
+	if *warmupDuration <= 0 || start == 0 {
+		return 0
+	}
+	left := *warmupDuration - time.Since(time.Unix(0, start))
+	if left <= 0 {
+		return 0
+	}
+	return time.Duration(float64(*warmupDelay) * float64(left) / float64(*warmupDuration))
+}
+
+// waitForWarmup delays a backend request while warming up.
+func waitForWarmup(req *http.Request) {
+	d := currentWarmupDelay()
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-req.Context().Done():
+	}
+}
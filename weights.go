@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var weights = flag.String("weights", "1:mike=5;3:amit=3,dan=5,mike=2,prashanth=2,reuben=2", "Per-version vote weights, as version:dog=weight,... separated by semicolons; unlisted dogs weigh 1")
+
+// aliasSampler picks items in proportion to their weights in constant time
+// using Vose's alias method.
+type aliasSampler struct {
+	items []string
+	prob  []float64
+	alias []int
+}
+
+// newAliasSampler builds a sampler for items with the given weights.
+func newAliasSampler(items []string, w []float64) (*aliasSampler, error) {
+	n := len(items)
+	if n == 0 || n != len(w) {
+		return nil, errors.New("need one weight per item")
+	}
+	var total float64
+	for i, x := range w {
+		if x < 0 {
+			return nil, fmt.Errorf("weight for %s is negative", items[i])
+		}
+		total += x
+	}
+	if total <= 0 {
+		return nil, errors.New("weights must not all be zero")
+	}
+
+	s := &aliasSampler{
+		items: items,
+		prob:  make([]float64, n),
+		alias: make([]int, n),
+	}
+	scaled := make([]float64, n)
+	var small, large []int
+	for i, x := range w {
+		scaled[i] = x * float64(n) / total
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+	for len(small) > 0 && len(large) > 0 {
+		l := small[len(small)-1]
+		small = small[:len(small)-1]
+		g := large[len(large)-1]
+		large = large[:len(large)-1]
+		s.prob[l] = scaled[l]
+		s.alias[l] = g
+		scaled[g] = scaled[g] + scaled[l] - 1
+		if scaled[g] < 1 {
+			small = append(small, g)
+		} else {
+			large = append(large, g)
+		}
+	}
+	// leftovers are 1 apart from rounding error
+	for _, i := range append(small, large...) {
+		s.prob[i] = 1
+	}
+	return s, nil
+}
+
+// sample returns a random item.
+func (s *aliasSampler) sample(r *rand.Rand) string {
+	i := r.Intn(len(s.items))
+	if r.Float64() < s.prob[i] {
+		return s.items[i]
+	}
+	return s.items[s.alias[i]]
+}
+
+// parseWeights reads the weights setting into per-version weight tables.
+func parseWeights(s string) (map[int]map[string]float64, error) {
+	known := make(map[string]bool)
+	for _, d := range dogs {
+		known[d] = true
+	}
+	m := make(map[int]map[string]float64)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		vs, list, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not version:dog=weight", entry)
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(vs))
+		if err != nil {
+			return nil, fmt.Errorf("%q: bad version: %w", entry, err)
+		}
+		table := make(map[string]float64)
+		for _, item := range strings.Split(list, ",") {
+			dog, ws, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				return nil, fmt.Errorf("%q is not dog=weight", item)
+			}
+			if !known[dog] {
+				return nil, fmt.Errorf("%q: unknown dog %q", entry, dog)
+			}
+			x, err := strconv.ParseFloat(ws, 64)
+			if err != nil || x < 0 {
+				return nil, fmt.Errorf("%q: bad weight %q", entry, ws)
+			}
+			table[dog] = x
+		}
+		m[v] = table
+	}
+	return m, nil
+}
+
+// samplerFor builds the sampler for a version from its weight table, over
+// the given dogs.
+func samplerFor(tables map[int]map[string]float64, v int, dogs []string) (*aliasSampler, error) {
+	w := make([]float64, len(dogs))
+	for i, d := range dogs {
+		w[i] = 1
+		if x, ok := tables[v][d]; ok {
+			w[i] = x
+		}
+	}
+	return newAliasSampler(dogs, w)
+}
+
+var (
+	samplerOnce sync.Once
+	samplerMu   sync.RWMutex
+	samplers    = make(map[int]*aliasSampler)
+	weightSpec  string // the weights currently in use
+)
+
+// buildSamplers makes a sampler for each version from a weights setting.
+func buildSamplers(spec string) (map[int]*aliasSampler, error) {
+	tables, err := parseWeights(spec)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[int]*aliasSampler)
+	for _, ver := range []int{1, 2, 3} {
+		s, err := samplerFor(tables, ver, dogs)
+		if err != nil {
+			return nil, fmt.Errorf("version %d: %w", ver, err)
+		}
+		m[ver] = s
+	}
+	return m, nil
+}
+
+// versionSampler returns the sampler for a backend version, falling back to
+// equal weights if the configuration is invalid.
+func versionSampler(v int) *aliasSampler {
+	samplerOnce.Do(func() {
+		m, err := buildSamplers(*weights)
+		if err != nil {
+			slog.Error("Invalid weights", "err", err)
+			m, _ = buildSamplers("")
+		}
+		samplerMu.Lock()
+		samplers, weightSpec = m, *weights
+		samplerMu.Unlock()
+	})
+	samplerMu.RLock()
+	defer samplerMu.RUnlock()
+	s, ok := samplers[v]
+	if !ok {
+		return samplers[1]
+	}
+	return s
+}
+
+// setWeights replaces the vote weights at runtime, logging the change
+// against the request that made it, if any.
+func setWeights(ctx context.Context, spec string) error {
+	m, err := buildSamplers(spec)
+	if err != nil {
+		return err
+	}
+	versionSampler(1) // make sure the configured weights don't overwrite these
+	samplerMu.Lock()
+	samplers, weightSpec = m, spec
+	samplerMu.Unlock()
+	contextLogger(ctx).Info("Weights set", "weights", spec)
+	return nil
+}
+
+// tenantSamplers caches the samplers of each tenant's dogs, built from the
+// weights in use when they were made.
+var tenantSamplers struct {
+	lock     sync.Mutex
+	spec     string
+	samplers map[string]*aliasSampler
+}
+
+// tenantSampler returns the sampler for a backend version over a tenant's
+// dogs, keeping their relative weights, or versionSampler(v) for no tenant.
+func tenantSampler(tenant string, v int) *aliasSampler {
+	if tenant == "" {
+		return versionSampler(v)
+	}
+	spec := currentWeights()
+	key := fmt.Sprintf("%s|%d", tenant, v)
+	tenantSamplers.lock.Lock()
+	defer tenantSamplers.lock.Unlock()
+	if tenantSamplers.spec != spec || tenantSamplers.samplers == nil {
+		tenantSamplers.spec, tenantSamplers.samplers = spec, make(map[string]*aliasSampler)
+	}
+	if s, ok := tenantSamplers.samplers[key]; ok {
+		return s
+	}
+	tables, err := parseWeights(spec)
+	if err == nil {
+		var s *aliasSampler
+		if s, err = samplerFor(tables, v, dogsFor(tenant)); err == nil {
+			tenantSamplers.samplers[key] = s
+			return s
+		}
+	}
+	// the tenant's dogs may all weigh nothing; vote among them equally
+	slog.Warn("Cannot weigh tenant's dogs", "tenant", tenant, "version", v, "err", err)
+	s, err := samplerFor(nil, v, dogsFor(tenant))
+	if err != nil {
+		return versionSampler(v)
+	}
+	tenantSamplers.samplers[key] = s
+	return s
+}
+
+// currentWeights returns the weights setting in use.
+func currentWeights() string {
+	versionSampler(1)
+	samplerMu.RLock()
+	defer samplerMu.RUnlock()
+	return weightSpec
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// TestAliasSamplerDistribution checks that the default weight tables are
+// sampled in proportion to their normalized weights.
+func TestAliasSamplerDistribution(t *testing.T) {
+	tables, err := parseWeights(flag.Lookup("weights").DefValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 200000
+	for _, v := range []int{1, 3} {
+		s, err := samplerFor(tables, v, dogs)
+		if err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		var total float64
+		want := make(map[string]float64, len(dogs))
+		for _, d := range dogs {
+			want[d] = 1
+			if x, ok := tables[v][d]; ok {
+				want[d] = x
+			}
+			total += want[d]
+		}
+		counts := make(map[string]int, len(dogs))
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < n; i++ {
+			counts[s.sample(r)]++
+		}
+		for _, d := range dogs {
+			p := want[d] / total
+			got := float64(counts[d]) / n
+			// about 4.5 standard deviations at this sample size
+			if math.Abs(got-p) > 0.005 {
+				t.Errorf("version %d: %s sampled %.4f of the time, want %.4f", v, d, got, p)
+			}
+		}
+	}
+}
+
+func TestAliasSamplerZeroWeight(t *testing.T) {
+	s, err := newAliasSampler([]string{"a", "b", "c"}, []float64{1, 0, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		if d := s.sample(r); d == "b" {
+			t.Fatal("sampled an item that weighs nothing")
+		}
+	}
+}
+
+func TestAliasSamplerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		items   []string
+		weights []float64
+		want    string
+	}{
+		{"negative", []string{"a", "b"}, []float64{1, -1}, "negative"},
+		{"all zero", []string{"a", "b"}, []float64{0, 0}, "zero"},
+		{"mismatched", []string{"a", "b"}, []float64{1}, "one weight per item"},
+		{"empty", nil, nil, "one weight per item"},
+	}
+	for _, tt := range tests {
+		_, err := newAliasSampler(tt.items, tt.weights)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"", true},
+		{"1:mike=5;3:amit=3,dan=5", true},
+		{"1:mike=0", true},
+		{"1:rex=5", false},
+		{"1:mike=-1", false},
+		{"1:mike", false},
+		{"x:mike=1", false},
+		{"mike=1", false},
+	}
+	for _, tt := range tests {
+		_, err := parseWeights(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseWeights(%q): got error %v, want ok=%v", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func BenchmarkAliasSample(b *testing.B) {
+	tables, err := parseWeights(flag.Lookup("weights").DefValue)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s, err := samplerFor(tables, 3, dogs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.sample(r)
+	}
+}